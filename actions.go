@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"network-dispatcher/config"
+	dbusapi "network-dispatcher/dbus_api"
+	"network-dispatcher/mount"
+	"network-dispatcher/shell"
+	sshtunnel "network-dispatcher/ssh_tunnel"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Keeps ssh tunnels started by ssh_tunnel entities
+var tunnels = sshtunnel.NewManager()
+
+// runAction runs built-in action of the entity. Result is reported the same way as script result
+// along with structured action result if action provides it
+//
+// ctx stops the action, e.g. mount retries, once the event dispatch is interrupted
+func runAction(ctx context.Context, entity *matchedEntity, event config.Event) (*shell.ExecScriptOut, any) {
+	started := time.Now()
+	var out string
+	var result any
+	var err error
+	switch entity.Action {
+	case config.ActionSSHTunnel:
+		out, err = runSSHTunnel(entity.SSHTunnel, event)
+	case config.ActionMount:
+		var mountResult *mount.Result
+		mountResult, err = runMount(ctx, entity.Mount, time.Duration(entity.Timeout), event)
+		out, result = mountResult.String(), mountResult
+	default:
+		err = fmt.Errorf("unsupported action %s", entity.Action)
+	}
+	execOut := &shell.ExecScriptOut{
+		ScriptName: entity.Action,
+		Out:        out,
+		Combined:   out,
+		Started:    started,
+		Duration:   time.Since(started)}
+	if err != nil {
+		execOut.Err = err.Error()
+	}
+	return execOut, result
+}
+
+// stopsAction reports whether the event means the network is gone or unusable,
+// so built-in actions stop instead of starting
+func stopsAction(event string) bool {
+	switch event {
+	case Disconnected,
+		ConnectivityEventPrefix + dbusapi.ConnectivityName(dbusapi.NM_CONNECTIVITY_NONE),
+		ConnectivityEventPrefix + dbusapi.ConnectivityName(dbusapi.NM_CONNECTIVITY_LIMITED),
+		ConnectivityEventPrefix + dbusapi.ConnectivityName(dbusapi.NM_CONNECTIVITY_PORTAL):
+		return true
+	}
+	return false
+}
+
+// runMount unmounts the share on events which stop actions and mounts it on any other one.
+//
+// All mount attempts are given the timeout, config.DefaultMountTimeout when it's zero
+func runMount(ctx context.Context, conf *config.Mount, timeout time.Duration, event config.Event) (*mount.Result, error) {
+	share := mount.Share{
+		Source:         conf.Source,
+		Target:         os.ExpandEnv(conf.Target),
+		Link:           os.ExpandEnv(conf.Link),
+		Attempts:       conf.GetAttempts(),
+		RetryDelay:     conf.GetRetryDelay(),
+		MaxRetryDelay:  conf.GetMaxRetryDelay(),
+		AttemptTimeout: conf.GetAttemptTimeout(),
+		UnmountTimeout: conf.GetUnmountTimeout()}
+	if stopsAction(event.Event) {
+		return share.Unmount()
+	}
+	if timeout == 0 {
+		timeout = config.DefaultMountTimeout
+	}
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, fmt.Errorf("mount did not finish in %s", timeout))
+	defer cancel()
+	return share.Mount(ctx)
+}
+
+// runSSHTunnel stops the tunnel on events which stop actions and starts it on any other one
+func runSSHTunnel(tunnel *config.SSHTunnel, event config.Event) (string, error) {
+	name := tunnel.GetName()
+	if stopsAction(event.Event) {
+		if !tunnels.Stop(name) {
+			return fmt.Sprintf("ssh tunnel %s is not running", name), nil
+		}
+		return fmt.Sprintf("ssh tunnel %s stopped", name), nil
+	}
+
+	opts := sshtunnel.Options{
+		Name:              name,
+		Address:           net.JoinHostPort(tunnel.Host, strconv.Itoa(tunnel.GetPort())),
+		User:              tunnel.User,
+		KeyFile:           os.ExpandEnv(tunnel.Key),
+		KnownHostsFile:    tunnel.GetKnownHosts(),
+		KeepaliveInterval: tunnel.GetKeepaliveInterval(),
+		KeepaliveCountMax: tunnel.GetKeepaliveCountMax()}
+	for _, f := range tunnel.Forwards {
+		forward, err := config.ParseForward(f)
+		if err != nil {
+			return "", err
+		}
+		opts.Forwards = append(opts.Forwards, sshtunnel.Forward{Local: forward.Local, Remote: forward.Remote})
+	}
+	if err := tunnels.Start(opts, tunnel.GetStartTimeout()); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("ssh tunnel %s is connected", name), nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"network-dispatcher/config"
+	"network-dispatcher/mount"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// writeKey writes new private key in openssh format into the temporary directory
+func writeKey(t *testing.T) string {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// connectingTunnel returns tunnel to the ssh server which never answers, so the tunnel keeps connecting
+func connectingTunnel(t *testing.T) *config.SSHTunnel {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	port := listener.Addr().(*net.TCPAddr).Port
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	free.Close()
+	forward := fmt.Sprintf("%d:127.0.0.1:22", free.Addr().(*net.TCPAddr).Port)
+	return &config.SSHTunnel{Name: "office", Host: "127.0.0.1", Port: port, User: "user", Key: writeKey(t),
+		KnownHosts: filepath.Join(t.TempDir(), "known_hosts"), Forwards: []string{forward},
+		StartTimeout: config.Duration(100 * time.Millisecond)}
+}
+
+func TestActionsStopOnLostConnectivity(t *testing.T) {
+	tunnel := connectingTunnel(t)
+	share := &config.Mount{Source: "//192.168.1.1/Storage", Target: t.TempDir()}
+	for _, event := range []string{Disconnected, "connectivity-none", "connectivity-limited", "connectivity-portal"} {
+		t.Run(event, func(t *testing.T) {
+			out, err := runSSHTunnel(tunnel, config.Event{Event: event})
+			if err != nil || out != "ssh tunnel office is not running" {
+				t.Errorf("runSSHTunnel() = %q, %v, want stop of not running tunnel", out, err)
+			}
+			if status := tunnels.Status(); len(status) != 0 {
+				t.Errorf("tunnels = %+v, want none started", status)
+			}
+			result, err := runMount(context.Background(), share, 0, config.Event{Event: event})
+			if err != nil || result.Status != mount.StatusNotMounted {
+				t.Errorf("runMount() = %+v, %v, want unmount of not mounted share", result, err)
+			}
+		})
+	}
+
+	// connectivity coming back starts the tunnel again
+	if _, err := runSSHTunnel(tunnel, config.Event{Event: "connectivity-full"}); err == nil {
+		t.Error("runSSHTunnel() connected to server which never answers")
+	}
+	defer tunnels.Stop("office")
+	if status := tunnels.Status(); len(status) != 1 {
+		t.Errorf("tunnels = %+v, want started tunnel", status)
+	}
+}
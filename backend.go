@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"network-dispatcher/config"
+	dbusapi "network-dispatcher/dbus_api"
+	"network-dispatcher/logging"
+	"network-dispatcher/netlink_api"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Sources of network events selected with --backend
+const (
+	BackendNetworkManager = "networkmanager"
+	BackendNetlink        = "netlink"
+)
+
+// eventBackend is a source of network events. All backends feed the same dispatch pipeline
+type eventBackend interface {
+	// start remembers networks connected before the daemon started. Their connect scripts are not run
+	start()
+	// monitor dispatches network events forever
+	monitor()
+}
+
+func newEventBackend(name string, d *networkDispatcher) (eventBackend, error) {
+	switch name {
+	case BackendNetworkManager:
+		return &networkManagerBackend{d: d}, nil
+	case BackendNetlink:
+		return &netlinkBackend{d: d, updates: netlink_api.Kernel{}}, nil
+	}
+	return nil, fmt.Errorf("unsupported backend %q. Supported backends: %s, %s", name, BackendNetworkManager, BackendNetlink)
+}
+
+// networkManagerBackend listens NetworkManager device signals on the system bus
+type networkManagerBackend struct {
+	d *networkDispatcher
+}
+
+func (b *networkManagerBackend) start() {
+	if err := dbusapi.Connect(); err != nil {
+		// monitor keeps reconnecting and resyncs network state once bus is available
+		slog.Warn("Failed to connect to DBus", logging.Error, err)
+		return
+	}
+	b.d.syncOnStartup()
+	takeSleepLock()
+}
+
+func (b *networkManagerBackend) monitor() {
+	go netlink_api.WatchDefaultRoutes(b.d.onDefaultRouteChanged)
+	dbusapi.MonitorNetworkCardStateChanged(b.d.signalHandlers())
+}
+
+// syncOnStartup remembers NetworkManager state without dispatching it
+func (d *networkDispatcher) syncOnStartup() {
+	// perform initial gateway aquire.
+	// when service starts on boot then gateway is not yet available. But it's fine because gateway is used only by disconnect hooks
+	// onConnect event updates gateway in realtime from the received config and does not rely on saveNetworkStateOnStartup
+	d.saveNetworkStateOnStartup()
+	d.syncConnectivity(false)
+	d.syncPrimary()
+}
+
+// signalHandlers dispatches NetworkManager and logind signals. Shared by the daemon and the replay command
+func (d *networkDispatcher) signalHandlers() dbusapi.SignalHandlers {
+	return dbusapi.SignalHandlers{
+		OnConnected:                func(devicePath dbus.ObjectPath) { d.events.push(devicePath, Connected) },
+		OnDisconnected:             func(devicePath dbus.ObjectPath) { d.events.push(devicePath, Disconnected) },
+		OnConnectivityChanged:      d.onConnectivityChanged,
+		OnPrimaryConnectionChanged: func(dbus.ObjectPath) { d.onPrimaryMightChange() },
+		OnResync:                   d.onResync,
+		OnPrepareForSleep:          d.onPrepareForSleep,
+		OnSignal:                   d.recorder.Signal}
+}
+
+// onDefaultRouteChanged is called on kernel default route updates
+func (d *networkDispatcher) onDefaultRouteChanged() {
+	d.recorder.RouteChanged()
+	d.onPrimaryMightChange()
+}
+
+// netlinkBackend derives events from kernel default routes and link states.
+// Works without NetworkManager, e.g. with systemd-networkd or iwd
+type netlinkBackend struct {
+	d       *networkDispatcher
+	updates netlink_api.LinkUpdates
+	// default gateways by interface name known on start
+	initial map[string]string
+}
+
+func (b *netlinkBackend) start() {
+	gateways, err := b.d.routes.GetDefaultGateways()
+	if err != nil {
+		slog.Warn("Failed to get default gateways on startup. Gateway dependant scripts will not run", logging.Error, err)
+	}
+	// networks connected before start are never reported as connected, even when their gateway is not resolved
+	b.initial = gateways
+	for ifName, gateway := range gateways {
+		if gatewayEntity := b.d.getLinkNetwork(ifName, gateway); gatewayEntity != nil {
+			slog.Info("Found gateway on startup", networkAttrs(gatewayEntity)...)
+			state.setNetwork(*gatewayEntity)
+		}
+	}
+	b.d.syncPrimary()
+}
+
+func (b *netlinkBackend) monitor() {
+	go netlink_api.WatchDefaultRoutes(b.d.onPrimaryMightChange)
+	b.watchLinks(context.Background())
+}
+
+// watchLinks queues connected and disconnected events of interfaces until ctx is done
+func (b *netlinkBackend) watchLinks(ctx context.Context) {
+	netlink_api.MonitorDefaultRoutes(ctx, b.d.routes, b.updates, b.initial, netlink_api.LinkHandlers{
+		OnConnected: func(ifName string, gateway string) {
+			b.d.events.enqueue(deviceEvent{key: linkQueueKey(ifName), event: Connected, dispatch: func(ctx context.Context) { b.d.onLinkConnected(ctx, ifName, gateway) }})
+		},
+		OnDisconnected: func(ifName string) {
+			b.d.events.enqueue(deviceEvent{key: linkQueueKey(ifName), event: Disconnected, dispatch: func(context.Context) { b.d.onLinkDisconnected(ifName) }})
+		}})
+}
+
+// Event queue of the interface. Interfaces have no NetworkManager device path in netlink backend
+func linkQueueKey(ifName string) string {
+	return "link:" + ifName
+}
+
+func (d *networkDispatcher) onLinkConnected(ctx context.Context, ifName string, gateway string) {
+	slog.Info("Netlink network connected event", logging.Interface, ifName, logging.Gateway, gateway)
+	if gatewayEntity := d.getLinkNetwork(ifName, gateway); gatewayEntity != nil {
+		networkConnected(ctx, gatewayEntity)
+	}
+}
+
+func (d *networkDispatcher) onLinkDisconnected(ifName string) {
+	slog.Info("Netlink network disconnected event", logging.Interface, ifName)
+	gatewayEntity := state.removeNetwork(ifName, "")
+	if gatewayEntity == nil {
+		slog.Info("No connected network saved. Disconnect scripts will not run", logging.Interface, ifName)
+		return
+	}
+	dispatchDisconnected(gatewayEntity)
+}
+
+// getLinkNetwork resolves network details available through netlink.
+// Returns nil when interface is not used by any entity or gateway macaddress is unknown
+func (d *networkDispatcher) getLinkNetwork(ifName string, gateway string) *config.ConnectedGateway {
+	deviceType := d.routes.GetDeviceType(ifName)
+	if !isDeviceTypeDispatched(deviceType) {
+		return nil
+	}
+	gatewayEntity, err := d.getGatewayEntity(gateway)
+	if err != nil {
+		slog.Warn("Failed to create gateway entity", logging.Interface, ifName, logging.Error, err)
+		return nil
+	}
+	gatewayEntity.Interface = ifName
+	gatewayEntity.DeviceType = deviceType
+	gatewayEntity.ConnectedAt = time.Now()
+	return gatewayEntity
+}
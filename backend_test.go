@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"network-dispatcher/netlink_api"
+	"slices"
+	"testing"
+)
+
+func TestNetlinkBackendDerivesEvents(t *testing.T) {
+	d, _, routes := newTestDispatcher(t)
+	routes.AddRoute(netlink_api.DefaultRoute{Interface: "wlan0", Gateway: homeGateway, Metric: 600})
+	b := &netlinkBackend{d: d, updates: routes}
+	b.start()
+	if got := savedNetworks(); !slices.Equal(got, []string{"wlan0 " + homeMac}) {
+		t.Fatalf("saved networks on start = %q, want wlan0", got)
+	}
+
+	lookup := afterCalls(2, func() { routes.SetNeighbour(homeGateway, homeMac) })
+	routes.OnNeighbourLookup = func(ip string) { lookup() }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	monitorDone := make(chan struct{})
+	go func() {
+		b.watchLinks(ctx)
+		close(monitorDone)
+	}()
+	defer func() {
+		cancel()
+		<-monitorDone
+		d.events.wait()
+	}()
+
+	// link goes down with its routes
+	routes.RemoveRoutes("wlan0")
+	waitForEvents(t, 0, []string{"disconnected wlan0 " + homeMac})
+
+	// gateway macaddress is in the neighbour table only after arp reply
+	routes.SetNeighbour(homeGateway, "")
+	routes.AddRoute(netlink_api.DefaultRoute{Interface: "wlan0", Gateway: homeGateway, Metric: 600})
+	waitForEvents(t, 1, []string{"connected wlan0 " + homeMac})
+
+	// interfaces of not dispatched device types are ignored
+	routes.AddRoute(netlink_api.DefaultRoute{Interface: "eth0", Gateway: "10.0.0.1", Metric: 100})
+	routes.RemoveRoutes("eth0")
+
+	// change missed while subscription is lost is found after resubscribe
+	routes.DropSubscriptions()
+	routes.RemoveRoutes("wlan0")
+	waitForEvents(t, 2, []string{"disconnected wlan0 " + homeMac})
+	if got := savedNetworks(); len(got) != 0 {
+		t.Errorf("saved networks = %q, want none", got)
+	}
+}
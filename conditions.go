@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"network-dispatcher/config"
+	"network-dispatcher/probe"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Prefix of variables with probe results passed to the scripts, e.g. DISPATCHER_CONDITION_0_RESULT
+const DISPATCHER_CONDITION_PREFIX = "DISPATCHER_CONDITION_"
+
+// runConditions runs entity probes in parallel.
+//
+// Returns probe results as script environment variables and error when any of the probes failed
+func runConditions(entity *config.Entity) (map[string]string, error) {
+	results := make([]probe.Result, len(entity.Conditions))
+	var wg sync.WaitGroup
+	for i, condition := range entity.Conditions {
+		wg.Add(1)
+		go func(i int, p probe.Probe) {
+			defer wg.Done()
+			results[i] = p.Run(context.Background())
+		}(i, condition.Probe())
+	}
+	wg.Wait()
+
+	envVars := map[string]string{}
+	var failed []string
+	for i, result := range results {
+		prefix := fmt.Sprintf("%s%d_", DISPATCHER_CONDITION_PREFIX, i)
+		envVars[prefix+"TYPE"] = result.Type
+		envVars[prefix+"TARGET"] = result.Target
+		envVars[prefix+"PASSED"] = strconv.FormatBool(result.Passed)
+		envVars[prefix+"ATTEMPTS"] = strconv.Itoa(result.Attempts)
+		envVars[prefix+"DURATION"] = result.Duration.String()
+		envVars[prefix+"RESULT"] = result.Detail
+		if !result.Passed {
+			failed = append(failed, fmt.Sprintf("%s %s: %s", result.Type, result.Target, result.Error))
+			continue
+		}
+		slog.Debug("Condition passed", "condition", result.Type, "target", result.Target, "result", result.Detail)
+	}
+	if len(failed) > 0 {
+		return envVars, fmt.Errorf("conditions failed: %s", strings.Join(failed, "; "))
+	}
+	return envVars, nil
+}
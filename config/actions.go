@@ -0,0 +1,295 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Built-in actions which entities could run instead of the Script
+const (
+	// Keeps ssh tunnel with local port forwards.
+	// Stopped on disconnected, connectivity-none, connectivity-limited and connectivity-portal events and started on others
+	ActionSSHTunnel = "ssh_tunnel"
+	// Mounts fstab share. Unmounted on the same events ssh tunnel is stopped
+	ActionMount = "mount"
+)
+
+var SupportedActions = []string{ActionSSHTunnel, ActionMount}
+
+const (
+	DefaultSSHPort              = 22
+	DefaultSSHKeepaliveInterval = 10 * time.Second
+	DefaultSSHKeepaliveCountMax = 3
+	// Time connected event waits for the tunnel to connect, so next entity could mount share through it
+	DefaultSSHStartTimeout = 20 * time.Second
+
+	DefaultMountAttempts      = 10
+	DefaultMountRetryDelay    = time.Second
+	DefaultMountMaxRetryDelay = 30 * time.Second
+	DefaultUnmountTimeout     = 10 * time.Second
+	// Time all mount attempts are given when entity Timeout is empty
+	DefaultMountTimeout = 5 * time.Minute
+	// mount command is killed when single attempt hangs longer, e.g. on unreachable server
+	DefaultMountAttemptTimeout = 30 * time.Second
+)
+
+// SSHTunnel configures ssh_tunnel action
+type SSHTunnel struct {
+	// Identifies the tunnel between connected and disconnected entities. User@Host:Port when empty
+	Name string `json:",omitempty"`
+	Host string
+	// 22 when empty
+	Port int `json:",omitempty"`
+	User string
+	// Path to the private key. Supports sh environment variables such as $HOME
+	Key string
+	// $HOME/.ssh/known_hosts when empty
+	KnownHosts string `json:",omitempty"`
+	// Local port forwards in ssh -L format: [bind_address:]port:host:hostport
+	Forwards []string
+	// Interval of keepalive requests. 10s when empty
+	KeepaliveInterval Duration `json:",omitempty"`
+	// Connection is restarted after so many unanswered keepalives. 3 when empty
+	KeepaliveCountMax int `json:",omitempty"`
+	// Time connected event waits for the tunnel to connect. 20s when empty
+	StartTimeout Duration `json:",omitempty"`
+}
+
+// Mount configures mount action. Share must be present in /etc/fstab with noauto and user or users options
+type Mount struct {
+	// fstab source of the share, e.g. //192.168.1.1/Storage
+	Source string `json:",omitempty"`
+	// Mount directory. Looked up in fstab by Source when empty
+	Target string `json:",omitempty"`
+	// Symlink pointed to the mount directory after mount. Supports sh environment variables such as $HOME
+	Link string `json:",omitempty"`
+	// Number of mount attempts. 10 when empty
+	Attempts int `json:",omitempty"`
+	// Delay after the first failed attempt. Doubled after each next one up to MaxRetryDelay. 1s when empty
+	RetryDelay Duration `json:",omitempty"`
+	// 30s when empty
+	MaxRetryDelay Duration `json:",omitempty"`
+	// mount command is killed when it runs longer. 30s when empty
+	AttemptTimeout Duration `json:",omitempty"`
+	// Time given to lazy unmount to detach the share. 10s when empty
+	UnmountTimeout Duration `json:",omitempty"`
+}
+
+func (m *Mount) GetAttempts() int {
+	if m.Attempts == 0 {
+		return DefaultMountAttempts
+	}
+	return m.Attempts
+}
+
+func (m *Mount) GetRetryDelay() time.Duration {
+	if m.RetryDelay == 0 {
+		return DefaultMountRetryDelay
+	}
+	return time.Duration(m.RetryDelay)
+}
+
+func (m *Mount) GetMaxRetryDelay() time.Duration {
+	if m.MaxRetryDelay == 0 {
+		return DefaultMountMaxRetryDelay
+	}
+	return time.Duration(m.MaxRetryDelay)
+}
+
+func (m *Mount) GetAttemptTimeout() time.Duration {
+	if m.AttemptTimeout == 0 {
+		return DefaultMountAttemptTimeout
+	}
+	return time.Duration(m.AttemptTimeout)
+}
+
+func (m *Mount) GetUnmountTimeout() time.Duration {
+	if m.UnmountTimeout == 0 {
+		return DefaultUnmountTimeout
+	}
+	return time.Duration(m.UnmountTimeout)
+}
+
+// Forward is a parsed local port forward
+type Forward struct {
+	// Local listen address, e.g. 127.0.0.1:4445
+	Local string
+	// Address dialed on the ssh server side, e.g. 127.0.0.1:445
+	Remote string
+}
+
+func (f Forward) String() string {
+	return f.Local + " -> " + f.Remote
+}
+
+// ParseForward parses forward in ssh -L format: [bind_address:]port:host:hostport.
+// Local port is bound to 127.0.0.1 when bind address is absent
+func ParseForward(forward string) (Forward, error) {
+	parts := strings.Split(forward, ":")
+	var bind string
+	switch len(parts) {
+	case 3:
+		bind = "127.0.0.1"
+	case 4:
+		bind, parts = parts[0], parts[1:]
+	default:
+		return Forward{}, fmt.Errorf("invalid forward %q. Expected [bind_address:]port:host:hostport", forward)
+	}
+	for _, port := range []string{parts[0], parts[2]} {
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			return Forward{}, fmt.Errorf("invalid port %q in forward %q", port, forward)
+		}
+	}
+	if parts[1] == "" {
+		return Forward{}, fmt.Errorf("empty host in forward %q", forward)
+	}
+	return Forward{
+		Local:  net.JoinHostPort(bind, parts[0]),
+		Remote: net.JoinHostPort(parts[1], parts[2])}, nil
+}
+
+// GetName returns name identifying the tunnel
+func (t *SSHTunnel) GetName() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return fmt.Sprintf("%s@%s", t.User, net.JoinHostPort(t.Host, strconv.Itoa(t.GetPort())))
+}
+
+func (t *SSHTunnel) GetPort() int {
+	if t.Port == 0 {
+		return DefaultSSHPort
+	}
+	return t.Port
+}
+
+func (t *SSHTunnel) GetKnownHosts() string {
+	if t.KnownHosts != "" {
+		return os.ExpandEnv(t.KnownHosts)
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+func (t *SSHTunnel) GetKeepaliveInterval() time.Duration {
+	if t.KeepaliveInterval == 0 {
+		return DefaultSSHKeepaliveInterval
+	}
+	return time.Duration(t.KeepaliveInterval)
+}
+
+func (t *SSHTunnel) GetKeepaliveCountMax() int {
+	if t.KeepaliveCountMax == 0 {
+		return DefaultSSHKeepaliveCountMax
+	}
+	return t.KeepaliveCountMax
+}
+
+func (t *SSHTunnel) GetStartTimeout() time.Duration {
+	if t.StartTimeout == 0 {
+		return DefaultSSHStartTimeout
+	}
+	return time.Duration(t.StartTimeout)
+}
+
+func IsSupportedAction(action string) bool {
+	for _, supported := range SupportedActions {
+		if action == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAction reports problems of the entity built-in action
+func checkAction(r *Report, path string, entity *Entity) {
+	if !IsSupportedAction(entity.Action) {
+		r.Addf(path+".Action", "unsupported Action %q. Supported actions: %s", entity.Action, strings.Join(SupportedActions, ", "))
+		return
+	}
+	if entity.Script != "" {
+		r.Addf(path+".Script", "Script could not be used together with Action")
+	}
+	// actions run inside the daemon, there is no script process to queue, skip or kill
+	if entity.Concurrency != "" {
+		r.Addf(path+".Concurrency", "Concurrency could not be used together with Action")
+	}
+	if entity.KillGracePeriod != 0 {
+		r.Addf(path+".KillGracePeriod", "KillGracePeriod could not be used together with Action")
+	}
+	if entity.Action == ActionSSHTunnel && entity.Timeout != 0 {
+		r.Addf(path+".Timeout", "Timeout could not be used together with %s action. Use SSHTunnel.StartTimeout", ActionSSHTunnel)
+	}
+	switch entity.Action {
+	case ActionSSHTunnel:
+		checkSSHTunnel(r, path+".SSHTunnel", entity.SSHTunnel)
+	case ActionMount:
+		checkMount(r, path+".Mount", entity.Mount)
+	}
+}
+
+func checkMount(r *Report, path string, mount *Mount) {
+	if mount == nil {
+		r.Addf(path, "Mount is required for %s action", ActionMount)
+		return
+	}
+	if mount.Source == "" && mount.Target == "" {
+		r.Addf(path, "either Source or Target is required")
+	}
+	if mount.Attempts < 0 {
+		r.Addf(path+".Attempts", "Attempts must not be negative")
+	}
+	if mount.RetryDelay < 0 {
+		r.Addf(path+".RetryDelay", "RetryDelay must not be negative")
+	}
+	if mount.MaxRetryDelay < 0 {
+		r.Addf(path+".MaxRetryDelay", "MaxRetryDelay must not be negative")
+	}
+	if mount.AttemptTimeout < 0 {
+		r.Addf(path+".AttemptTimeout", "AttemptTimeout must not be negative")
+	}
+	if mount.UnmountTimeout < 0 {
+		r.Addf(path+".UnmountTimeout", "UnmountTimeout must not be negative")
+	}
+}
+
+func checkSSHTunnel(r *Report, path string, tunnel *SSHTunnel) {
+	if tunnel == nil {
+		r.Addf(path, "SSHTunnel is required for %s action", ActionSSHTunnel)
+		return
+	}
+	if tunnel.Host == "" {
+		r.Addf(path+".Host", "Host is empty")
+	}
+	if tunnel.User == "" {
+		r.Addf(path+".User", "User is empty")
+	}
+	if tunnel.Key == "" {
+		r.Addf(path+".Key", "Key is empty")
+	}
+	if tunnel.Port < 0 || tunnel.Port > 65535 {
+		r.Addf(path+".Port", "invalid Port %d", tunnel.Port)
+	}
+	if len(tunnel.Forwards) == 0 {
+		r.Addf(path+".Forwards", "at least one forward is required")
+	}
+	for i, forward := range tunnel.Forwards {
+		if _, err := ParseForward(forward); err != nil {
+			r.Addf(fmt.Sprintf("%s.Forwards[%d]", path, i), "%v", err)
+		}
+	}
+	if tunnel.KeepaliveInterval < 0 {
+		r.Addf(path+".KeepaliveInterval", "KeepaliveInterval must not be negative")
+	}
+	if tunnel.KeepaliveCountMax < 0 {
+		r.Addf(path+".KeepaliveCountMax", "KeepaliveCountMax must not be negative")
+	}
+	if tunnel.StartTimeout < 0 {
+		r.Addf(path+".StartTimeout", "StartTimeout must not be negative")
+	}
+}
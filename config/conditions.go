@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"network-dispatcher/probe"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultConditionTimeout = 3 * time.Second
+	DefaultConditionRetries = 2
+)
+
+// Condition is a reachability probe which must pass for the entity to run
+type Condition struct {
+	// tcp, ping, dns or http
+	Type string
+	// host:port for tcp, host for ping, name for dns and url for http
+	Target string
+	// Address dns Target must resolve to
+	ExpectedAddress string `json:",omitempty"`
+	// Status http GET must return. 200 when empty
+	ExpectedStatus int `json:",omitempty"`
+	// Timeout of the single attempt. 3s when empty
+	Timeout Duration `json:",omitempty"`
+	// Number of attempts after the first failed one. 2 when nil
+	Retries *int `json:",omitempty"`
+}
+
+// Probe converts condition into the probe with defaults applied
+func (c *Condition) Probe() probe.Probe {
+	p := probe.Probe{
+		Type:            c.Type,
+		Target:          c.Target,
+		ExpectedAddress: c.ExpectedAddress,
+		ExpectedStatus:  c.ExpectedStatus,
+		Timeout:         time.Duration(c.Timeout),
+		Retries:         DefaultConditionRetries}
+	if p.ExpectedStatus == 0 {
+		p.ExpectedStatus = http.StatusOK
+	}
+	if p.Timeout == 0 {
+		p.Timeout = DefaultConditionTimeout
+	}
+	if c.Retries != nil {
+		p.Retries = *c.Retries
+	}
+	return p
+}
+
+func checkConditions(r *Report, path string, conditions []Condition) {
+	for i, condition := range conditions {
+		conditionPath := fmt.Sprintf("%s[%d]", path, i)
+		if !slices.Contains(probe.Types, condition.Type) {
+			r.Addf(conditionPath+".Type", "unsupported Type %q. Supported types: %s", condition.Type, strings.Join(probe.Types, ", "))
+			continue
+		}
+		if condition.Target == "" {
+			r.Addf(conditionPath+".Target", "Target is empty")
+			continue
+		}
+		switch condition.Type {
+		case probe.TypeTCP:
+			if _, _, err := net.SplitHostPort(condition.Target); err != nil {
+				r.Addf(conditionPath+".Target", "tcp Target must be host:port: %v", err)
+			}
+		case probe.TypeDNS:
+			if net.ParseIP(condition.ExpectedAddress) == nil {
+				r.Addf(conditionPath+".ExpectedAddress", "invalid ExpectedAddress %q", condition.ExpectedAddress)
+			}
+		case probe.TypeHTTP:
+			if u, err := url.Parse(condition.Target); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				r.Addf(conditionPath+".Target", "http Target must be http or https url")
+			}
+			if condition.ExpectedStatus != 0 && (condition.ExpectedStatus < 100 || condition.ExpectedStatus > 599) {
+				r.Addf(conditionPath+".ExpectedStatus", "invalid ExpectedStatus %d", condition.ExpectedStatus)
+			}
+		}
+		if condition.Timeout < 0 {
+			r.Addf(conditionPath+".Timeout", "Timeout must not be negative")
+		}
+		if condition.Retries != nil && *condition.Retries < 0 {
+			r.Addf(conditionPath+".Retries", "Retries must not be negative")
+		}
+	}
+}
@@ -2,29 +2,90 @@ package config
 
 import (
 	"fmt"
+	"network-dispatcher/shell"
 	"slices"
+	"strings"
+	"time"
 )
 
 type Entity struct {
 	IncludedMacAddresses []string `json:"Included_MacAddresses,omitempty"`
 	ExcludedMacAddresses []string `json:"Excluded_MacAddresses,omitempty"`
-	Script               string   `json:"Script"`
-	// Supported events: connect, disconnect
+	IncludedSSIDs        []string `json:"Included_SSIDs,omitempty"`
+	ExcludedSSIDs        []string `json:"Excluded_SSIDs,omitempty"`
+	// Access point mac addresses
+	IncludedBSSIDs []string `json:"Included_BSSIDs,omitempty"`
+	// NetworkManager connection profile names or UUIDs
+	IncludedConnections []string `json:"Included_Connections,omitempty"`
+	ExcludedConnections []string `json:"Excluded_Connections,omitempty"`
+	// NetworkManager device types the entity applies to, e.g. wifi, ethernet, wireguard.
+	// Only wifi devices are matched when empty
+	DeviceTypes []string `json:"DeviceTypes,omitempty"`
+	// Script or built-in Action is executed on the event
+	Script string `json:"Script,omitempty"`
+	// Built-in action, e.g. ssh_tunnel. Executed instead of the Script
+	Action string `json:"Action,omitempty"`
+	// Configuration of ssh_tunnel action
+	SSHTunnel *SSHTunnel `json:"SSHTunnel,omitempty"`
+	// Configuration of mount action
+	Mount *Mount `json:"Mount,omitempty"`
+	// Reachability probes. Entity runs only when all of them pass
+	Conditions []Condition `json:"Conditions,omitempty"`
+	// Supported events: connected, disconnected, reconnected, primary-changed
+	// and connectivity-full, connectivity-limited, connectivity-portal, connectivity-none. See SupportedEvents
 	Event          string            `json:"Event"`
 	EnvVariables   map[string]string `json:"EnvVariables,omitempty"`
 	ContinueOnFail bool              `json:"ContinueOnFail,omitempty"`
+	// Script is terminated with SIGTERM when it runs longer. Waits forever when empty.
+	// Limits all attempts of mount action, 5m when empty
+	Timeout Duration `json:"Timeout,omitempty"`
+	// Time between SIGTERM and SIGKILL sent to the timed out script. 5s when empty
+	KillGracePeriod Duration `json:"KillGracePeriod,omitempty"`
+	// What to do when the entity script is started again while its previous run is still running:
+	// kill-previous, queue, skip-if-running or run-parallel. kill-previous when empty
+	Concurrency string `json:"Concurrency,omitempty"`
+	// Disconnect script runs only when network doesn't come back to the same gateway within the window.
+	// Connect script doesn't run again when it does. Configuration Debounce is used when empty
+	Debounce Duration `json:"Debounce,omitempty"`
 }
 
 type Event struct {
 	Gateway    string
 	MacAddress string
 	Event      string
+	DeviceType string
+	// Network interface name, e.g. wlan0
+	Interface string
+	// Wifi network name and access point mac address. Empty for non wifi devices
+	SSID  string
+	BSSID string
+	// NetworkManager connection profile
+	ConnectionId   string
+	ConnectionUuid string
+	ConnectionType string
+	// Network which was primary before primary-changed event. Empty for other events
+	PreviousInterface  string `json:",omitempty"`
+	PreviousGateway    string `json:",omitempty"`
+	PreviousMacAddress string `json:",omitempty"`
 }
 
-// Represents currently connected gateway
+// Device types matched by entities without DeviceTypes filter
+var DefaultDeviceTypes = []string{"wifi"}
+
+// Represents network currently connected on the interface
 type ConnectedGateway struct {
-	Gateway    string
-	MacAddress string
+	Interface string `json:",omitempty"`
+	// NetworkManager device object path, e.g. /org/freedesktop/NetworkManager/Devices/3
+	DevicePath     string    `json:",omitempty"`
+	DeviceType     string    `json:",omitempty"`
+	ConnectedAt    time.Time `json:",omitempty"`
+	Gateway        string
+	MacAddress     string
+	SSID           string `json:",omitempty"`
+	BSSID          string `json:",omitempty"`
+	ConnectionId   string `json:",omitempty"`
+	ConnectionUuid string `json:",omitempty"`
+	ConnectionType string `json:",omitempty"`
 }
 
 func (e *Entity) HasIncludedMacAddresses() bool {
@@ -43,6 +104,87 @@ func (e *Entity) ContainsExcludedMacAddress(address string) bool {
 	return slices.Contains(e.ExcludedMacAddresses, address)
 }
 
+func (e *Entity) HasIncludedSSIDs() bool {
+	return len(e.IncludedSSIDs) > 0
+}
+
+func (e *Entity) ContainsIncludedSSID(ssid string) bool {
+	return slices.Contains(e.IncludedSSIDs, ssid)
+}
+
+func (e *Entity) ContainsExcludedSSID(ssid string) bool {
+	return slices.Contains(e.ExcludedSSIDs, ssid)
+}
+
+func (e *Entity) HasIncludedBSSIDs() bool {
+	return len(e.IncludedBSSIDs) > 0
+}
+
+// NetworkManager reports BSSID in upper case, so compare ignoring case
+func (e *Entity) ContainsIncludedBSSID(bssid string) bool {
+	return slices.ContainsFunc(e.IncludedBSSIDs, func(b string) bool {
+		return strings.EqualFold(b, bssid)
+	})
+}
+
+func (e *Entity) HasIncludedConnections() bool {
+	return len(e.IncludedConnections) > 0
+}
+
+// Connection could be referenced either by its name or UUID
+func (e *Entity) ContainsIncludedConnection(id string, uuid string) bool {
+	return containsConnection(e.IncludedConnections, id, uuid)
+}
+
+func (e *Entity) ContainsExcludedConnection(id string, uuid string) bool {
+	return containsConnection(e.ExcludedConnections, id, uuid)
+}
+
+func containsConnection(connections []string, id string, uuid string) bool {
+	return slices.ContainsFunc(connections, func(c string) bool {
+		return (id != "" && c == id) || (uuid != "" && strings.EqualFold(c, uuid))
+	})
+}
+
+func (e *Entity) GetConcurrency() shell.Policy {
+	if e.Concurrency == "" {
+		return shell.DefaultPolicy
+	}
+	return shell.Policy(e.Concurrency)
+}
+
+// Returns device types entity applies to. Falls back to DefaultDeviceTypes
+func (e *Entity) GetDeviceTypes() []string {
+	if len(e.DeviceTypes) == 0 {
+		return DefaultDeviceTypes
+	}
+	return e.DeviceTypes
+}
+
+func (e *Entity) ContainsDeviceType(deviceType string) bool {
+	for _, t := range e.GetDeviceTypes() {
+		if strings.EqualFold(t, deviceType) {
+			return true
+		}
+	}
+	return false
+}
+
 func (cg ConnectedGateway) String() string {
-	return fmt.Sprintf("Gateway: %s    MacAddress: %s", cg.Gateway, cg.MacAddress)
+	out := fmt.Sprintf("Gateway: %s    MacAddress: %s", cg.Gateway, cg.MacAddress)
+	if cg.SSID != "" {
+		out += fmt.Sprintf("    SSID: %s    BSSID: %s", cg.SSID, cg.BSSID)
+	}
+	if cg.ConnectionId != "" {
+		out += fmt.Sprintf("    Connection: %s (%s)", cg.ConnectionId, cg.ConnectionUuid)
+	}
+	return out
+}
+
+// GetDebounce returns entity debounce window or the global one when entity doesn't set it
+func (e *Entity) GetDebounce(global Duration) time.Duration {
+	if e.Debounce > 0 {
+		return time.Duration(e.Debounce)
+	}
+	return time.Duration(global)
 }
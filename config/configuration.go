@@ -0,0 +1,177 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	dbusapi "network-dispatcher/dbus_api"
+	"network-dispatcher/shell"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Events entities could react on
+var SupportedEvents = []string{"connected", "disconnected", "reconnected",
+	"connectivity-full", "connectivity-limited", "connectivity-portal", "connectivity-none", "primary-changed"}
+
+type Configuration struct {
+	// Events of the same device received within the window are coalesced into the last one,
+	// e.g. quick connected -> disconnected -> connected flap becomes just connected. Disabled when empty
+	CoalesceWindow Duration `json:",omitempty"`
+	// Default Debounce of entities which don't set it. Disabled when empty
+	Debounce Duration `json:",omitempty"`
+	Entities []Entity
+}
+
+// Load reads and validates configuration file.
+//
+// Returns os.ErrNotExist wrapped error when file is absent
+func Load(path string) (*Configuration, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("config file not found at %s: %w", path, err)
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	conf, err := Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return conf, nil
+}
+
+// Parse decodes configuration and validates it
+func Parse(content []byte) (*Configuration, error) {
+	conf := Configuration{}
+	if err := json.Unmarshal(content, &conf); err != nil {
+		return nil, err
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return &conf, nil
+}
+
+// Validate checks configuration could be used to dispatch events
+func (c *Configuration) Validate() error {
+	report := &Report{}
+	c.check(report)
+	return report.Err()
+}
+
+// check reports problems of the configuration itself.
+// Does not check anything on the system, e.g. scripts which might be created after config
+func (c *Configuration) check(r *Report) {
+	if c.CoalesceWindow < 0 {
+		r.Addf("CoalesceWindow", "CoalesceWindow must not be negative")
+	}
+	if c.Debounce < 0 {
+		r.Addf("Debounce", "Debounce must not be negative")
+	}
+	for i, entity := range c.Entities {
+		path := fmt.Sprintf("Entities[%d]", i)
+		if entity.Action != "" {
+			checkAction(r, path, &entity)
+		} else if entity.Script == "" {
+			r.Addf(path+".Script", "Script is empty")
+		}
+		if !IsSupportedEvent(entity.Event) {
+			r.Addf(path+".Event", "unsupported Event %q. Supported events: %s",
+				entity.Event, strings.Join(SupportedEvents, ", "))
+		}
+		if entity.Timeout < 0 {
+			r.Addf(path+".Timeout", "Timeout must not be negative")
+		}
+		if entity.KillGracePeriod < 0 {
+			r.Addf(path+".KillGracePeriod", "KillGracePeriod must not be negative")
+		}
+		if entity.Debounce < 0 {
+			r.Addf(path+".Debounce", "Debounce must not be negative")
+		}
+		if entity.Concurrency != "" && !shell.IsValidPolicy(entity.Concurrency) {
+			r.Addf(path+".Concurrency", "unsupported Concurrency %q. Supported values: %v", entity.Concurrency, shell.Policies)
+		}
+		for j, deviceType := range entity.DeviceTypes {
+			if !dbusapi.IsKnownDeviceTypeName(deviceType) {
+				r.Addf(fmt.Sprintf("%s.DeviceTypes[%d]", path, j), "unknown device type %q", deviceType)
+			}
+		}
+		checkConditions(r, path+".Conditions", entity.Conditions)
+		checkMacAddresses(r, path+".Included_MacAddresses", entity.IncludedMacAddresses)
+		checkMacAddresses(r, path+".Excluded_MacAddresses", entity.ExcludedMacAddresses)
+		checkMacAddresses(r, path+".Included_BSSIDs", entity.IncludedBSSIDs)
+		checkContradictions(r, path, "Included_MacAddresses", entity.IncludedMacAddresses, "Excluded_MacAddresses", entity.ExcludedMacAddresses)
+		checkContradictions(r, path, "Included_SSIDs", entity.IncludedSSIDs, "Excluded_SSIDs", entity.ExcludedSSIDs)
+		checkContradictions(r, path, "Included_Connections", entity.IncludedConnections, "Excluded_Connections", entity.ExcludedConnections)
+	}
+}
+
+// checkScripts reports scripts which could not be executed
+func (c *Configuration) checkScripts(r *Report) {
+	for i, entity := range c.Entities {
+		if entity.Script == "" {
+			continue
+		}
+		path := fmt.Sprintf("Entities[%d].Script", i)
+		script := os.ExpandEnv(entity.Script)
+		info, err := os.Stat(script)
+		if err != nil {
+			r.Addf(path, "script %s does not exist", script)
+			continue
+		}
+		if info.IsDir() {
+			r.Addf(path, "script %s is a directory", script)
+			continue
+		}
+		if err := unix.Access(script, unix.X_OK); err != nil {
+			r.Addf(path, "script %s is not executable", script)
+		}
+	}
+}
+
+func checkMacAddresses(r *Report, path string, addresses []string) {
+	for i, address := range addresses {
+		if _, err := net.ParseMAC(address); err != nil {
+			r.Addf(fmt.Sprintf("%s[%d]", path, i), "invalid mac address %q", address)
+		}
+	}
+}
+
+// checkContradictions reports values present in both included and excluded lists. Entity would never run for them
+func checkContradictions(r *Report, path string, includedName string, included []string, excludedName string, excluded []string) {
+	for i, value := range included {
+		for _, excludedValue := range excluded {
+			if strings.EqualFold(value, excludedValue) {
+				r.Addf(fmt.Sprintf("%s.%s[%d]", path, includedName, i), "%q is both in %s and %s", value, includedName, excludedName)
+			}
+		}
+	}
+}
+
+// CheckFile validates config file as strict as possible, including the scripts it references
+func CheckFile(path string) (*Configuration, *Report, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	conf, report := DecodeStrict(content)
+	if conf == nil {
+		return nil, report, nil
+	}
+	conf.check(report)
+	conf.checkScripts(report)
+	return conf, report, nil
+}
+
+func IsSupportedEvent(event string) bool {
+	for _, supported := range SupportedEvents {
+		if strings.EqualFold(event, supported) {
+			return true
+		}
+	}
+	return false
+}
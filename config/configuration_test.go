@@ -0,0 +1,37 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseRejectsUnknownDeviceTypes(t *testing.T) {
+	_, err := Parse([]byte(`{"Entities": [{"Script": "/bin/true", "Event": "connected", "DeviceTypes": ["wifi", "wlan"]}]}`))
+	if err == nil || !strings.Contains(err.Error(), `Entities[0].DeviceTypes[1]: unknown device type "wlan"`) {
+		t.Errorf("Parse() error = %v, want unknown device type", err)
+	}
+}
+
+func TestParseRejectsScriptOptionsOfActions(t *testing.T) {
+	tests := []struct {
+		entity string
+		want   string
+	}{
+		{`{"Action": "mount", "Mount": {"Source": "//nas/share"}, "Event": "connected", "Concurrency": "queue"}`,
+			"Entities[0].Concurrency: Concurrency could not be used together with Action"},
+		{`{"Action": "mount", "Mount": {"Source": "//nas/share"}, "Event": "connected", "KillGracePeriod": "1s"}`,
+			"Entities[0].KillGracePeriod: KillGracePeriod could not be used together with Action"},
+		{`{"Action": "ssh_tunnel", "SSHTunnel": {"Host": "example.com", "User": "user", "Key": "/key", "Forwards": ["4445:127.0.0.1:445"]},
+			"Event": "connected", "Timeout": "1m"}`,
+			"Entities[0].Timeout: Timeout could not be used together with ssh_tunnel action"},
+	}
+	for _, test := range tests {
+		_, err := Parse([]byte(`{"Entities": [` + test.entity + `]}`))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Parse(%s) error = %v, want %q", test.entity, err, test.want)
+		}
+	}
+	if _, err := Parse([]byte(`{"Entities": [{"Action": "mount", "Mount": {"Source": "//nas/share"}, "Event": "connected", "Timeout": "2m"}]}`)); err != nil {
+		t.Errorf("Parse() of mount with Timeout error = %v, want none", err)
+	}
+}
@@ -0,0 +1,321 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// Diagnostic is a single problem found in the config file
+type Diagnostic struct {
+	// 1 based position in the file. 0 when position is unknown
+	Line   int
+	Column int
+	// Field path, e.g. Entities[1].Event
+	Path    string
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	location := ""
+	if d.Line > 0 {
+		location = fmt.Sprintf("%d:%d: ", d.Line, d.Column)
+	}
+	if d.Path != "" {
+		return fmt.Sprintf("%s%s: %s", location, d.Path, d.Message)
+	}
+	return location + d.Message
+}
+
+// Report collects diagnostics for the config file.
+//
+// Remembers positions of all fields to point diagnostics to the exact line in the file
+type Report struct {
+	content []byte
+	// field path -> byte offset of the field key
+	positions   map[string]int64
+	Diagnostics []Diagnostic
+}
+
+func (r *Report) HasProblems() bool {
+	return len(r.Diagnostics) > 0
+}
+
+// Err joins all diagnostics into a single error. Nil when there are no problems
+func (r *Report) Err() error {
+	var errs []error
+	for _, d := range r.Diagnostics {
+		errs = append(errs, errors.New(d.String()))
+	}
+	return errors.Join(errs...)
+}
+
+// Addf adds diagnostic for the field path.
+// Falls back to the closest parent position when field itself is absent in the file
+func (r *Report) Addf(path string, format string, args ...any) {
+	line, column := 0, 0
+	for p := path; p != ""; p = parentPath(p) {
+		if offset, ok := r.positions[p]; ok {
+			line, column = r.lineColumn(offset)
+			break
+		}
+	}
+	r.addAt(line, column, path, fmt.Sprintf(format, args...))
+}
+
+func (r *Report) addAtOffset(offset int64, path string, message string) {
+	line, column := r.lineColumn(offset)
+	r.addAt(line, column, path, message)
+}
+
+func (r *Report) addAt(line int, column int, path string, message string) {
+	r.Diagnostics = append(r.Diagnostics, Diagnostic{Line: line, Column: column, Path: path, Message: message})
+}
+
+func (r *Report) lineColumn(offset int64) (int, int) {
+	if offset > int64(len(r.content)) {
+		offset = int64(len(r.content))
+	}
+	before := r.content[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := int(offset) - (bytes.LastIndexByte(before, '\n') + 1) + 1
+	return line, column
+}
+
+// skipSeparators moves offset to the beginning of the next json value
+func (r *Report) skipSeparators(offset int64) int64 {
+	for offset < int64(len(r.content)) && strings.IndexByte(" \t\r\n,:", r.content[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
+
+// Entities[1].Event -> Entities[1] -> Entities
+func parentPath(path string) string {
+	if strings.HasSuffix(path, "]") {
+		return path[:strings.LastIndexByte(path, '[')]
+	}
+	if i := strings.LastIndexByte(path, '.'); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
+
+// DecodeStrict decodes configuration and reports every field not known to the Configuration,
+// unlike json.Decoder.DisallowUnknownFields which stops on the first one without position.
+//
+// Returned configuration is nil when content is not a valid json
+func DecodeStrict(content []byte) (*Configuration, *Report) {
+	report := &Report{content: content, positions: map[string]int64{}}
+
+	conf := Configuration{}
+	err := json.Unmarshal(content, &conf)
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		report.addAtOffset(syntaxErr.Offset, "", syntaxErr.Error())
+		return nil, report
+	}
+
+	w := fieldWalker{dec: json.NewDecoder(bytes.NewReader(content)), report: report}
+	if err := w.walk(reflect.TypeOf(conf), ""); err != nil && !errors.Is(err, io.EOF) {
+		report.addAtOffset(w.dec.InputOffset(), "", err.Error())
+	}
+	if len(w.invalid) > 0 {
+		// json.Unmarshal stops on the first value rejected by its UnmarshalJSON.
+		// Values are already reported by the walker, so decode the rest of the file without them
+		conf = Configuration{}
+		err = json.Unmarshal(w.withoutInvalidValues(), &conf)
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+	case errors.As(err, &typeErr):
+		report.addAtOffset(typeErr.Offset, typeErr.Field, typeErrorMessage(typeErr))
+	default:
+		report.addAt(0, 0, "", err.Error())
+		return nil, report
+	}
+	return &conf, report
+}
+
+func typeErrorMessage(err *json.UnmarshalTypeError) string {
+	return fmt.Sprintf("expected %s, got json %s", err.Type, err.Value)
+}
+
+// fieldWalker walks json tokens along with the go type they are decoded into
+type fieldWalker struct {
+	dec    *json.Decoder
+	report *Report
+	// [start, end) offsets of values rejected by UnmarshalJSON of their type
+	invalid [][2]int64
+}
+
+func (w *fieldWalker) walk(t reflect.Type, path string) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	start := w.report.skipSeparators(w.dec.InputOffset())
+	if err := w.walkValue(t, path); err != nil {
+		return err
+	}
+	w.checkValue(t, path, start, w.dec.InputOffset())
+	return nil
+}
+
+func (w *fieldWalker) walkValue(t reflect.Type, path string) error {
+	tok, err := w.dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		return nil
+	}
+	switch {
+	case delim == '{' && t.Kind() == reflect.Struct:
+		for w.dec.More() {
+			key, offset, err := w.readKey()
+			if err != nil {
+				return err
+			}
+			fieldPath := joinPath(path, key)
+			w.report.positions[fieldPath] = offset
+			field, ok := jsonField(t, key)
+			if !ok {
+				w.report.addAtOffset(offset, fieldPath, fmt.Sprintf("unknown field %q", key))
+				err = w.walk(reflect.TypeOf((*any)(nil)).Elem(), fieldPath)
+			} else {
+				err = w.walk(field.Type, fieldPath)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case delim == '{' && t.Kind() == reflect.Map:
+		for w.dec.More() {
+			key, offset, err := w.readKey()
+			if err != nil {
+				return err
+			}
+			w.report.positions[joinPath(path, key)] = offset
+			if err := w.walk(t.Elem(), joinPath(path, key)); err != nil {
+				return err
+			}
+		}
+	case delim == '[' && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array):
+		for i := 0; w.dec.More(); i++ {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			w.report.positions[itemPath] = w.report.skipSeparators(w.dec.InputOffset())
+			if err := w.walk(t.Elem(), itemPath); err != nil {
+				return err
+			}
+		}
+	default:
+		// value of unexpected type or any. Type mismatch is reported by json.Unmarshal
+		for w.dec.More() {
+			if delim == '{' {
+				if _, _, err := w.readKey(); err != nil {
+					return err
+				}
+			}
+			if err := w.walk(reflect.TypeOf((*any)(nil)).Elem(), path); err != nil {
+				return err
+			}
+		}
+	}
+	// closing delimiter
+	_, err = w.dec.Token()
+	return err
+}
+
+// checkValue decodes the value of the type with its own UnmarshalJSON, e.g. Duration,
+// and reports the error at the value position
+func (w *fieldWalker) checkValue(t reflect.Type, path string, start int64, end int64) {
+	unmarshaler, ok := reflect.New(t).Interface().(json.Unmarshaler)
+	if !ok {
+		return
+	}
+	err := unmarshaler.UnmarshalJSON(w.report.content[start:end])
+	if err == nil {
+		return
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		w.report.addAtOffset(start, path, typeErrorMessage(typeErr))
+	} else {
+		w.report.addAtOffset(start, path, err.Error())
+	}
+	w.invalid = append(w.invalid, [2]int64{start, end})
+}
+
+// withoutInvalidValues replaces invalid values with null, or 0 when the value is shorter.
+// Values are padded with spaces to keep offsets of the following json intact
+func (w *fieldWalker) withoutInvalidValues() []byte {
+	content := bytes.Clone(w.report.content)
+	for _, span := range w.invalid {
+		value := content[span[0]:span[1]]
+		replacement := "0"
+		if len(value) >= len("null") {
+			replacement = "null"
+		}
+		copy(value, replacement)
+		for i := len(replacement); i < len(value); i++ {
+			value[i] = ' '
+		}
+	}
+	return content
+}
+
+// readKey returns object key with the offset of its opening quote
+func (w *fieldWalker) readKey() (string, int64, error) {
+	tok, err := w.dec.Token()
+	if err != nil {
+		return "", 0, err
+	}
+	key, ok := tok.(string)
+	if !ok {
+		return "", 0, fmt.Errorf("expected object key, got %v", tok)
+	}
+	quoted, _ := json.Marshal(key)
+	return key, w.dec.InputOffset() - int64(len(quoted)), nil
+}
+
+// jsonField finds struct field the same way encoding/json does: exact match first, then case insensitive
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	var caseInsensitive *reflect.StructField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if name == key {
+			return field, true
+		}
+		if caseInsensitive == nil && strings.EqualFold(name, key) {
+			caseInsensitive = &field
+		}
+	}
+	if caseInsensitive != nil {
+		return *caseInsensitive, true
+	}
+	return reflect.StructField{}, false
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
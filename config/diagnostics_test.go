@@ -0,0 +1,46 @@
+package config
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func diagnostics(report *Report) []string {
+	var got []string
+	for _, d := range report.Diagnostics {
+		got = append(got, d.String())
+	}
+	return got
+}
+
+func TestDecodeStrictPlacesInvalidDurations(t *testing.T) {
+	content := `{
+  "Debounce": "soon",
+  "Entities": [
+    {"Script": "/bin/true", "Event": "connected", "Timeout": "abc"},
+    {"Script": 42, "Event": "connected", "Timeout": true, "Unknown": 1},
+    {"Script": "/bin/true", "Event": "connected", "Timeout": "5s", "KillGracePeriod": null}
+  ],
+  "CoalesceWindow": "1s"
+}`
+	conf, report := DecodeStrict([]byte(content))
+	if conf == nil {
+		t.Fatalf("configuration is nil, diagnostics: %q", diagnostics(report))
+	}
+	want := []string{
+		`2:15: Debounce: expected config.Duration, got json string "soon"`,
+		`4:62: Entities[0].Timeout: expected config.Duration, got json string "abc"`,
+		`5:53: Entities[1].Timeout: expected config.Duration, got json bool`,
+		`5:59: Entities[1].Unknown: unknown field "Unknown"`,
+		`5:18: Entities.1.Script: expected string, got json number`,
+	}
+	if got := diagnostics(report); !slices.Equal(got, want) {
+		t.Errorf("diagnostics:\n%q\nwant:\n%q", got, want)
+	}
+	// values after the invalid ones are still decoded
+	if len(conf.Entities) != 3 || time.Duration(conf.Entities[2].Timeout) != 5*time.Second ||
+		time.Duration(conf.CoalesceWindow) != time.Second {
+		t.Errorf("configuration = %+v, want valid values decoded", conf)
+	}
+}
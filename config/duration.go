@@ -0,0 +1,57 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Duration is written in config as a go duration string, e.g. "30s" or "1m30s".
+// Plain number is treated as seconds
+type Duration time.Duration
+
+// UnmarshalJSON fails with *json.UnmarshalTypeError, so invalid durations are reported like any other type mismatch.
+// null leaves the duration unchanged
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var value any
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case nil:
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return &json.UnmarshalTypeError{Value: fmt.Sprintf("string %q", v), Type: reflect.TypeOf(*d)}
+		}
+		*d = Duration(parsed)
+	default:
+		return &json.UnmarshalTypeError{Value: jsonKind(v), Type: reflect.TypeOf(*d)}
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// jsonKind describes decoded json value the same way encoding/json does in UnmarshalTypeError
+func jsonKind(value any) string {
+	switch value.(type) {
+	case bool:
+		return "bool"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
@@ -0,0 +1,27 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDurationUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    time.Duration
+		wantErr bool
+	}{
+		{json: `"1m30s"`, want: 90 * time.Second},
+		{json: `2.5`, want: 2500 * time.Millisecond},
+		{json: `null`, want: time.Minute},
+		{json: `"abc"`, want: time.Minute, wantErr: true},
+		{json: `[1]`, want: time.Minute, wantErr: true},
+	}
+	for _, test := range tests {
+		d := Duration(time.Minute)
+		err := d.UnmarshalJSON([]byte(test.json))
+		if (err != nil) != test.wantErr || time.Duration(d) != test.want {
+			t.Errorf("UnmarshalJSON(%s) = %v, %v; want %v, error %v", test.json, d, err, test.want, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Store keeps the last valid configuration loaded from the config file.
+//
+// Configuration is swapped atomically only after the new file was successfully validated.
+// So events dispatched during the reload always see either old or new configuration
+type Store struct {
+	path string
+	// serializes reloads triggered by inotify and SIGHUP
+	reloadMu   sync.Mutex
+	current    atomic.Pointer[Configuration]
+	generation atomic.Uint64
+}
+
+func NewStore(path string) *Store {
+	s := &Store{path: path}
+	s.current.Store(&Configuration{})
+	return s
+}
+
+func (s *Store) Path() string {
+	return s.path
+}
+
+// Current returns currently active configuration. Never nil
+func (s *Store) Current() *Configuration {
+	return s.current.Load()
+}
+
+// Generation is incremented each time a new configuration is swapped in
+func (s *Store) Generation() uint64 {
+	return s.generation.Load()
+}
+
+// Reload reads and validates the config file and swaps it in when valid.
+//
+// Invalid configuration is rejected and the last good one is kept.
+// Absent config file on the first load is valid and means no entities to dispatch.
+// Config file removed later is rejected the same way as invalid one
+func (s *Store) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	conf, err := Load(s.path)
+	if errors.Is(err, os.ErrNotExist) && s.generation.Load() == 0 {
+		slog.Warn("Config file does not exist. No scripts will be executed", "path", s.path)
+		conf, err = &Configuration{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	s.current.Store(conf)
+	generation := s.generation.Add(1)
+	slog.Info("Loaded config", "path", s.path, "generation", generation, "entities", len(conf.Entities))
+	return nil
+}
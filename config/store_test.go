@@ -0,0 +1,121 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	oneEntity   = `{"Entities": [{"Script": "/bin/true", "Event": "connected"}]}`
+	twoEntities = `{"Entities": [{"Script": "/bin/true", "Event": "connected"}, {"Script": "/bin/true", "Event": "disconnected"}]}`
+)
+
+func writeConfig(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newWatchedStore loads config with one entity and watches its changes
+func newWatchedStore(t *testing.T) *Store {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, path, oneEntity)
+	store := NewStore(path)
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := Watch(store); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// waitGeneration waits until the store swaps in configuration of the given generation
+func waitGeneration(t *testing.T, store *Store, generation uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for store.Generation() < generation {
+		if time.Now().After(deadline) {
+			t.Fatalf("generation = %d, want %d", store.Generation(), generation)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// assertKept checks that the watcher keeps the first configuration after the change settled down
+func assertKept(t *testing.T, store *Store) {
+	t.Helper()
+	time.Sleep(3 * watchDebounce)
+	if store.Generation() != 1 || len(store.Current().Entities) != 1 {
+		t.Errorf("generation = %d, entities = %d, want the first configuration kept", store.Generation(), len(store.Current().Entities))
+	}
+}
+
+func TestReloadWithoutFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	store := NewStore(path)
+	if err := store.Reload(); err != nil {
+		t.Fatalf("first Reload() error = %v, want empty configuration", err)
+	}
+	if len(store.Current().Entities) != 0 || store.Generation() != 1 {
+		t.Errorf("configuration = %+v, generation = %d, want empty one", store.Current(), store.Generation())
+	}
+
+	writeConfig(t, path, oneEntity)
+	if err := store.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reload(); err == nil {
+		t.Error("Reload() of removed file succeeded, want error")
+	}
+	if len(store.Current().Entities) != 1 || store.Generation() != 2 {
+		t.Errorf("entities = %d, generation = %d, want configuration kept", len(store.Current().Entities), store.Generation())
+	}
+}
+
+func TestWatchReloadsValidEdit(t *testing.T) {
+	store := newWatchedStore(t)
+	writeConfig(t, store.Path(), twoEntities)
+	waitGeneration(t, store, 2)
+	if got := len(store.Current().Entities); got != 2 {
+		t.Errorf("entities = %d, want 2", got)
+	}
+}
+
+func TestWatchRejectsInvalidEdit(t *testing.T) {
+	store := newWatchedStore(t)
+	writeConfig(t, store.Path(), `{"Entities": [{"Script": "/bin/true", "Event": "unknown"}]}`)
+	assertKept(t, store)
+}
+
+func TestWatchReloadsRenamedSave(t *testing.T) {
+	store := newWatchedStore(t)
+	// editors write temp file next to the config and rename it over the original one
+	tmp := store.Path() + ".swp"
+	writeConfig(t, tmp, twoEntities)
+	if err := os.Rename(tmp, store.Path()); err != nil {
+		t.Fatal(err)
+	}
+	waitGeneration(t, store, 2)
+	if got := len(store.Current().Entities); got != 2 {
+		t.Errorf("entities = %d, want 2", got)
+	}
+
+	// the watch survives the rename
+	writeConfig(t, store.Path(), oneEntity)
+	waitGeneration(t, store, 3)
+}
+
+func TestWatchKeepsConfigOfRemovedFile(t *testing.T) {
+	store := newWatchedStore(t)
+	if err := os.Remove(store.Path()); err != nil {
+		t.Fatal(err)
+	}
+	assertKept(t, store)
+}
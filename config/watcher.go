@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"network-dispatcher/logging"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Editors write a file in several steps, e.g. truncate and write or write temp file and rename.
+// Wait until changes settle down before reloading to not read half written file
+const watchDebounce = 300 * time.Millisecond
+
+// Watch reloads the store each time its config file changes.
+//
+// Watches config file directory instead of the file itself
+// because editors often save by renaming a temp file over the original one,
+// which silently drops the inotify watch of the original file.
+func Watch(store *Store) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("failed to init inotify: %v", err)
+	}
+	dir := filepath.Dir(store.Path())
+	_, err = unix.InotifyAddWatch(fd, dir,
+		unix.IN_CLOSE_WRITE|unix.IN_MOVED_TO|unix.IN_MOVED_FROM|unix.IN_CREATE|unix.IN_DELETE)
+	if err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("failed to watch %s: %v", dir, err)
+	}
+
+	changed := make(chan struct{}, 1)
+	go readInotifyEvents(fd, filepath.Base(store.Path()), changed)
+	go func() {
+		var timer <-chan time.Time
+		for {
+			select {
+			case <-changed:
+				timer = time.After(watchDebounce)
+			case <-timer:
+				timer = nil
+				if err := store.Reload(); err != nil {
+					slog.Error("Config reload failed. Keeping previous configuration", "generation", store.Generation(), logging.Error, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func readInotifyEvents(fd int, fileName string, changed chan<- struct{}) {
+	defer unix.Close(fd)
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := unix.Read(fd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			slog.Warn("Stopped watching config changes", logging.Error, err)
+			return
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+
+			if inotifyEventName(nameBytes) != fileName {
+				continue
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// name is padded with null bytes up to event.Len
+func inotifyEventName(name []byte) string {
+	for i, b := range name {
+		if b == 0 {
+			return string(name[:i])
+		}
+	}
+	return string(name)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log/slog"
+	dbusapi "network-dispatcher/dbus_api"
+	"network-dispatcher/logging"
+	"strings"
+)
+
+// Prefix of events dispatched on NetworkManager connectivity change, e.g. connectivity-full
+const ConnectivityEventPrefix = "connectivity-"
+
+// onConnectivityChanged is called by the signals loop and must not block
+func (d *networkDispatcher) onConnectivityChanged(connectivity uint32) {
+	if connectivity == dbusapi.NM_CONNECTIVITY_UNKNOWN {
+		// connectivity checks are disabled or not finished yet
+		return
+	}
+	d.events.pushConnectivity(ConnectivityEventPrefix + dbusapi.ConnectivityName(connectivity))
+}
+
+// dispatchConnectivity runs connectivity entities for every connected network.
+//
+// Connectivity is global in NetworkManager, so each network gets the event and entity filters decide which one to use
+func dispatchConnectivity(event string) {
+	connectivity := strings.TrimPrefix(event, ConnectivityEventPrefix)
+	if !state.setConnectivity(connectivity) {
+		return
+	}
+	slog.Info("NetworkManager connectivity changed", "connectivity", connectivity)
+	networks := state.getNetworks()
+	if len(networks) == 0 {
+		slog.Info("No connected networks. Connectivity scripts will not run", logging.Event, event)
+		return
+	}
+	for _, network := range networks {
+		executeEntityScripts(newEvent(&network, event))
+	}
+}
+
+// syncConnectivity queries the current connectivity, e.g. after NetworkManager restart.
+//
+// Connectivity scripts run only when it changed since the last known state.
+// When dispatch is false connectivity is just remembered, e.g. on startup when connected scripts are not run either
+func (d *networkDispatcher) syncConnectivity(dispatch bool) {
+	connectivity, err := d.nm.GetConnectivity()
+	if err != nil {
+		slog.Warn("Failed to get NetworkManager connectivity", logging.Error, err)
+		return
+	}
+	if !dispatch {
+		state.setConnectivity(dbusapi.ConnectivityName(connectivity))
+		return
+	}
+	d.onConnectivityChanged(connectivity)
+}
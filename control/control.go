@@ -0,0 +1,146 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"network-dispatcher/logging"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Time given to the client to send a command and read the reply
+const requestTimeout = 5 * time.Second
+
+// Handler returns reply for the command. Reply is marshalled to json
+type Handler func(command string) (any, error)
+
+// response is sent back to the client for each command
+type response struct {
+	Error string          `json:",omitempty"`
+	Data  json.RawMessage `json:",omitempty"`
+}
+
+// Runtime directory systemd creates for the daemon service with RuntimeDirectory=network-dispatcher
+const RuntimeDir = "/run/network-dispatcher"
+
+const socketName = "control.sock"
+
+// DefaultSocketPath returns control socket path in the directory not writable by other users.
+//
+// Daemon is started by system systemd before user logs in, so it uses the service runtime directory
+// which the status command started from user session finds the same way.
+// XDG_RUNTIME_DIR is used when daemon runs without the service
+func DefaultSocketPath() string {
+	if dir := os.Getenv("RUNTIME_DIRECTORY"); dir != "" {
+		return filepath.Join(dir, socketName)
+	}
+	if info, err := os.Stat(RuntimeDir); err == nil && info.IsDir() {
+		return filepath.Join(RuntimeDir, socketName)
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "network-dispatcher.sock")
+	}
+	return filepath.Join(RuntimeDir, socketName)
+}
+
+// Serve listens on the unix socket and answers commands in background.
+//
+// Each connection sends a single command line and receives a single json reply.
+// Socket is accessible only by the current user
+func Serve(path string, handler Handler) error {
+	if err := removeStaleSocket(path); err != nil {
+		return err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen control socket %s: %v", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return fmt.Errorf("failed to restrict control socket %s permissions: %v", path, err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				slog.Warn("Control socket stopped", "path", path, logging.Error, err)
+				return
+			}
+			go handleConnection(conn, handler)
+		}
+	}()
+	return nil
+}
+
+// removeStaleSocket removes leftover socket of the previous run which was not stopped gracefully.
+// Refuses to touch a file which is not our socket, so other users can't substitute it
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check control socket %s: %v", path, err)
+	}
+	if info.Mode().Type() != os.ModeSocket {
+		return fmt.Errorf("control socket path %s is taken by a file which is not a socket", path)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); !ok || int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("control socket %s is owned by another user", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale control socket %s: %v", path, err)
+	}
+	return nil
+}
+
+func handleConnection(conn net.Conn, handler Handler) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	command, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		slog.Warn("Failed to read control command", logging.Error, err)
+		return
+	}
+	resp := response{}
+	data, err := handler(strings.TrimSpace(command))
+	if err == nil {
+		resp.Data, err = json.Marshal(data)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	if err := json.NewEncoder(conn).Encode(resp); err != nil {
+		slog.Warn("Failed to send control reply", logging.Error, err)
+	}
+}
+
+// Request sends command to the daemon listening on the socket and returns its json reply
+func Request(path string, command string) (json.RawMessage, error) {
+	conn, err := net.DialTimeout("unix", path, requestTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to network-dispatcher at %s. Is it running? %v", path, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		return nil, fmt.Errorf("failed to send %s command: %v", command, err)
+	}
+	resp := response{}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to read %s reply: %v", command, err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Data, nil
+}
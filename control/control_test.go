@@ -0,0 +1,58 @@
+package control
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServeReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), socketName)
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keeps the socket file like crashed daemon
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	if err := Serve(path, func(command string) (any, error) { return command, nil }); err != nil {
+		t.Fatal(err)
+	}
+	data, err := Request(path, "status")
+	if err != nil || string(data) != `"status"` {
+		t.Errorf("Request() = %s, %v, want status reply", data, err)
+	}
+}
+
+func TestServeRefusesNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), socketName)
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := Serve(path, func(command string) (any, error) { return nil, nil })
+	if err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("Serve() error = %v, want refusal", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("file is removed: %v", err)
+	}
+}
+
+func TestDefaultSocketPath(t *testing.T) {
+	t.Setenv("RUNTIME_DIRECTORY", "/run/service")
+	if got := DefaultSocketPath(); got != "/run/service/control.sock" {
+		t.Errorf("DefaultSocketPath() = %s, want socket in the service runtime directory", got)
+	}
+	t.Setenv("RUNTIME_DIRECTORY", "")
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	want := "/run/user/1000/network-dispatcher.sock"
+	if _, err := os.Stat(RuntimeDir); err == nil {
+		want = filepath.Join(RuntimeDir, socketName)
+	}
+	if got := DefaultSocketPath(); got != want {
+		t.Errorf("DefaultSocketPath() = %s, want %s", got, want)
+	}
+}
@@ -2,35 +2,129 @@ package dbusapi
 
 import (
 	"fmt"
-	"log"
-	"os"
+	"log/slog"
+	"network-dispatcher/logging"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 )
 
 const NM_DEVICE_STATE_ACTIVATED = 100
 const NM_DEVICE_STATE_DISCONNECTED = 30
-const NM_DEVICE_TYPE_WIFI = 2
 
-var conn *dbus.Conn
+// NMConnectivityState values. See https://networkmanager.dev/docs/api/latest/nm-dbus-types.html#NMConnectivityState
+const (
+	NM_CONNECTIVITY_UNKNOWN = 0
+	NM_CONNECTIVITY_NONE    = 1
+	NM_CONNECTIVITY_PORTAL  = 2
+	NM_CONNECTIVITY_LIMITED = 3
+	NM_CONNECTIVITY_FULL    = 4
+)
 
-type NetworkAdapter struct {
-	object dbus.BusObject
+// Connectivity names used in connectivity-* events. Same names as nmcli networking connectivity prints
+var connectivityNames = map[uint32]string{
+	NM_CONNECTIVITY_UNKNOWN: "unknown",
+	NM_CONNECTIVITY_NONE:    "none",
+	NM_CONNECTIVITY_PORTAL:  "portal",
+	NM_CONNECTIVITY_LIMITED: "limited",
+	NM_CONNECTIVITY_FULL:    "full",
 }
 
-type Ip4Config struct {
-	object dbus.BusObject
-	Path   dbus.ObjectPath
-}
+// NMDeviceType values. See https://networkmanager.dev/docs/api/latest/nm-dbus-types.html#NMDeviceType
+const (
+	NM_DEVICE_TYPE_UNKNOWN       = 0
+	NM_DEVICE_TYPE_ETHERNET      = 1
+	NM_DEVICE_TYPE_WIFI          = 2
+	NM_DEVICE_TYPE_UNUSED1       = 3
+	NM_DEVICE_TYPE_UNUSED2       = 4
+	NM_DEVICE_TYPE_BT            = 5
+	NM_DEVICE_TYPE_OLPC_MESH     = 6
+	NM_DEVICE_TYPE_WIMAX         = 7
+	NM_DEVICE_TYPE_MODEM         = 8
+	NM_DEVICE_TYPE_INFINIBAND    = 9
+	NM_DEVICE_TYPE_BOND          = 10
+	NM_DEVICE_TYPE_VLAN          = 11
+	NM_DEVICE_TYPE_ADSL          = 12
+	NM_DEVICE_TYPE_BRIDGE        = 13
+	NM_DEVICE_TYPE_GENERIC       = 14
+	NM_DEVICE_TYPE_TEAM          = 15
+	NM_DEVICE_TYPE_TUN           = 16
+	NM_DEVICE_TYPE_IP_TUNNEL     = 17
+	NM_DEVICE_TYPE_MACVLAN       = 18
+	NM_DEVICE_TYPE_VXLAN         = 19
+	NM_DEVICE_TYPE_VETH          = 20
+	NM_DEVICE_TYPE_MACSEC        = 21
+	NM_DEVICE_TYPE_DUMMY         = 22
+	NM_DEVICE_TYPE_PPP           = 23
+	NM_DEVICE_TYPE_OVS_INTERFACE = 24
+	NM_DEVICE_TYPE_OVS_PORT      = 25
+	NM_DEVICE_TYPE_OVS_BRIDGE    = 26
+	NM_DEVICE_TYPE_WPAN          = 27
+	NM_DEVICE_TYPE_6LOWPAN       = 28
+	NM_DEVICE_TYPE_WIREGUARD     = 29
+	NM_DEVICE_TYPE_WIFI_P2P      = 30
+	NM_DEVICE_TYPE_VRF           = 31
+	NM_DEVICE_TYPE_LOOPBACK      = 32
+	NM_DEVICE_TYPE_HSR           = 33
+	NM_DEVICE_TYPE_IPVLAN        = 34
+)
 
-type Ip6Config struct {
-	object dbus.BusObject
-	Path   dbus.ObjectPath
+// Device type names used by the DeviceTypes config filter and DISPATCHER_DEVICE_TYPE.
+// Same names as nmcli prints in the TYPE column
+var deviceTypeNames = map[uint32]string{
+	NM_DEVICE_TYPE_UNKNOWN:       "unknown",
+	NM_DEVICE_TYPE_ETHERNET:      "ethernet",
+	NM_DEVICE_TYPE_WIFI:          "wifi",
+	NM_DEVICE_TYPE_UNUSED1:       "unused1",
+	NM_DEVICE_TYPE_UNUSED2:       "unused2",
+	NM_DEVICE_TYPE_BT:            "bt",
+	NM_DEVICE_TYPE_OLPC_MESH:     "olpc-mesh",
+	NM_DEVICE_TYPE_WIMAX:         "wimax",
+	NM_DEVICE_TYPE_MODEM:         "modem",
+	NM_DEVICE_TYPE_INFINIBAND:    "infiniband",
+	NM_DEVICE_TYPE_BOND:          "bond",
+	NM_DEVICE_TYPE_VLAN:          "vlan",
+	NM_DEVICE_TYPE_ADSL:          "adsl",
+	NM_DEVICE_TYPE_BRIDGE:        "bridge",
+	NM_DEVICE_TYPE_GENERIC:       "generic",
+	NM_DEVICE_TYPE_TEAM:          "team",
+	NM_DEVICE_TYPE_TUN:           "tun",
+	NM_DEVICE_TYPE_IP_TUNNEL:     "ip-tunnel",
+	NM_DEVICE_TYPE_MACVLAN:       "macvlan",
+	NM_DEVICE_TYPE_VXLAN:         "vxlan",
+	NM_DEVICE_TYPE_VETH:          "veth",
+	NM_DEVICE_TYPE_MACSEC:        "macsec",
+	NM_DEVICE_TYPE_DUMMY:         "dummy",
+	NM_DEVICE_TYPE_PPP:           "ppp",
+	NM_DEVICE_TYPE_OVS_INTERFACE: "ovs-interface",
+	NM_DEVICE_TYPE_OVS_PORT:      "ovs-port",
+	NM_DEVICE_TYPE_OVS_BRIDGE:    "ovs-bridge",
+	NM_DEVICE_TYPE_WPAN:          "wpan",
+	NM_DEVICE_TYPE_6LOWPAN:       "6lowpan",
+	NM_DEVICE_TYPE_WIREGUARD:     "wireguard",
+	NM_DEVICE_TYPE_WIFI_P2P:      "wifi-p2p",
+	NM_DEVICE_TYPE_VRF:           "vrf",
+	NM_DEVICE_TYPE_LOOPBACK:      "loopback",
+	NM_DEVICE_TYPE_HSR:           "hsr",
+	NM_DEVICE_TYPE_IPVLAN:        "ipvlan",
 }
 
+const networkManagerName = "org.freedesktop.NetworkManager"
+const networkManagerPath = "/org/freedesktop/NetworkManager"
+
+// Backoff between attempts to reconnect to the system bus
+const minReconnectDelay = time.Second
+const maxReconnectDelay = 30 * time.Second
+
+var connMu sync.RWMutex
+var conn *dbus.Conn
+
 func Connect() error {
-	if conn != nil {
+	connMu.Lock()
+	defer connMu.Unlock()
+	if conn != nil && conn.Connected() {
 		return nil
 	}
 	var err error
@@ -38,115 +132,199 @@ func Connect() error {
 	return err
 }
 
-func MonitorNetworkCardStateChanged(onConnected func(*dbus.Signal), onDisconnected func(*dbus.Signal)) {
-	if conn == nil {
-		if err := Connect(); err != nil {
-			fmt.Fprintln(os.Stderr, "Failed to connect to session bus:", err)
-			os.Exit(1)
+// IsConnected tells whether system bus connection is available right now
+func IsConnected() bool {
+	c := getConn()
+	return c != nil && c.Connected()
+}
+
+// getConn returns the current system bus connection. It's replaced on reconnect
+func getConn() *dbus.Conn {
+	connMu.RLock()
+	defer connMu.RUnlock()
+	return conn
+}
+
+// SignalHandlers are called by MonitorNetworkCardStateChanged
+type SignalHandlers struct {
+	// Device reached NM_DEVICE_STATE_ACTIVATED.
+	// Device handlers are called synchronously in the signals order and must not block
+	OnConnected func(dbus.ObjectPath)
+	// Device reached NM_DEVICE_STATE_DISCONNECTED
+	OnDisconnected func(dbus.ObjectPath)
+	// NetworkManager Connectivity property changed to one of NM_CONNECTIVITY_* values. Optional
+	OnConnectivityChanged func(connectivity uint32)
+	// NetworkManager PrimaryConnection property changed, e.g. default route moved to docked ethernet. Optional
+	OnPrimaryConnectionChanged func(activeConnection dbus.ObjectPath)
+	// Other handlers run in their own goroutine
+	// Called when signals might have been missed: after reconnect to the bus and after NetworkManager restart.
+	// It's expected to re-query devices and dispatch the missed state changes
+	OnResync func()
+	// logind PrepareForSleep signal. sleeping is true before suspend and false after resume. Optional
+	OnPrepareForSleep func(sleeping bool)
+	// Called with every received signal before it's dispatched, e.g. to record it. Optional
+	OnSignal func(*dbus.Signal)
+	// Go starts handlers which run in their own goroutine, e.g. to wait for them. Optional
+	Go func(handler func())
+}
+
+func (h SignalHandlers) async(handler func()) {
+	if h.Go != nil {
+		h.Go(handler)
+		return
+	}
+	go handler()
+}
+
+// MonitorNetworkCardStateChanged dispatches NetworkManager device state changes forever.
+//
+// Reconnects to the system bus with backoff when connection is lost.
+func MonitorNetworkCardStateChanged(handlers SignalHandlers) {
+	delay := minReconnectDelay
+	needResync := false
+	for {
+		c, err := subscribe()
+		if err != nil {
+			slog.Warn("Failed to subscribe to NetworkManager signals", "retry_in", delay, logging.Error, err)
+			needResync = true
+			time.Sleep(delay)
+			delay = min(delay*2, maxReconnectDelay)
+			continue
+		}
+		delay = minReconnectDelay
+		if needResync {
+			slog.Info("Subscribed to NetworkManager signals again. Resync network state")
+			handlers.async(handlers.OnResync)
 		}
+
+		DispatchSignals(c, handlers)
+		slog.Warn("Lost connection to the system bus. Reconnecting")
+		needResync = true
 	}
+}
 
-	call := conn.BusObject().Call("org.freedesktop.DBus.AddMatch", 0,
-		"interface='org.freedesktop.NetworkManager.Device'")
-	if call.Err != nil {
-		log.Printf("\n Dbus connection error: %s \n", call.Err)
+// subscribe connects to the system bus if needed and installs match rules for NetworkManager signals
+func subscribe() (chan *dbus.Signal, error) {
+	if err := Connect(); err != nil {
+		return nil, fmt.Errorf("failed to connect to system bus: %v", err)
 	}
+	c := getConn()
+	err := c.AddMatchSignal(dbus.WithMatchInterface("org.freedesktop.NetworkManager.Device"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to add NetworkManager device match rule: %v", err)
+	}
+	// notifies when NetworkManager is started or stopped
+	err = c.AddMatchSignal(
+		dbus.WithMatchSender("org.freedesktop.DBus"),
+		dbus.WithMatchInterface("org.freedesktop.DBus"),
+		dbus.WithMatchMember("NameOwnerChanged"),
+		dbus.WithMatchArg(0, networkManagerName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to add NameOwnerChanged match rule: %v", err)
+	}
+	// NetworkManager global properties, e.g. Connectivity
+	err = c.AddMatchSignal(
+		dbus.WithMatchObjectPath(networkManagerPath),
+		dbus.WithMatchInterface("org.freedesktop.DBus.Properties"),
+		dbus.WithMatchMember("PropertiesChanged"),
+		dbus.WithMatchArg(0, networkManagerName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to add NetworkManager PropertiesChanged match rule: %v", err)
+	}
+	err = c.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.login1.Manager"),
+		dbus.WithMatchMember("PrepareForSleep"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to add PrepareForSleep match rule: %v", err)
+	}
+	signals := make(chan *dbus.Signal, 10)
+	c.Signal(signals)
+	return signals, nil
+}
 
-	c := make(chan *dbus.Signal, 10)
-	conn.Signal(c)
+// DispatchSignals calls handlers of the received signals.
+//
+// Returns when signals channel is closed, which happens when bus connection is lost
+func DispatchSignals(c <-chan *dbus.Signal, handlers SignalHandlers) {
 	for signal := range c {
-		if signal.Name == "org.freedesktop.NetworkManager.Device.StateChanged" {
+		if handlers.OnSignal != nil {
+			handlers.OnSignal(signal)
+		}
+		switch signal.Name {
+		case "org.freedesktop.NetworkManager.Device.StateChanged":
 			if len(signal.Body) != 3 {
-				log.Printf("Incorrect signal body. Expected 3 arguments , got %+v\n", signal.Body)
+				slog.Warn("Incorrect StateChanged signal body. Expected 3 arguments", "body", signal.Body)
 				continue
 			}
 			state := signal.Body[0].(uint32)
 			if state == NM_DEVICE_STATE_ACTIVATED {
-				go onConnected(signal)
+				handlers.OnConnected(signal.Path)
 			}
 			if state == NM_DEVICE_STATE_DISCONNECTED {
-				go onDisconnected(signal)
+				handlers.OnDisconnected(signal.Path)
+			}
+		case "org.freedesktop.DBus.Properties.PropertiesChanged":
+			if signal.Path != networkManagerPath {
+				continue
+			}
+			var iface string
+			var changed map[string]dbus.Variant
+			var invalidated []string
+			if err := dbus.Store(signal.Body, &iface, &changed, &invalidated); err != nil || iface != networkManagerName {
+				continue
+			}
+			if connectivity, ok := changed["Connectivity"].Value().(uint32); ok && handlers.OnConnectivityChanged != nil {
+				handlers.OnConnectivityChanged(connectivity)
+			}
+			if primary, ok := changed["PrimaryConnection"].Value().(dbus.ObjectPath); ok && handlers.OnPrimaryConnectionChanged != nil {
+				handlers.OnPrimaryConnectionChanged(primary)
+			}
+		case "org.freedesktop.DBus.NameOwnerChanged":
+			var name, oldOwner, newOwner string
+			if err := dbus.Store(signal.Body, &name, &oldOwner, &newOwner); err != nil || name != networkManagerName {
+				continue
+			}
+			if newOwner == "" {
+				slog.Warn("NetworkManager stopped. Waiting for it to start again")
+				continue
+			}
+			// NetworkManager recreates all device objects on start. State is re-queried from scratch
+			slog.Info("NetworkManager started. Resync network state")
+			handlers.async(handlers.OnResync)
+		case "org.freedesktop.login1.Manager.PrepareForSleep":
+			var sleeping bool
+			if err := dbus.Store(signal.Body, &sleeping); err != nil {
+				slog.Warn("Incorrect PrepareForSleep signal body", "body", signal.Body, logging.Error, err)
+				continue
+			}
+			if handlers.OnPrepareForSleep != nil {
+				handlers.async(func() { handlers.OnPrepareForSleep(sleeping) })
 			}
 		}
 	}
 }
 
-func NewNetworkAdapter(path dbus.ObjectPath) *NetworkAdapter {
-	return &NetworkAdapter{object: conn.Object("org.freedesktop.NetworkManager", path)}
-}
-
-func GetDeviceByInterfaceName(name string) (*NetworkAdapter, error) {
-	var path dbus.ObjectPath
-	err := conn.Object("org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager").Call("org.freedesktop.NetworkManager.GetDeviceByIpIface", 0, name).Store(&path)
-	if err != nil {
-		return nil, err
-	}
-	return NewNetworkAdapter(path), nil
-}
-
-func (n *NetworkAdapter) Ip4Config() (*Ip4Config, error) {
-	var path dbus.ObjectPath
-	err := n.object.Call("org.freedesktop.DBus.Properties.Get", 0,
-		"org.freedesktop.NetworkManager.Device", "Ip4Config").Store(&path)
-
-	if err != nil {
-		return nil, err
-	}
-	return newIp4Config(path), nil
-}
-
-func (n *NetworkAdapter) Ip6Config() (*Ip6Config, error) {
-	var path dbus.ObjectPath
-	err := n.object.Call("org.freedesktop.DBus.Properties.Get", 0,
-		"org.freedesktop.NetworkManager.Device", "Ip6Config").Store(&path)
-
-	if err != nil {
-		return nil, err
+// DeviceTypeName converts NM_DEVICE_TYPE_* value into its config name
+func DeviceTypeName(deviceType uint32) string {
+	if name, ok := deviceTypeNames[deviceType]; ok {
+		return name
 	}
-	return newIp6Config(path), nil
+	return deviceTypeNames[NM_DEVICE_TYPE_UNKNOWN]
 }
 
-func (n *NetworkAdapter) GetState() (uint32, error) {
-	var state uint32
-	err := n.object.Call("org.freedesktop.DBus.Properties.Get", 0,
-		"org.freedesktop.NetworkManager.Device", "State").Store(&state)
-	return state, err
-}
-
-func (n *NetworkAdapter) GetDeviceType() (uint32, error) {
-	var deviceType uint32
-	err := n.object.Call("org.freedesktop.DBus.Properties.Get", 0,
-		"org.freedesktop.NetworkManager.Device", "DeviceType").Store(&deviceType)
-	return deviceType, err
-}
-
-func (n *NetworkAdapter) GetInterfaceName() (string, error) {
-	var name string
-	err := n.object.Call("org.freedesktop.DBus.Properties.Get", 0,
-		"org.freedesktop.NetworkManager.Device", "Interface").Store(&name)
-	return name, err
-}
-
-func newIp4Config(path dbus.ObjectPath) *Ip4Config {
-	return &Ip4Config{object: conn.Object("org.freedesktop.NetworkManager", path), Path: path}
-}
-
-func newIp6Config(path dbus.ObjectPath) *Ip6Config {
-	return &Ip6Config{object: conn.Object("org.freedesktop.NetworkManager", path), Path: path}
-}
-
-func (c *Ip4Config) Gateway() (string, error) {
-	gateway, err := c.object.GetProperty("org.freedesktop.NetworkManager.IP4Config.Gateway")
-	if err != nil {
-		return "", err
+func IsKnownDeviceTypeName(name string) bool {
+	for _, known := range deviceTypeNames {
+		if strings.EqualFold(known, name) {
+			return true
+		}
 	}
-	return strings.ReplaceAll(gateway.String(), "\"", ""), nil
+	return false
 }
 
-func (c *Ip6Config) Gateway() (string, error) {
-	gateway, err := c.object.GetProperty("org.freedesktop.NetworkManager.IP6Config.Gateway")
-	if err != nil {
-		return "", err
+// ConnectivityName converts NM_CONNECTIVITY_* value into its name, e.g. full or portal
+func ConnectivityName(connectivity uint32) string {
+	if name, ok := connectivityNames[connectivity]; ok {
+		return name
 	}
-	return strings.ReplaceAll(gateway.String(), "\"", ""), nil
+	return "unknown"
 }
@@ -0,0 +1,249 @@
+package dbusapi
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// FakeNetworkManager is in-memory NetworkManager, e.g. for tests of the event flows.
+//
+// Devices could be changed with SetDevice at any time, also while the dispatcher is querying them
+type FakeNetworkManager struct {
+	mu           sync.Mutex
+	devices      map[dbus.ObjectPath]FakeDevice
+	connectivity uint32
+	unavailable  bool
+	// OnGet is called before every device property read with the property name, e.g. Ip4Config.
+	// Allows to change the device while the dispatcher retries. Optional
+	OnGet func(path dbus.ObjectPath, property string)
+}
+
+// FakeDevice is the state of the fake device.
+// Empty gateway means device has no such ip configuration and empty SSID and BSSID mean no access point
+type FakeDevice struct {
+	Path           dbus.ObjectPath
+	Interface      string
+	DeviceType     uint32
+	State          uint32
+	Ip4Gateway     string
+	Ip6Gateway     string
+	SSID           string
+	BSSID          string
+	ConnectionId   string
+	ConnectionUuid string
+	ConnectionType string
+	// Errors returned by property reads keyed by property name, e.g. Ip4Config
+	Errors map[string]error
+}
+
+func NewFakeNetworkManager() *FakeNetworkManager {
+	return &FakeNetworkManager{devices: map[dbus.ObjectPath]FakeDevice{}, connectivity: NM_CONNECTIVITY_UNKNOWN}
+}
+
+// SetDevice adds the device or replaces the one with the same path
+func (f *FakeNetworkManager) SetDevice(device FakeDevice) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.devices[device.Path] = device
+}
+
+// RemoveDevice removes the device, e.g. unplugged usb wifi dongle. Its properties could not be read anymore
+func (f *FakeNetworkManager) RemoveDevice(path dbus.ObjectPath) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.devices, path)
+}
+
+func (f *FakeNetworkManager) SetConnectivity(connectivity uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.connectivity = connectivity
+}
+
+// SetAvailable simulates lost system bus connection. All queries fail while NetworkManager is unavailable
+func (f *FakeNetworkManager) SetAvailable(available bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.unavailable = !available
+}
+
+func (f *FakeNetworkManager) IsConnected() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.unavailable
+}
+
+func (f *FakeNetworkManager) Device(path dbus.ObjectPath) Device {
+	return &fakeDevice{nm: f, path: path}
+}
+
+func (f *FakeNetworkManager) GetDeviceByInterfaceName(name string) (Device, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.unavailable {
+		return nil, errFakeUnavailable
+	}
+	for path, device := range f.devices {
+		if device.Interface == name {
+			return &fakeDevice{nm: f, path: path}, nil
+		}
+	}
+	return nil, fmt.Errorf("no device found for interface %s", name)
+}
+
+func (f *FakeNetworkManager) GetDevicePaths() ([]dbus.ObjectPath, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.unavailable {
+		return nil, errFakeUnavailable
+	}
+	paths := make([]dbus.ObjectPath, 0, len(f.devices))
+	for path := range f.devices {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	return paths, nil
+}
+
+func (f *FakeNetworkManager) GetConnectivity() (uint32, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.unavailable {
+		return 0, errFakeUnavailable
+	}
+	return f.connectivity, nil
+}
+
+var errFakeUnavailable = errors.New("NetworkManager is not available")
+
+// fakeDevice reads the current state of FakeDevice on every property read, like dbus object does
+type fakeDevice struct {
+	nm   *FakeNetworkManager
+	path dbus.ObjectPath
+}
+
+func (d *fakeDevice) get(property string) (FakeDevice, error) {
+	if onGet := d.nm.OnGet; onGet != nil {
+		onGet(d.path, property)
+	}
+	d.nm.mu.Lock()
+	defer d.nm.mu.Unlock()
+	if d.nm.unavailable {
+		return FakeDevice{}, errFakeUnavailable
+	}
+	device, ok := d.nm.devices[d.path]
+	if !ok {
+		return FakeDevice{}, fmt.Errorf("unknown object %s", d.path)
+	}
+	if err := device.Errors[property]; err != nil {
+		return FakeDevice{}, err
+	}
+	return device, nil
+}
+
+func (d *fakeDevice) Path() dbus.ObjectPath {
+	return d.path
+}
+
+func (d *fakeDevice) GetState() (uint32, error) {
+	device, err := d.get("State")
+	return device.State, err
+}
+
+func (d *fakeDevice) GetDeviceType() (uint32, error) {
+	device, err := d.get("DeviceType")
+	return device.DeviceType, err
+}
+
+func (d *fakeDevice) GetInterfaceName() (string, error) {
+	device, err := d.get("Interface")
+	return device.Interface, err
+}
+
+func (d *fakeDevice) Ip4Config() (IpConfig, error) {
+	device, err := d.get("Ip4Config")
+	if err != nil {
+		return nil, err
+	}
+	return &fakeObject{path: d.childPath("IP4Config", device.Ip4Gateway != ""), values: []string{device.Ip4Gateway}}, nil
+}
+
+func (d *fakeDevice) Ip6Config() (IpConfig, error) {
+	device, err := d.get("Ip6Config")
+	if err != nil {
+		return nil, err
+	}
+	return &fakeObject{path: d.childPath("IP6Config", device.Ip6Gateway != ""), values: []string{device.Ip6Gateway}}, nil
+}
+
+func (d *fakeDevice) ActiveAccessPoint() (AccessPoint, error) {
+	device, err := d.get("ActiveAccessPoint")
+	if err != nil {
+		return nil, err
+	}
+	exists := device.SSID != "" || device.BSSID != ""
+	return &fakeObject{path: d.childPath("AccessPoint", exists), values: []string{device.SSID, device.BSSID}}, nil
+}
+
+func (d *fakeDevice) ActiveConnection() (ActiveConnection, error) {
+	device, err := d.get("ActiveConnection")
+	if err != nil {
+		return nil, err
+	}
+	exists := device.ConnectionId != "" || device.ConnectionUuid != ""
+	return &fakeObject{path: d.childPath("ActiveConnection", exists),
+		values: []string{device.ConnectionId, device.ConnectionUuid, device.ConnectionType}}, nil
+}
+
+// childPath returns "/" for absent object, the same as NetworkManager does
+func (d *fakeDevice) childPath(name string, exists bool) dbus.ObjectPath {
+	if !exists {
+		return "/"
+	}
+	return d.path + dbus.ObjectPath("/"+name)
+}
+
+// fakeObject is a snapshot of ip config, access point or active connection taken when device property was read
+type fakeObject struct {
+	path   dbus.ObjectPath
+	values []string
+}
+
+func (o *fakeObject) Path() dbus.ObjectPath {
+	return o.path
+}
+
+func (o *fakeObject) value(i int) (string, error) {
+	if o.path == "/" {
+		return "", fmt.Errorf("unknown object %s", o.path)
+	}
+	return o.values[i], nil
+}
+
+func (o *fakeObject) Gateway() (string, error) {
+	return o.value(0)
+}
+
+func (o *fakeObject) Ssid() (string, error) {
+	return o.value(0)
+}
+
+func (o *fakeObject) Bssid() (string, error) {
+	return o.value(1)
+}
+
+func (o *fakeObject) Id() (string, error) {
+	return o.value(0)
+}
+
+func (o *fakeObject) Uuid() (string, error) {
+	return o.value(1)
+}
+
+func (o *fakeObject) Type() (string, error) {
+	return o.value(2)
+}
@@ -0,0 +1,46 @@
+package dbusapi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const logindName = "org.freedesktop.login1"
+
+// InhibitSleep takes logind delay inhibitor lock.
+//
+// Sleep is delayed until the returned file is closed, but not longer than logind InhibitDelayMaxSec
+func InhibitSleep(why string) (*os.File, error) {
+	c := getConn()
+	if c == nil {
+		return nil, errors.New("not connected to the system bus")
+	}
+	var fd dbus.UnixFD
+	err := c.Object(logindName, "/org/freedesktop/login1").Call("org.freedesktop.login1.Manager.Inhibit", 0,
+		"sleep", "network-dispatcher", why, "delay").Store(&fd)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "sleep-inhibitor"), nil
+}
+
+// InhibitDelayMax returns logind InhibitDelayMaxSec, the longest time sleep is delayed by the delay inhibitor lock
+func InhibitDelayMax() (time.Duration, error) {
+	c := getConn()
+	if c == nil {
+		return 0, errors.New("not connected to the system bus")
+	}
+	variant, err := c.Object(logindName, "/org/freedesktop/login1").GetProperty("org.freedesktop.login1.Manager.InhibitDelayMaxUSec")
+	if err != nil {
+		return 0, err
+	}
+	usec, ok := variant.Value().(uint64)
+	if !ok {
+		return 0, fmt.Errorf("unexpected InhibitDelayMaxUSec type %s", variant.Signature())
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
@@ -0,0 +1,238 @@
+package dbusapi
+
+import (
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// NetworkManager is the part of NetworkManager dbus api the dispatcher queries on device events.
+//
+// SystemBus talks to the real NetworkManager, FakeNetworkManager keeps everything in memory
+type NetworkManager interface {
+	// IsConnected tells whether NetworkManager could be queried right now
+	IsConnected() bool
+	// Device returns device by its object path. Device is not queried until its properties are read
+	Device(path dbus.ObjectPath) Device
+	GetDeviceByInterfaceName(name string) (Device, error)
+	// GetDevicePaths returns object paths of all network devices known to NetworkManager
+	GetDevicePaths() ([]dbus.ObjectPath, error)
+	// GetConnectivity returns NetworkManager connectivity state, one of NM_CONNECTIVITY_* values
+	GetConnectivity() (uint32, error)
+}
+
+// Device is org.freedesktop.NetworkManager.Device object
+type Device interface {
+	Path() dbus.ObjectPath
+	GetState() (uint32, error)
+	GetDeviceType() (uint32, error)
+	GetInterfaceName() (string, error)
+	// Path of the returned config is "/" when device has no IPv4 configuration yet
+	Ip4Config() (IpConfig, error)
+	// Path of the returned config is "/" when device has no IPv6 configuration yet
+	Ip6Config() (IpConfig, error)
+	// ActiveAccessPoint returns wifi access point device is connected to.
+	//
+	// Path is "/" when device is not connected to any access point
+	ActiveAccessPoint() (AccessPoint, error)
+	// ActiveConnection returns connection profile activated on the device.
+	//
+	// Path is "/" when device has no active connection
+	ActiveConnection() (ActiveConnection, error)
+}
+
+// IpConfig is org.freedesktop.NetworkManager.IP4Config or IP6Config object
+type IpConfig interface {
+	Path() dbus.ObjectPath
+	Gateway() (string, error)
+}
+
+type AccessPoint interface {
+	Path() dbus.ObjectPath
+	Ssid() (string, error)
+	// Bssid returns mac address of the access point
+	Bssid() (string, error)
+}
+
+// ActiveConnection is NetworkManager connection profile currently applied to the device
+type ActiveConnection interface {
+	Path() dbus.ObjectPath
+	// Id returns connection profile name, e.g. "Home"
+	Id() (string, error)
+	Uuid() (string, error)
+	// Type returns connection profile type, e.g. 802-11-wireless or 802-3-ethernet
+	Type() (string, error)
+}
+
+// SystemBus queries NetworkManager over the system bus connection established by Connect
+type SystemBus struct{}
+
+func (SystemBus) IsConnected() bool {
+	return IsConnected()
+}
+
+func (SystemBus) Device(path dbus.ObjectPath) Device {
+	return NewNetworkAdapter(path)
+}
+
+func (SystemBus) GetDeviceByInterfaceName(name string) (Device, error) {
+	var path dbus.ObjectPath
+	err := getConn().Object(networkManagerName, networkManagerPath).Call("org.freedesktop.NetworkManager.GetDeviceByIpIface", 0, name).Store(&path)
+	if err != nil {
+		return nil, err
+	}
+	return NewNetworkAdapter(path), nil
+}
+
+func (SystemBus) GetDevicePaths() ([]dbus.ObjectPath, error) {
+	var paths []dbus.ObjectPath
+	err := getConn().Object(networkManagerName, networkManagerPath).Call("org.freedesktop.NetworkManager.GetDevices", 0).Store(&paths)
+	return paths, err
+}
+
+func (SystemBus) GetConnectivity() (uint32, error) {
+	var connectivity uint32
+	err := getConn().Object(networkManagerName, networkManagerPath).Call("org.freedesktop.DBus.Properties.Get", 0,
+		networkManagerName, "Connectivity").Store(&connectivity)
+	return connectivity, err
+}
+
+// NetworkAdapter is Device on the system bus
+type NetworkAdapter struct {
+	object dbus.BusObject
+}
+
+type ipConfig struct {
+	object dbus.BusObject
+	// org.freedesktop.NetworkManager.IP4Config or IP6Config
+	iface string
+}
+
+type accessPoint struct {
+	object dbus.BusObject
+}
+
+type activeConnection struct {
+	object dbus.BusObject
+}
+
+func NewNetworkAdapter(path dbus.ObjectPath) *NetworkAdapter {
+	return &NetworkAdapter{object: getConn().Object(networkManagerName, path)}
+}
+
+// Path returns dbus object path of the device
+func (n *NetworkAdapter) Path() dbus.ObjectPath {
+	return n.object.Path()
+}
+
+func (n *NetworkAdapter) Ip4Config() (IpConfig, error) {
+	path, err := n.getPathProperty("org.freedesktop.NetworkManager.Device", "Ip4Config")
+	if err != nil {
+		return nil, err
+	}
+	return &ipConfig{object: getConn().Object(networkManagerName, path), iface: "org.freedesktop.NetworkManager.IP4Config"}, nil
+}
+
+func (n *NetworkAdapter) Ip6Config() (IpConfig, error) {
+	path, err := n.getPathProperty("org.freedesktop.NetworkManager.Device", "Ip6Config")
+	if err != nil {
+		return nil, err
+	}
+	return &ipConfig{object: getConn().Object(networkManagerName, path), iface: "org.freedesktop.NetworkManager.IP6Config"}, nil
+}
+
+func (n *NetworkAdapter) GetState() (uint32, error) {
+	var state uint32
+	err := n.object.Call("org.freedesktop.DBus.Properties.Get", 0,
+		"org.freedesktop.NetworkManager.Device", "State").Store(&state)
+	return state, err
+}
+
+func (n *NetworkAdapter) GetDeviceType() (uint32, error) {
+	var deviceType uint32
+	err := n.object.Call("org.freedesktop.DBus.Properties.Get", 0,
+		"org.freedesktop.NetworkManager.Device", "DeviceType").Store(&deviceType)
+	return deviceType, err
+}
+
+func (n *NetworkAdapter) GetInterfaceName() (string, error) {
+	var name string
+	err := n.object.Call("org.freedesktop.DBus.Properties.Get", 0,
+		"org.freedesktop.NetworkManager.Device", "Interface").Store(&name)
+	return name, err
+}
+
+func (n *NetworkAdapter) ActiveAccessPoint() (AccessPoint, error) {
+	path, err := n.getPathProperty("org.freedesktop.NetworkManager.Device.Wireless", "ActiveAccessPoint")
+	if err != nil {
+		return nil, err
+	}
+	return &accessPoint{object: getConn().Object(networkManagerName, path)}, nil
+}
+
+func (n *NetworkAdapter) ActiveConnection() (ActiveConnection, error) {
+	path, err := n.getPathProperty("org.freedesktop.NetworkManager.Device", "ActiveConnection")
+	if err != nil {
+		return nil, err
+	}
+	return &activeConnection{object: getConn().Object(networkManagerName, path)}, nil
+}
+
+func (n *NetworkAdapter) getPathProperty(iface string, name string) (dbus.ObjectPath, error) {
+	var path dbus.ObjectPath
+	err := n.object.Call("org.freedesktop.DBus.Properties.Get", 0, iface, name).Store(&path)
+	return path, err
+}
+
+func (c *ipConfig) Path() dbus.ObjectPath {
+	return c.object.Path()
+}
+
+func (c *ipConfig) Gateway() (string, error) {
+	gateway, err := c.object.GetProperty(c.iface + ".Gateway")
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(gateway.String(), "\"", ""), nil
+}
+
+func (a *accessPoint) Path() dbus.ObjectPath {
+	return a.object.Path()
+}
+
+func (a *accessPoint) Ssid() (string, error) {
+	var ssid []byte
+	err := a.object.Call("org.freedesktop.DBus.Properties.Get", 0,
+		"org.freedesktop.NetworkManager.AccessPoint", "Ssid").Store(&ssid)
+	return string(ssid), err
+}
+
+func (a *accessPoint) Bssid() (string, error) {
+	var address string
+	err := a.object.Call("org.freedesktop.DBus.Properties.Get", 0,
+		"org.freedesktop.NetworkManager.AccessPoint", "HwAddress").Store(&address)
+	return address, err
+}
+
+func (a *activeConnection) Path() dbus.ObjectPath {
+	return a.object.Path()
+}
+
+func (a *activeConnection) Id() (string, error) {
+	return a.getStringProperty("Id")
+}
+
+func (a *activeConnection) Uuid() (string, error) {
+	return a.getStringProperty("Uuid")
+}
+
+func (a *activeConnection) Type() (string, error) {
+	return a.getStringProperty("Type")
+}
+
+func (a *activeConnection) getStringProperty(name string) (string, error) {
+	var value string
+	err := a.object.Call("org.freedesktop.DBus.Properties.Get", 0,
+		"org.freedesktop.NetworkManager.Connection.Active", name).Store(&value)
+	return value, err
+}
@@ -0,0 +1,86 @@
+// Package nmtest runs private dbus-daemon with scriptable fake NetworkManager for integration tests.
+//
+// Bus becomes the system bus of the test process, so dbusapi talks to the fake the same way it talks to NetworkManager
+package nmtest
+
+import (
+	"bufio"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Bus is private dbus-daemon started with the session bus policy
+type Bus struct {
+	Address string
+	t       testing.TB
+	cmd     *exec.Cmd
+}
+
+// StartBus starts dbus-daemon and points DBUS_SYSTEM_BUS_ADDRESS to it until the test ends.
+//
+// Test is skipped when dbus-daemon is not installed
+func StartBus(t testing.TB) *Bus {
+	t.Helper()
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon is not installed")
+	}
+	// fixed address allows to restart the bus at the same place
+	b := &Bus{Address: "unix:path=" + filepath.Join(t.TempDir(), "bus"), t: t}
+	b.start()
+	t.Setenv("DBUS_SYSTEM_BUS_ADDRESS", b.Address)
+	t.Cleanup(b.Stop)
+	return b
+}
+
+func (b *Bus) start() {
+	b.t.Helper()
+	cmd := exec.Command("dbus-daemon", "--session", "--nofork", "--nopidfile", "--print-address=1", "--address="+b.Address)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		b.t.Fatalf("failed to start dbus-daemon: %v", err)
+	}
+	// daemon prints its address once it accepts connections
+	ready := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(stdout).ReadString('\n')
+		if err == nil && !strings.HasPrefix(line, "unix:") {
+			err = fmt.Errorf("unexpected dbus-daemon address %q", line)
+		}
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(10 * time.Second):
+		err = fmt.Errorf("dbus-daemon did not start in time")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		b.t.Fatal(err)
+	}
+	b.cmd = cmd
+}
+
+// Stop kills dbus-daemon. All connections to the bus are lost
+func (b *Bus) Stop() {
+	if b.cmd == nil {
+		return
+	}
+	b.cmd.Process.Kill()
+	b.cmd.Wait()
+	b.cmd = nil
+}
+
+// Restart starts dbus-daemon again at the same address, e.g. to test reconnects
+func (b *Bus) Restart() {
+	b.t.Helper()
+	b.Stop()
+	b.start()
+}
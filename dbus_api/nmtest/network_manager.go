@@ -0,0 +1,280 @@
+package nmtest
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	dbusapi "network-dispatcher/dbus_api"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	networkManagerName  = "org.freedesktop.NetworkManager"
+	networkManagerPath  = dbus.ObjectPath("/org/freedesktop/NetworkManager")
+	deviceInterface     = "org.freedesktop.NetworkManager.Device"
+	propertiesInterface = "org.freedesktop.DBus.Properties"
+)
+
+// Objects owned by the device. Their paths are /org/freedesktop/NetworkManager/<kind>/<device number>
+const (
+	ip4ConfigKind        = "IP4Config"
+	ip6ConfigKind        = "IP6Config"
+	accessPointKind      = "AccessPoint"
+	activeConnectionKind = "ActiveConnection"
+)
+
+// NetworkManager is fake org.freedesktop.NetworkManager exported on the Bus.
+//
+// Devices are described with dbusapi.FakeDevice. Device paths must be /org/freedesktop/NetworkManager/Devices/<number>
+type NetworkManager struct {
+	t            testing.TB
+	conn         *dbus.Conn
+	mu           sync.Mutex
+	devices      map[dbus.ObjectPath]dbusapi.FakeDevice
+	connectivity uint32
+	// number of property reads keyed by path of the device which owns the object and property name
+	gets map[string]int
+}
+
+// Export connects to the bus and exports NetworkManager objects under the well-known name
+func Export(t testing.TB, bus *Bus) *NetworkManager {
+	t.Helper()
+	nm := &NetworkManager{t: t, devices: map[dbus.ObjectPath]dbusapi.FakeDevice{}, gets: map[string]int{}}
+	nm.connect(bus)
+	t.Cleanup(func() { nm.conn.Close() })
+	return nm
+}
+
+// Reconnect exports the same objects again, e.g. after Bus.Restart
+func (nm *NetworkManager) Reconnect(bus *Bus) {
+	nm.t.Helper()
+	nm.conn.Close()
+	nm.connect(bus)
+}
+
+func (nm *NetworkManager) connect(bus *Bus) {
+	nm.t.Helper()
+	conn, err := dbus.Connect(bus.Address)
+	if err != nil {
+		nm.t.Fatalf("failed to connect to the test bus: %v", err)
+	}
+	nm.conn = conn
+	if err := conn.Export(&root{nm}, networkManagerPath, networkManagerName); err != nil {
+		nm.t.Fatal(err)
+	}
+	if err := conn.ExportSubtree(&properties{nm}, networkManagerPath, propertiesInterface); err != nil {
+		nm.t.Fatal(err)
+	}
+	nm.Start()
+}
+
+// Start takes NetworkManager name, the same as NetworkManager does on start
+func (nm *NetworkManager) Start() {
+	nm.t.Helper()
+	reply, err := nm.conn.RequestName(networkManagerName, dbus.NameFlagDoNotQueue)
+	if err != nil || reply != dbus.RequestNameReplyPrimaryOwner {
+		nm.t.Fatalf("failed to own %s: %v %v", networkManagerName, reply, err)
+	}
+}
+
+// Stop releases NetworkManager name, the same as NetworkManager does on exit.
+// Objects could still be queried, but clients see NetworkManager is gone
+func (nm *NetworkManager) Stop() {
+	nm.t.Helper()
+	if _, err := nm.conn.ReleaseName(networkManagerName); err != nil {
+		nm.t.Fatal(err)
+	}
+}
+
+// SetDevice adds the device or replaces the one with the same path without any signals
+func (nm *NetworkManager) SetDevice(device dbusapi.FakeDevice) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	nm.devices[device.Path] = device
+}
+
+// SetState changes device state and emits StateChanged signal
+func (nm *NetworkManager) SetState(devicePath dbus.ObjectPath, state uint32) {
+	nm.t.Helper()
+	nm.mu.Lock()
+	device, ok := nm.devices[devicePath]
+	old := device.State
+	device.State = state
+	nm.devices[devicePath] = device
+	nm.mu.Unlock()
+	if !ok {
+		nm.t.Fatalf("unknown device %s", devicePath)
+	}
+	nm.EmitStateChanged(devicePath, state, old)
+}
+
+// EmitStateChanged emits StateChanged signal without changing the device, e.g. stale signal of already deactivated device
+func (nm *NetworkManager) EmitStateChanged(devicePath dbus.ObjectPath, state uint32, old uint32) {
+	nm.t.Helper()
+	// reason is NM_DEVICE_STATE_REASON_NONE
+	if err := nm.conn.Emit(devicePath, deviceInterface+".StateChanged", state, old, uint32(0)); err != nil {
+		nm.t.Fatal(err)
+	}
+}
+
+// SetConnectivity changes NetworkManager connectivity and emits PropertiesChanged signal
+func (nm *NetworkManager) SetConnectivity(connectivity uint32) {
+	nm.t.Helper()
+	nm.mu.Lock()
+	nm.connectivity = connectivity
+	nm.mu.Unlock()
+	changed := map[string]dbus.Variant{"Connectivity": dbus.MakeVariant(connectivity)}
+	if err := nm.conn.Emit(networkManagerPath, propertiesInterface+".PropertiesChanged", networkManagerName, changed, []string{}); err != nil {
+		nm.t.Fatal(err)
+	}
+}
+
+// Gets returns how many times property of the device or its objects was read, e.g. Ip4Config or Gateway
+func (nm *NetworkManager) Gets(devicePath dbus.ObjectPath, property string) int {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	return nm.gets[string(devicePath)+" "+property]
+}
+
+// root is org.freedesktop.NetworkManager interface of the NetworkManager object
+type root struct {
+	nm *NetworkManager
+}
+
+func (r *root) GetDevices() ([]dbus.ObjectPath, *dbus.Error) {
+	r.nm.mu.Lock()
+	defer r.nm.mu.Unlock()
+	paths := make([]dbus.ObjectPath, 0, len(r.nm.devices))
+	for devicePath := range r.nm.devices {
+		paths = append(paths, devicePath)
+	}
+	return paths, nil
+}
+
+func (r *root) GetDeviceByIpIface(iface string) (dbus.ObjectPath, *dbus.Error) {
+	r.nm.mu.Lock()
+	defer r.nm.mu.Unlock()
+	for devicePath, device := range r.nm.devices {
+		if device.Interface == iface {
+			return devicePath, nil
+		}
+	}
+	return "", dbus.NewError("org.freedesktop.NetworkManager.UnknownDevice", []interface{}{"No device found for the requested iface."})
+}
+
+// properties is org.freedesktop.DBus.Properties interface of all NetworkManager objects
+type properties struct {
+	nm *NetworkManager
+}
+
+func (p *properties) Get(msg dbus.Message, iface string, name string) (dbus.Variant, *dbus.Error) {
+	objectPath, _ := msg.Headers[dbus.FieldPath].Value().(dbus.ObjectPath)
+	p.nm.mu.Lock()
+	defer p.nm.mu.Unlock()
+	if objectPath == networkManagerPath {
+		return p.getManagerProperty(name)
+	}
+	kind, device, ok := p.findObject(objectPath)
+	if !ok {
+		return dbus.Variant{}, dbus.NewError("org.freedesktop.DBus.Error.UnknownObject", []interface{}{fmt.Sprintf("No such object path '%s'", objectPath)})
+	}
+	p.nm.gets[string(device.Path)+" "+name]++
+	if err := device.Errors[name]; err != nil {
+		return dbus.Variant{}, dbus.MakeFailedError(err)
+	}
+	var value any
+	switch kind + "." + name {
+	case "Devices.State":
+		value = device.State
+	case "Devices.DeviceType":
+		value = device.DeviceType
+	case "Devices.Interface":
+		value = device.Interface
+	case "Devices.Ip4Config":
+		value = childPath(ip4ConfigKind, device)
+	case "Devices.Ip6Config":
+		value = childPath(ip6ConfigKind, device)
+	case "Devices.ActiveAccessPoint":
+		value = childPath(accessPointKind, device)
+	case "Devices.ActiveConnection":
+		value = childPath(activeConnectionKind, device)
+	case ip4ConfigKind + ".Gateway":
+		value = device.Ip4Gateway
+	case ip6ConfigKind + ".Gateway":
+		value = device.Ip6Gateway
+	case accessPointKind + ".Ssid":
+		value = []byte(device.SSID)
+	case accessPointKind + ".HwAddress":
+		value = device.BSSID
+	case activeConnectionKind + ".Id":
+		value = device.ConnectionId
+	case activeConnectionKind + ".Uuid":
+		value = device.ConnectionUuid
+	case activeConnectionKind + ".Type":
+		value = device.ConnectionType
+	default:
+		return dbus.Variant{}, unknownProperty(iface, name)
+	}
+	return dbus.MakeVariant(value), nil
+}
+
+// Must be called with nm.mu held
+func (p *properties) getManagerProperty(name string) (dbus.Variant, *dbus.Error) {
+	switch name {
+	case "Connectivity":
+		return dbus.MakeVariant(p.nm.connectivity), nil
+	case "PrimaryConnection":
+		return dbus.MakeVariant(dbus.ObjectPath("/")), nil
+	}
+	return dbus.Variant{}, unknownProperty(networkManagerName, name)
+}
+
+// findObject returns kind of the object, e.g. IP4Config, and device which owns it.
+// Must be called with nm.mu held
+func (p *properties) findObject(objectPath dbus.ObjectPath) (string, dbusapi.FakeDevice, bool) {
+	kind, number, ok := strings.Cut(strings.TrimPrefix(string(objectPath), string(networkManagerPath)+"/"), "/")
+	if !ok {
+		return "", dbusapi.FakeDevice{}, false
+	}
+	for devicePath, device := range p.nm.devices {
+		if path.Base(string(devicePath)) != number {
+			continue
+		}
+		// child object exists only while device has it
+		if kind != "Devices" && childPath(kind, device) != objectPath {
+			return "", dbusapi.FakeDevice{}, false
+		}
+		return kind, device, true
+	}
+	return "", dbusapi.FakeDevice{}, false
+}
+
+// childPath returns "/" for absent object, the same as NetworkManager does
+func childPath(kind string, device dbusapi.FakeDevice) dbus.ObjectPath {
+	if !hasChild(kind, device) {
+		return "/"
+	}
+	return networkManagerPath + dbus.ObjectPath("/"+kind+"/"+path.Base(string(device.Path)))
+}
+
+func hasChild(kind string, device dbusapi.FakeDevice) bool {
+	switch kind {
+	case ip4ConfigKind:
+		return device.Ip4Gateway != ""
+	case ip6ConfigKind:
+		return device.Ip6Gateway != ""
+	case accessPointKind:
+		return device.SSID != "" || device.BSSID != ""
+	case activeConnectionKind:
+		return device.ConnectionId != "" || device.ConnectionUuid != ""
+	}
+	return false
+}
+
+func unknownProperty(iface string, name string) *dbus.Error {
+	return dbus.NewError("org.freedesktop.DBus.Error.UnknownProperty", []interface{}{fmt.Sprintf("No such property '%s' on interface '%s'", name, iface)})
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"network-dispatcher/config"
+	"network-dispatcher/logging"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Disconnect of the network which might come back soon, e.g. on weak wifi
+type pendingDisconnect struct {
+	event          config.Event
+	disconnectedAt time.Time
+	// disconnect entities by their debounce window which did not run yet
+	entities map[time.Duration][]matchedEntity
+	// debounce windows already passed. Network coming back after them is connected again as usual
+	expired map[time.Duration]bool
+	// the longest debounce window of all entities. Disconnect is forgotten after it
+	window time.Duration
+	timers []timer
+}
+
+type timer interface {
+	Stop() bool
+}
+
+// clock of the debounce windows. Replaced in tests
+type clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) timer
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) AfterFunc(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
+
+// disconnectDebouncer delays disconnect scripts of entities with Debounce
+// until network doesn't come back to the same gateway on the same interface within the entity window
+type disconnectDebouncer struct {
+	mu    sync.Mutex
+	clock clock
+	// interface and gateway mac address -> disconnect
+	pending map[string]*pendingDisconnect
+}
+
+var disconnects = newDisconnectDebouncer(systemClock{})
+
+func newDisconnectDebouncer(clock clock) *disconnectDebouncer {
+	return &disconnectDebouncer{clock: clock, pending: map[string]*pendingDisconnect{}}
+}
+
+// pendingKey identifies the disconnected network. Gateway reached through another interface is another network
+func pendingKey(ifName string, macAddress string) string {
+	return ifName + " " + macAddress
+}
+
+// splitDebounced splits entities into ones which run right away and ones with debounce window
+func splitDebounced(entities []matchedEntity) ([]matchedEntity, map[time.Duration][]matchedEntity) {
+	global := configStore.Current().Debounce
+	var immediate []matchedEntity
+	debounced := map[time.Duration][]matchedEntity{}
+	for _, entity := range entities {
+		if window := entity.GetDebounce(global); window > 0 {
+			debounced[window] = append(debounced[window], entity)
+		} else {
+			immediate = append(immediate, entity)
+		}
+	}
+	return immediate, debounced
+}
+
+// debounceWindows returns distinct debounce windows of all entities in ascending order
+func debounceWindows() []time.Duration {
+	conf := configStore.Current()
+	var windows []time.Duration
+	for _, entity := range conf.Entities {
+		if window := entity.GetDebounce(conf.Debounce); window > 0 && !slices.Contains(windows, window) {
+			windows = append(windows, window)
+		}
+	}
+	slices.Sort(windows)
+	return windows
+}
+
+// schedule remembers disconnect of the gateway and runs debounced entities after their windows
+// unless network comes back to the same gateway on the same interface before.
+//
+// Repeated disconnect of the network still pending keeps the first one, since network never came back in between
+func (d *disconnectDebouncer) schedule(event config.Event, entities map[time.Duration][]matchedEntity) {
+	windows := debounceWindows()
+	if len(windows) == 0 {
+		return
+	}
+	key := pendingKey(event.Interface, event.MacAddress)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.pending[key]; ok {
+		slog.Debug("Network disconnect is already pending", logging.Interface, event.Interface, logging.Mac, event.MacAddress)
+		return
+	}
+	p := &pendingDisconnect{
+		event:          event,
+		disconnectedAt: d.clock.Now(),
+		entities:       entities,
+		expired:        map[time.Duration]bool{},
+		window:         windows[len(windows)-1]}
+	d.pending[key] = p
+	for _, window := range windows {
+		p.timers = append(p.timers, d.clock.AfterFunc(window, func() { d.expire(key, p, window) }))
+	}
+}
+
+func (d *disconnectDebouncer) expire(key string, p *pendingDisconnect, window time.Duration) {
+	d.mu.Lock()
+	if d.pending[key] != p {
+		// network came back
+		d.mu.Unlock()
+		return
+	}
+	entities := p.entities[window]
+	delete(p.entities, window)
+	p.expired[window] = true
+	if window == p.window {
+		delete(d.pending, key)
+	}
+	d.mu.Unlock()
+
+	if len(entities) > 0 {
+		slog.Info("Network did not come back within debounce window. Run disconnect scripts",
+			logging.Interface, p.event.Interface, logging.Mac, p.event.MacAddress, "window", window)
+		runEntityScripts(context.Background(), p.event, entities)
+	}
+}
+
+// reconnected cancels pending disconnect of the gateway on the interface. Returns nil when there is none
+func (d *disconnectDebouncer) reconnected(ifName string, macAddress string) *pendingDisconnect {
+	key := pendingKey(ifName, macAddress)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.pending[key]
+	if !ok {
+		return nil
+	}
+	p.stop()
+	delete(d.pending, key)
+	return p
+}
+
+// flush runs all pending disconnect scripts right away, e.g. before suspend
+func (d *disconnectDebouncer) flush() {
+	d.mu.Lock()
+	pending := d.pending
+	d.pending = map[string]*pendingDisconnect{}
+	d.mu.Unlock()
+
+	for _, p := range pending {
+		p.stop()
+		windows := make([]time.Duration, 0, len(p.entities))
+		for window := range p.entities {
+			windows = append(windows, window)
+		}
+		slices.Sort(windows)
+		for _, window := range windows {
+			runEntityScripts(context.Background(), p.event, p.entities[window])
+		}
+	}
+}
+
+func (p *pendingDisconnect) stop() {
+	for _, timer := range p.timers {
+		timer.Stop()
+	}
+}
+
+// cameBackWithin tells whether network came back before the debounce window passed
+func (p *pendingDisconnect) cameBackWithin(window time.Duration) bool {
+	return p != nil && window > 0 && !p.expired[window]
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"network-dispatcher/config"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock fires timers only when the test advances it
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock   *fakeClock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	stopped := t.stopped
+	t.stopped = true
+	return !stopped
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// advance moves the clock and runs timers which are due in their order
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	for _, t := range c.timers {
+		if !t.stopped && !t.at.After(c.now) {
+			t.stopped = true
+			due = append(due, t)
+		}
+	}
+	c.mu.Unlock()
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, t := range due {
+		t.f()
+	}
+}
+
+// newDebounceTest loads config with 20 seconds debounce of wifi and ethernet entities
+func newDebounceTest(t *testing.T) *fakeClock {
+	newTestDispatcher(t)
+	dir := t.TempDir()
+	hook := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	loadConfig(t, dir, fmt.Sprintf(`{"Debounce": "20s", "Entities": [
+		{"Script": %[1]q, "Event": "connected", "DeviceTypes": ["wifi", "ethernet"]},
+		{"Script": %[1]q, "Event": "reconnected", "DeviceTypes": ["wifi", "ethernet"]},
+		{"Script": %[1]q, "Event": "disconnected", "DeviceTypes": ["wifi", "ethernet"]}]}`, hook))
+	clock := &fakeClock{now: time.Now()}
+	disconnects = newDisconnectDebouncer(clock)
+	return clock
+}
+
+func homeNetwork(ifName string) *config.ConnectedGateway {
+	deviceType := "wifi"
+	if ifName != "wlan0" {
+		deviceType = "ethernet"
+	}
+	return &config.ConnectedGateway{Interface: ifName, DeviceType: deviceType, Gateway: homeGateway, MacAddress: homeMac}
+}
+
+func assertDispatched(t *testing.T, want ...string) {
+	t.Helper()
+	if got := dispatchedEvents(); !slices.Equal(got, want) {
+		t.Errorf("dispatched events = %q, want %q", got, want)
+	}
+}
+
+func TestDebouncedDisconnectRunsAfterWindow(t *testing.T) {
+	clock := newDebounceTest(t)
+	dispatchDisconnected(homeNetwork("wlan0"))
+	clock.advance(19 * time.Second)
+	assertDispatched(t)
+
+	clock.advance(time.Second)
+	assertDispatched(t, "disconnected wlan0 "+homeMac)
+
+	// network coming back after the window is connected as usual
+	dispatchConnected(context.Background(), homeNetwork("wlan0"))
+	assertDispatched(t, "disconnected wlan0 "+homeMac, "connected wlan0 "+homeMac)
+}
+
+func TestReconnectWithinWindowCancelsDisconnect(t *testing.T) {
+	clock := newDebounceTest(t)
+	dispatchDisconnected(homeNetwork("wlan0"))
+	clock.advance(10 * time.Second)
+	dispatchConnected(context.Background(), homeNetwork("wlan0"))
+	assertDispatched(t, "reconnected wlan0 "+homeMac)
+
+	clock.advance(time.Minute)
+	assertDispatched(t, "reconnected wlan0 "+homeMac)
+}
+
+func TestOverlappingDisconnectsOfInterfaces(t *testing.T) {
+	clock := newDebounceTest(t)
+	dispatchDisconnected(homeNetwork("wlan0"))
+	clock.advance(5 * time.Second)
+	dispatchDisconnected(homeNetwork("eth0"))
+	// ethernet coming back doesn't cancel wifi disconnect of the same gateway
+	dispatchConnected(context.Background(), homeNetwork("eth0"))
+	assertDispatched(t, "reconnected eth0 "+homeMac)
+
+	clock.advance(15 * time.Second)
+	assertDispatched(t, "reconnected eth0 "+homeMac, "disconnected wlan0 "+homeMac)
+}
+
+func TestRepeatedDisconnectKeepsFirstWindow(t *testing.T) {
+	clock := newDebounceTest(t)
+	dispatchDisconnected(homeNetwork("wlan0"))
+	clock.advance(10 * time.Second)
+	dispatchDisconnected(homeNetwork("wlan0"))
+	clock.advance(10 * time.Second)
+	assertDispatched(t, "disconnected wlan0 "+homeMac)
+
+	clock.advance(time.Minute)
+	assertDispatched(t, "disconnected wlan0 "+homeMac)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	dbusapi "network-dispatcher/dbus_api"
+	"network-dispatcher/logging"
+	"network-dispatcher/netlink_api"
+	"network-dispatcher/trace"
+	"time"
+)
+
+// retryPolicy of lookups which are often not ready right after the event,
+// e.g. gateway is assigned a bit after device is activated and its macaddress is known only after arp reply
+type retryPolicy struct {
+	attempts int
+	delay    time.Duration
+}
+
+// it's 5 seconds
+var defaultRetry = retryPolicy{attempts: 50, delay: 100 * time.Millisecond}
+
+// networkDispatcher resolves network details of the device events and dispatches them to the entities.
+//
+// NetworkManager and kernel are queried only through the injected apis, so event flows could run against fakes
+type networkDispatcher struct {
+	nm     dbusapi.NetworkManager
+	routes netlink_api.Routes
+	retry  retryPolicy
+	// events of every device are dispatched one by one
+	events *eventQueue
+	// writes received signals and lookup results into the trace file. Nil unless started with --record
+	recorder *trace.Recorder
+	// longest wait for disconnect scripts before sleep
+	sleepDelay func() time.Duration
+}
+
+var dispatcher = newNetworkDispatcher(dbusapi.SystemBus{}, netlink_api.Kernel{})
+
+func newNetworkDispatcher(nm dbusapi.NetworkManager, routes netlink_api.Routes) *networkDispatcher {
+	d := &networkDispatcher{nm: nm, routes: routes, retry: defaultRetry, sleepDelay: logindSleepDelay}
+	d.events = newEventQueue(d)
+	return d
+}
+
+// record writes signals and lookups of the dispatcher into the trace for the replay command
+func (d *networkDispatcher) record(recorder *trace.Recorder) {
+	d.nm = trace.RecordNetworkManager(d.nm, recorder)
+	d.routes = trace.RecordRoutes(d.routes, recorder)
+	d.recorder = recorder
+}
+
+// getGatewayMacAddress looks up gateway macaddress in the neighbour table until it's resolved
+func (d *networkDispatcher) getGatewayMacAddress(gateway string) (string, error) {
+	var err error
+	var address string
+	for attempt := 1; attempt <= d.retry.attempts; attempt++ {
+		address, err = d.routes.GetNeighbourMacAddress(gateway)
+		if err == nil && address != "" {
+			slog.Debug("Received gateway macaddress", logging.Gateway, gateway, logging.Mac, address, "attempt", attempt)
+			return address, nil
+		}
+		time.Sleep(d.retry.delay)
+	}
+	if err == nil {
+		err = errors.New("macaddress is empty")
+	}
+	return "", fmt.Errorf("%v in %d attempts", err, d.retry.attempts)
+}
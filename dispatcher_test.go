@@ -0,0 +1,581 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"network-dispatcher/config"
+	dbusapi "network-dispatcher/dbus_api"
+	"network-dispatcher/netlink_api"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	wifiPath     = dbus.ObjectPath("/org/freedesktop/NetworkManager/Devices/3")
+	homeGateway  = "192.168.1.1"
+	homeMac      = "cc:ce:cc:ce:ce:cc"
+	officeMac    = "aa:bb:cc:dd:ee:ff"
+	ipv6Gateway  = "fe80::1"
+	ipv6Mac      = "11:22:33:44:55:66"
+	testAttempts = 5
+)
+
+// homeWifi is activated wifi device connected to the home network
+func homeWifi() dbusapi.FakeDevice {
+	return dbusapi.FakeDevice{
+		Path:           wifiPath,
+		Interface:      "wlan0",
+		DeviceType:     dbusapi.NM_DEVICE_TYPE_WIFI,
+		State:          dbusapi.NM_DEVICE_STATE_ACTIVATED,
+		Ip4Gateway:     homeGateway,
+		SSID:           "Home",
+		BSSID:          "00:11:22:33:44:55",
+		ConnectionId:   "Home",
+		ConnectionUuid: "6f1b7e1c-8f1e-4c1a-9a57-1d7d3c4a9d01",
+		ConnectionType: "802-11-wireless"}
+}
+
+// newTestDispatcher resets daemon state and loads config with connected and disconnected wifi entities
+func newTestDispatcher(t *testing.T) (*networkDispatcher, *dbusapi.FakeNetworkManager, *netlink_api.FakeRoutes) {
+	t.Helper()
+	dir := t.TempDir()
+	script := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	conf := fmt.Sprintf(`{"Entities": [{"Script": %q, "Event": "connected"}, {"Script": %q, "Event": "disconnected"}]}`, script, script)
+	configPath := filepath.Join(dir, ConfigFileName)
+	if err := os.WriteFile(configPath, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configStore = config.NewStore(configPath)
+	if err := configStore.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	state = newDaemonState()
+	disconnects = newDisconnectDebouncer(systemClock{})
+
+	nm := dbusapi.NewFakeNetworkManager()
+	routes := netlink_api.NewFakeRoutes()
+	routes.SetNeighbour(homeGateway, homeMac)
+	routes.SetNeighbour(ipv6Gateway, ipv6Mac)
+	routes.SetDeviceType("wlan0", "wifi")
+	d := newNetworkDispatcher(nm, routes)
+	d.retry = retryPolicy{attempts: testAttempts, delay: time.Millisecond}
+	dispatcher = d
+	return d, nm, routes
+}
+
+// dispatchedEvents returns dispatched events as "event interface mac"
+func dispatchedEvents() []string {
+	var dispatched []string
+	for _, record := range state.status().Events {
+		dispatched = append(dispatched, fmt.Sprintf("%s %s %s", record.Event.Event, record.Event.Interface, record.Event.MacAddress))
+	}
+	return dispatched
+}
+
+// savedNetworks returns connected networks as "interface mac"
+func savedNetworks() []string {
+	var networks []string
+	for _, network := range state.getNetworks() {
+		networks = append(networks, fmt.Sprintf("%s %s", network.Interface, network.MacAddress))
+	}
+	return networks
+}
+
+// afterCalls runs action once property was read the given number of times
+func afterCalls(calls int, action func()) func() {
+	count := 0
+	return func() {
+		count++
+		if count == calls {
+			action()
+		}
+	}
+}
+
+func TestOnConnected(t *testing.T) {
+	tests := []struct {
+		name   string
+		device dbusapi.FakeDevice
+		// previously connected network
+		saved        *config.ConnectedGateway
+		setup        func(nm *dbusapi.FakeNetworkManager, routes *netlink_api.FakeRoutes)
+		wantEvents   []string
+		wantNetworks []string
+	}{
+		{
+			name:         "wifi with ipv4 gateway",
+			device:       homeWifi(),
+			wantEvents:   []string{"connected wlan0 " + homeMac},
+			wantNetworks: []string{"wlan0 " + homeMac},
+		},
+		{
+			name: "ipv6 only gateway",
+			device: func() dbusapi.FakeDevice {
+				device := homeWifi()
+				device.Ip4Gateway, device.Ip6Gateway = "", ipv6Gateway
+				return device
+			}(),
+			wantEvents:   []string{"connected wlan0 " + ipv6Mac},
+			wantNetworks: []string{"wlan0 " + ipv6Mac},
+		},
+		{
+			name: "device type without entities",
+			device: func() dbusapi.FakeDevice {
+				device := homeWifi()
+				device.Interface, device.DeviceType = "eth0", dbusapi.NM_DEVICE_TYPE_ETHERNET
+				return device
+			}(),
+		},
+		{
+			name: "device is not activated",
+			device: func() dbusapi.FakeDevice {
+				device := homeWifi()
+				device.State = dbusapi.NM_DEVICE_STATE_DISCONNECTED
+				return device
+			}(),
+		},
+		{
+			name: "no gateway",
+			device: func() dbusapi.FakeDevice {
+				device := homeWifi()
+				device.Ip4Gateway = ""
+				return device
+			}(),
+		},
+		{
+			name: "gateway assigned after a few attempts",
+			device: func() dbusapi.FakeDevice {
+				device := homeWifi()
+				device.Ip4Gateway = ""
+				return device
+			}(),
+			setup: func(nm *dbusapi.FakeNetworkManager, routes *netlink_api.FakeRoutes) {
+				assign := afterCalls(3, func() { nm.SetDevice(homeWifi()) })
+				nm.OnGet = func(path dbus.ObjectPath, property string) {
+					if property == "Ip4Config" {
+						assign()
+					}
+				}
+			},
+			wantEvents:   []string{"connected wlan0 " + homeMac},
+			wantNetworks: []string{"wlan0 " + homeMac},
+		},
+		{
+			name: "deactivated while waiting for gateway",
+			device: func() dbusapi.FakeDevice {
+				device := homeWifi()
+				device.Ip4Gateway = ""
+				return device
+			}(),
+			setup: func(nm *dbusapi.FakeNetworkManager, routes *netlink_api.FakeRoutes) {
+				device := homeWifi()
+				device.State = dbusapi.NM_DEVICE_STATE_DISCONNECTED
+				// gateway would be found if device were still queried after deactivation
+				deactivate := afterCalls(2, func() { nm.SetDevice(device) })
+				nm.OnGet = func(path dbus.ObjectPath, property string) {
+					if property == "State" {
+						deactivate()
+					}
+				}
+			},
+		},
+		{
+			name:   "gateway macaddress resolved after a few attempts",
+			device: homeWifi(),
+			setup: func(nm *dbusapi.FakeNetworkManager, routes *netlink_api.FakeRoutes) {
+				routes.SetNeighbour(homeGateway, "")
+				resolve := afterCalls(testAttempts, func() { routes.SetNeighbour(homeGateway, homeMac) })
+				routes.OnNeighbourLookup = func(string) { resolve() }
+			},
+			wantEvents:   []string{"connected wlan0 " + homeMac},
+			wantNetworks: []string{"wlan0 " + homeMac},
+		},
+		{
+			name:   "gateway macaddress never resolved",
+			device: homeWifi(),
+			setup: func(nm *dbusapi.FakeNetworkManager, routes *netlink_api.FakeRoutes) {
+				routes.SetNeighbour(homeGateway, "")
+			},
+		},
+		{
+			name:         "still connected to the same network",
+			device:       homeWifi(),
+			saved:        &config.ConnectedGateway{Interface: "wlan0", DevicePath: string(wifiPath), DeviceType: "wifi", Gateway: homeGateway, MacAddress: homeMac},
+			wantNetworks: []string{"wlan0 " + homeMac},
+		},
+		{
+			name:         "roamed without disconnect",
+			device:       homeWifi(),
+			saved:        &config.ConnectedGateway{Interface: "wlan0", DevicePath: string(wifiPath), DeviceType: "wifi", Gateway: "10.0.0.1", MacAddress: officeMac},
+			wantEvents:   []string{"disconnected wlan0 " + officeMac, "connected wlan0 " + homeMac},
+			wantNetworks: []string{"wlan0 " + homeMac},
+		},
+		{
+			name:   "another wifi network behind the same gateway",
+			device: homeWifi(),
+			saved: &config.ConnectedGateway{Interface: "wlan0", DevicePath: string(wifiPath), DeviceType: "wifi", Gateway: homeGateway, MacAddress: homeMac,
+				SSID: "Guest"},
+			wantEvents:   []string{"disconnected wlan0 " + homeMac, "connected wlan0 " + homeMac},
+			wantNetworks: []string{"wlan0 " + homeMac},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, nm, routes := newTestDispatcher(t)
+			nm.SetDevice(tt.device)
+			if tt.saved != nil {
+				state.setNetwork(*tt.saved)
+			}
+			if tt.setup != nil {
+				tt.setup(nm, routes)
+			}
+
+			d.onConnected(context.Background(), tt.device.Path)
+
+			if got := dispatchedEvents(); !slices.Equal(got, tt.wantEvents) {
+				t.Errorf("dispatched events = %q, want %q", got, tt.wantEvents)
+			}
+			if got := savedNetworks(); !slices.Equal(got, tt.wantNetworks) {
+				t.Errorf("saved networks = %q, want %q", got, tt.wantNetworks)
+			}
+		})
+	}
+}
+
+func TestOnConnectedResolvesNetworkDetails(t *testing.T) {
+	d, nm, _ := newTestDispatcher(t)
+	nm.SetDevice(homeWifi())
+
+	d.onConnected(context.Background(), wifiPath)
+
+	network := state.findNetwork("wlan0", "")
+	if network == nil {
+		t.Fatal("network is not saved")
+	}
+	want := config.ConnectedGateway{Interface: "wlan0", DevicePath: string(wifiPath), DeviceType: "wifi",
+		ConnectedAt: network.ConnectedAt, Gateway: homeGateway, MacAddress: homeMac, SSID: "Home", BSSID: "00:11:22:33:44:55",
+		ConnectionId: "Home", ConnectionUuid: "6f1b7e1c-8f1e-4c1a-9a57-1d7d3c4a9d01", ConnectionType: "802-11-wireless"}
+	if *network != want {
+		t.Errorf("network = %+v, want %+v", *network, want)
+	}
+}
+
+func TestOnDisconnected(t *testing.T) {
+	saved := config.ConnectedGateway{Interface: "wlan0", DevicePath: string(wifiPath), DeviceType: "wifi", Gateway: homeGateway, MacAddress: homeMac}
+	tests := []struct {
+		name  string
+		saved *config.ConnectedGateway
+		// device still known to NetworkManager
+		device       *dbusapi.FakeDevice
+		wantEvents   []string
+		wantNetworks []string
+	}{
+		{
+			name:       "connected network",
+			saved:      &saved,
+			device:     &dbusapi.FakeDevice{Path: wifiPath, Interface: "wlan0", DeviceType: dbusapi.NM_DEVICE_TYPE_WIFI, State: dbusapi.NM_DEVICE_STATE_DISCONNECTED},
+			wantEvents: []string{"disconnected wlan0 " + homeMac},
+		},
+		{
+			name:       "removed device is found by its path",
+			saved:      &saved,
+			wantEvents: []string{"disconnected wlan0 " + homeMac},
+		},
+		{
+			name:   "nothing was connected",
+			device: &dbusapi.FakeDevice{Path: wifiPath, Interface: "wlan0", DeviceType: dbusapi.NM_DEVICE_TYPE_WIFI, State: dbusapi.NM_DEVICE_STATE_DISCONNECTED},
+		},
+		{
+			name: "other device was connected",
+			saved: &config.ConnectedGateway{Interface: "wlan1", DevicePath: "/org/freedesktop/NetworkManager/Devices/4",
+				DeviceType: "wifi", Gateway: homeGateway, MacAddress: homeMac},
+			device:       &dbusapi.FakeDevice{Path: wifiPath, Interface: "wlan0", DeviceType: dbusapi.NM_DEVICE_TYPE_WIFI, State: dbusapi.NM_DEVICE_STATE_DISCONNECTED},
+			wantNetworks: []string{"wlan1 " + homeMac},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, nm, _ := newTestDispatcher(t)
+			if tt.saved != nil {
+				state.setNetwork(*tt.saved)
+			}
+			if tt.device != nil {
+				nm.SetDevice(*tt.device)
+			}
+
+			d.onDisconnected(wifiPath)
+
+			if got := dispatchedEvents(); !slices.Equal(got, tt.wantEvents) {
+				t.Errorf("dispatched events = %q, want %q", got, tt.wantEvents)
+			}
+			if got := savedNetworks(); !slices.Equal(got, tt.wantNetworks) {
+				t.Errorf("saved networks = %q, want %q", got, tt.wantNetworks)
+			}
+		})
+	}
+}
+
+func TestSaveNetworkStateOnStartup(t *testing.T) {
+	tests := []struct {
+		name         string
+		routes       []netlink_api.DefaultRoute
+		devices      []dbusapi.FakeDevice
+		neighbours   map[string]string
+		wantNetworks []string
+		wantSSID     string
+	}{
+		{
+			name:         "default route on wifi",
+			routes:       []netlink_api.DefaultRoute{{Interface: "wlan0", Gateway: homeGateway, Metric: 600}},
+			devices:      []dbusapi.FakeDevice{homeWifi()},
+			wantNetworks: []string{"wlan0 " + homeMac},
+			wantSSID:     "Home",
+		},
+		{
+			name: "the lowest metric route is used",
+			routes: []netlink_api.DefaultRoute{
+				{Interface: "eth0", Gateway: "10.0.0.1", Metric: 100},
+				{Interface: "wlan0", Gateway: homeGateway, Metric: 600}},
+			devices: []dbusapi.FakeDevice{homeWifi(), {Path: "/org/freedesktop/NetworkManager/Devices/2", Interface: "eth0",
+				DeviceType: dbusapi.NM_DEVICE_TYPE_ETHERNET, State: dbusapi.NM_DEVICE_STATE_ACTIVATED, Ip4Gateway: "10.0.0.1"}},
+			neighbours: map[string]string{"10.0.0.1": officeMac},
+		},
+		{
+			name: "no default route",
+		},
+		{
+			name:         "device unknown to NetworkManager",
+			routes:       []netlink_api.DefaultRoute{{Interface: "wlan0", Gateway: homeGateway, Metric: 600}},
+			wantNetworks: []string{"wlan0 " + homeMac},
+		},
+		{
+			name:       "gateway macaddress is not resolved",
+			routes:     []netlink_api.DefaultRoute{{Interface: "wlan0", Gateway: homeGateway, Metric: 600}},
+			devices:    []dbusapi.FakeDevice{homeWifi()},
+			neighbours: map[string]string{homeGateway: ""},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, nm, routes := newTestDispatcher(t)
+			for _, route := range tt.routes {
+				routes.AddRoute(route)
+			}
+			for _, device := range tt.devices {
+				nm.SetDevice(device)
+			}
+			for ip, macAddress := range tt.neighbours {
+				routes.SetNeighbour(ip, macAddress)
+			}
+
+			d.saveNetworkStateOnStartup()
+
+			if got := dispatchedEvents(); len(got) != 0 {
+				t.Errorf("dispatched events on startup = %q, want none", got)
+			}
+			if got := savedNetworks(); !slices.Equal(got, tt.wantNetworks) {
+				t.Errorf("saved networks = %q, want %q", got, tt.wantNetworks)
+			}
+			if network := state.findNetwork("wlan0", ""); network != nil && network.SSID != tt.wantSSID {
+				t.Errorf("ssid = %q, want %q", network.SSID, tt.wantSSID)
+			}
+		})
+	}
+}
+
+func TestReconcileNetworks(t *testing.T) {
+	tests := []struct {
+		name         string
+		saved        *config.ConnectedGateway
+		devices      []dbusapi.FakeDevice
+		wantEvents   []string
+		wantNetworks []string
+	}{
+		{
+			name:       "disconnected while NetworkManager was not available",
+			saved:      &config.ConnectedGateway{Interface: "wlan0", DevicePath: string(wifiPath), DeviceType: "wifi", Gateway: homeGateway, MacAddress: homeMac},
+			wantEvents: []string{"disconnected wlan0 " + homeMac},
+		},
+		{
+			name:         "connected while NetworkManager was not available",
+			devices:      []dbusapi.FakeDevice{homeWifi()},
+			wantEvents:   []string{"connected wlan0 " + homeMac},
+			wantNetworks: []string{"wlan0 " + homeMac},
+		},
+		{
+			name: "device path changed after NetworkManager restart",
+			saved: &config.ConnectedGateway{Interface: "wlan0", DevicePath: "/org/freedesktop/NetworkManager/Devices/1",
+				DeviceType: "wifi", Gateway: homeGateway, MacAddress: homeMac},
+			devices:      []dbusapi.FakeDevice{homeWifi()},
+			wantNetworks: []string{"wlan0 " + homeMac},
+		},
+		{
+			name:         "still connected to the same network",
+			saved:        &config.ConnectedGateway{Interface: "wlan0", DevicePath: string(wifiPath), DeviceType: "wifi", Gateway: homeGateway, MacAddress: homeMac, SSID: "Home"},
+			devices:      []dbusapi.FakeDevice{homeWifi()},
+			wantNetworks: []string{"wlan0 " + homeMac},
+		},
+		{
+			name: "connected to another network on the same interface",
+			saved: &config.ConnectedGateway{Interface: "wlan0", DevicePath: string(wifiPath), DeviceType: "wifi", Gateway: "10.0.0.1", MacAddress: officeMac,
+				SSID: "Office"},
+			devices:      []dbusapi.FakeDevice{homeWifi()},
+			wantEvents:   []string{"disconnected wlan0 " + officeMac, "connected wlan0 " + homeMac},
+			wantNetworks: []string{"wlan0 " + homeMac},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, nm, _ := newTestDispatcher(t)
+			if tt.saved != nil {
+				state.setNetwork(*tt.saved)
+			}
+			for _, device := range tt.devices {
+				nm.SetDevice(device)
+			}
+
+			d.reconcileNetworks()
+
+			// missed events are dispatched through the device queues
+			d.events.wait()
+			if got := dispatchedEvents(); !slices.Equal(got, tt.wantEvents) {
+				t.Errorf("dispatched events = %q, want %q", got, tt.wantEvents)
+			}
+			if got := savedNetworks(); !slices.Equal(got, tt.wantNetworks) {
+				t.Errorf("saved networks = %q, want %q", got, tt.wantNetworks)
+			}
+			if network := state.findNetwork("wlan0", ""); network != nil && network.DevicePath != string(wifiPath) {
+				t.Errorf("device path = %s, want %s", network.DevicePath, wifiPath)
+			}
+		})
+	}
+}
+
+func TestLinkEvents(t *testing.T) {
+	d, _, _ := newTestDispatcher(t)
+
+	d.onLinkConnected(context.Background(), "wlan0", homeGateway)
+	d.onLinkConnected(context.Background(), "eth0", "10.0.0.1")
+	d.onLinkDisconnected("wlan0")
+
+	want := []string{"connected wlan0 " + homeMac, "disconnected wlan0 " + homeMac}
+	if got := dispatchedEvents(); !slices.Equal(got, want) {
+		t.Errorf("dispatched events = %q, want %q", got, want)
+	}
+	if got := savedNetworks(); len(got) != 0 {
+		t.Errorf("saved networks = %q, want none", got)
+	}
+}
+
+func TestGetGatewayFromDbusWithRetries(t *testing.T) {
+	errNoConfig := errors.New("no config")
+	type attempt struct {
+		gateway string
+		err     error
+	}
+	tests := []struct {
+		name string
+		// results of the consecutive attempts. The last one repeats
+		attempts     []attempt
+		wantGateway  string
+		wantErr      bool
+		wantAttempts int
+	}{
+		{
+			name:         "gateway on the first attempt",
+			attempts:     []attempt{{gateway: homeGateway}},
+			wantGateway:  homeGateway,
+			wantAttempts: 1,
+		},
+		{
+			name:         "gateway after errors",
+			attempts:     []attempt{{err: errNoConfig}, {err: errNoConfig}, {gateway: homeGateway}},
+			wantGateway:  homeGateway,
+			wantAttempts: 3,
+		},
+		{
+			name:         "gateway after empty ones",
+			attempts:     []attempt{{}, {}, {}, {gateway: homeGateway}},
+			wantGateway:  homeGateway,
+			wantAttempts: 4,
+		},
+		{
+			name:         "device not activated stops retries",
+			attempts:     []attempt{{err: errNoConfig}, {err: ErrDeviceNotActivated}},
+			wantErr:      true,
+			wantAttempts: 2,
+		},
+		{
+			name:         "no gateway is not an error",
+			attempts:     []attempt{{}},
+			wantAttempts: testAttempts,
+		},
+		{
+			name:         "error on all attempts",
+			attempts:     []attempt{{err: errNoConfig}},
+			wantErr:      true,
+			wantAttempts: testAttempts,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _, _ := newTestDispatcher(t)
+			calls := 0
+			gateway, err := d.getGatewayFromDbusWithRetries(func() (string, error) {
+				result := tt.attempts[min(calls, len(tt.attempts)-1)]
+				calls++
+				return result.gateway, result.err
+			})
+			if gateway != tt.wantGateway || (err != nil) != tt.wantErr {
+				t.Errorf("got %q, %v, want %q, error %t", gateway, err, tt.wantGateway, tt.wantErr)
+			}
+			if calls != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", calls, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestGetGatewayMacAddress(t *testing.T) {
+	tests := []struct {
+		name string
+		// macaddress is resolved before the given lookup. Never resolved when 0
+		resolvedAt   int
+		wantMac      string
+		wantErr      bool
+		wantAttempts int
+	}{
+		{name: "resolved on the first attempt", resolvedAt: 1, wantMac: homeMac, wantAttempts: 1},
+		{name: "resolved on the last attempt", resolvedAt: testAttempts, wantMac: homeMac, wantAttempts: testAttempts},
+		{name: "never resolved", wantErr: true, wantAttempts: testAttempts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, _, routes := newTestDispatcher(t)
+			routes.SetNeighbour(homeGateway, "")
+			lookups := 0
+			routes.OnNeighbourLookup = func(ip string) {
+				lookups++
+				if lookups == tt.resolvedAt {
+					routes.SetNeighbour(ip, homeMac)
+				}
+			}
+			macAddress, err := d.getGatewayMacAddress(homeGateway)
+			if macAddress != tt.wantMac || (err != nil) != tt.wantErr {
+				t.Errorf("got %q, %v, want %q, error %t", macAddress, err, tt.wantMac, tt.wantErr)
+			}
+			if lookups != tt.wantAttempts {
+				t.Errorf("lookups = %d, want %d", lookups, tt.wantAttempts)
+			}
+		})
+	}
+}
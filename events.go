@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"network-dispatcher/config"
+	"network-dispatcher/logging"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Pending events of every device buffered while previous event is dispatched. The oldest one is dropped when it's full
+const deviceEventQueueSize = 16
+
+// Queue of NetworkManager connectivity changes, which don't belong to any device
+const connectivityQueueKey = "connectivity"
+
+// Network state change of the single device
+type deviceEvent struct {
+	// device queue the event belongs to
+	key   string
+	event string
+	// dispatches the event in the device queue worker. ctx is cancelled when the event is interrupted
+	dispatch func(ctx context.Context)
+	// closed once the event or the newer one which superseded it is dispatched, or it's dropped
+	done []chan struct{}
+}
+
+// Events of the single device waiting for dispatch
+type deviceQueue struct {
+	pending []deviceEvent
+	// worker dispatching pending events is running
+	running bool
+	// event the worker dispatches now and cancels its dispatch
+	current string
+	cancel  context.CancelCauseFunc
+}
+
+// Cause of the connect interrupted by the following disconnect of the same device
+var errInterruptedByDisconnect = errors.New("device disconnected")
+
+// eventQueue dispatches events of each device strictly one by one in the order they were received.
+//
+// Otherwise quick roam could run disconnect handler after the connect handler.
+// Events of different devices are still dispatched in parallel
+type eventQueue struct {
+	mu     sync.Mutex
+	queues map[string]*deviceQueue
+	// events queued but not dispatched yet
+	pending sync.WaitGroup
+	// dispatcher handling device events
+	d *networkDispatcher
+}
+
+func newEventQueue(d *networkDispatcher) *eventQueue {
+	return &eventQueue{queues: map[string]*deviceQueue{}, d: d}
+}
+
+// push queues connected or disconnected event of NetworkManager device
+func (q *eventQueue) push(devicePath dbus.ObjectPath, event string) {
+	dispatch := func(ctx context.Context) { q.d.onConnected(ctx, devicePath) }
+	if event == Disconnected {
+		dispatch = func(context.Context) { q.d.onDisconnected(devicePath) }
+	}
+	q.enqueue(deviceEvent{key: string(devicePath), event: event, dispatch: dispatch})
+}
+
+// pushConnectivity queues connectivity-* event. Connectivity events are ordered among themselves
+func (q *eventQueue) pushConnectivity(event string) {
+	q.enqueue(deviceEvent{key: connectivityQueueKey, event: event, dispatch: func(context.Context) { dispatchConnectivity(event) }})
+}
+
+// pushDisconnectedNetwork queues disconnect of the saved network which device might not exist anymore.
+// Returned channel is closed once disconnect scripts finished
+func (q *eventQueue) pushDisconnectedNetwork(network config.ConnectedGateway) <-chan struct{} {
+	key := network.DevicePath
+	if key == "" {
+		key = network.Interface
+	}
+	done := make(chan struct{})
+	q.enqueue(deviceEvent{key: key, event: Disconnected, done: []chan struct{}{done}, dispatch: func(context.Context) {
+		if gatewayEntity := state.removeNetwork(network.Interface, network.DevicePath); gatewayEntity != nil {
+			dispatchDisconnected(gatewayEntity)
+		}
+	}})
+	return done
+}
+
+// enqueue adds the event to the device queue. Never blocks, so hung scripts of one device don't stop signal processing.
+//
+// Pending events which don't matter anymore are dropped:
+// disconnect drops connects not dispatched yet, the event supersedes the same pending one right before it
+// and the oldest event is dropped when the queue is full.
+//
+// Disconnect also interrupts the event being dispatched, so a hung connect script doesn't hold the disconnect back.
+// Scripts of kill-previous entities are killed and the rest of the interrupted event entities don't run
+func (q *eventQueue) enqueue(event deviceEvent) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queue, ok := q.queues[event.key]
+	if !ok {
+		queue = &deviceQueue{}
+		q.queues[event.key] = queue
+	}
+	q.pending.Add(1)
+
+	if event.event == Disconnected && queue.cancel != nil && queue.current != Disconnected {
+		slog.Info("Interrupt event dispatch", logging.Event, queue.current, "queue", event.key, "reason", errInterruptedByDisconnect)
+		queue.cancel(errInterruptedByDisconnect)
+	}
+	if event.event == Disconnected {
+		kept := queue.pending[:0]
+		for _, pending := range queue.pending {
+			if pending.event == Connected {
+				q.drop(pending, "device disconnected before it was dispatched")
+				continue
+			}
+			kept = append(kept, pending)
+		}
+		queue.pending = kept
+	}
+	if last := len(queue.pending) - 1; last >= 0 && queue.pending[last].event == event.event {
+		slog.Debug("Pending event is superseded by the newer one", logging.Event, event.event, "queue", event.key)
+		event.done = append(event.done, queue.pending[last].done...)
+		q.pending.Done()
+		queue.pending = queue.pending[:last]
+	}
+	if len(queue.pending) >= deviceEventQueueSize {
+		q.drop(queue.pending[0], "queue is full")
+		queue.pending = queue.pending[1:]
+	}
+	queue.pending = append(queue.pending, event)
+
+	if !queue.running {
+		queue.running = true
+		go q.run(event.key, queue)
+	}
+}
+
+// drop removes pending event without dispatching it
+func (q *eventQueue) drop(event deviceEvent, reason string) {
+	slog.Warn("Drop pending event", logging.Event, event.event, "queue", event.key, "reason", reason)
+	q.finish(event)
+}
+
+func (q *eventQueue) finish(event deviceEvent) {
+	for _, done := range event.done {
+		close(done)
+	}
+	q.pending.Done()
+}
+
+// run dispatches pending events of the device until there are none left
+func (q *eventQueue) run(key string, queue *deviceQueue) {
+	for {
+		event, ok := q.next(key, queue)
+		if !ok {
+			return
+		}
+		if window := time.Duration(configStore.Current().CoalesceWindow); window > 0 {
+			time.Sleep(window)
+			event = q.coalesce(queue, event)
+		}
+		ctx := q.dispatching(queue, event)
+		event.dispatch(ctx)
+		q.finish(event)
+	}
+}
+
+// dispatching remembers the event dispatched by the worker and returns context it's interrupted with
+func (q *eventQueue) dispatching(queue *deviceQueue, event deviceEvent) context.Context {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	queue.current, queue.cancel = event.event, cancel
+	return ctx
+}
+
+// next pops the oldest pending event. Stops the worker when there are no events
+func (q *eventQueue) next(key string, queue *deviceQueue) (deviceEvent, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if queue.cancel != nil {
+		queue.cancel(nil)
+		queue.current, queue.cancel = "", nil
+	}
+	if len(queue.pending) == 0 {
+		queue.running = false
+		delete(q.queues, key)
+		return deviceEvent{}, false
+	}
+	event := queue.pending[0]
+	queue.pending = queue.pending[1:]
+	return event, true
+}
+
+// wait blocks until all queued events are dispatched, including events queued while waiting
+func (q *eventQueue) wait() {
+	q.pending.Wait()
+}
+
+// coalesce replaces the event with the last one of the device received within the window after it,
+// which is the net state of the device.
+//
+// So connected -> disconnected -> connected flap becomes just connected,
+// which does nothing when device is still connected to the same network
+func (q *eventQueue) coalesce(queue *deviceQueue, event deviceEvent) deviceEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, next := range queue.pending {
+		slog.Debug("Coalesce event with the following one", logging.Event, event.event, "queue", event.key, "next_event", next.event)
+		next.done = append(next.done, event.done...)
+		q.pending.Done()
+		event = next
+	}
+	queue.pending = nil
+	return event
+}
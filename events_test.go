@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"network-dispatcher/config"
+	dbusapi "network-dispatcher/dbus_api"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const ethernetPath = dbus.ObjectPath("/org/freedesktop/NetworkManager/Devices/2")
+
+// waitForFile polls until the file is created by the script
+func waitForFile(t *testing.T, path string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is not created", path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeHungScript writes script which creates started file and never exits
+func writeHungScript(t *testing.T, dir string) (string, string) {
+	started := filepath.Join(dir, "started")
+	hung := filepath.Join(dir, "hung.sh")
+	if err := os.WriteFile(hung, []byte(fmt.Sprintf("#!/bin/sh\necho $$ >> %s\nwhile true; do sleep 0.01; done\n", started)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return hung, started
+}
+
+// loadConfig replaces the current config with the given one
+func loadConfig(t *testing.T, dir string, conf string) {
+	configPath := filepath.Join(dir, ConfigFileName)
+	if err := os.WriteFile(configPath, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configStore = config.NewStore(configPath)
+	if err := configStore.Reload(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitDispatched waits until all queued events are dispatched
+func waitDispatched(t *testing.T, d *networkDispatcher) {
+	t.Helper()
+	dispatched := make(chan struct{})
+	go func() {
+		d.events.wait()
+		close(dispatched)
+	}()
+	select {
+	case <-dispatched:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("events are not dispatched. Dispatched events: %q", dispatchedEvents())
+	}
+}
+
+// assertNotRunning checks that no process of the script pids written into the file is alive
+func assertNotRunning(t *testing.T, pidsFile string) {
+	t.Helper()
+	content, err := os.ReadFile(pidsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pid := range strings.Fields(string(content)) {
+		if _, err := os.Stat("/proc/" + pid); err == nil {
+			t.Errorf("hung script pid %s is still running", pid)
+		}
+	}
+}
+
+// TestHungScriptDoesNotBlockSignals keeps wifi connect script hung while signals keep flowing
+func TestHungScriptDoesNotBlockSignals(t *testing.T) {
+	d, nm, routes := newTestDispatcher(t)
+	dir := t.TempDir()
+	hung, started := writeHungScript(t, dir)
+	hook := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	loadConfig(t, dir, fmt.Sprintf(`{"Entities": [
+		{"Script": %q, "Event": "connected"},
+		{"Script": %q, "Event": "connected", "DeviceTypes": ["ethernet"]},
+		{"Script": %q, "Event": "disconnected", "DeviceTypes": ["wifi", "ethernet"]}]}`, hung, hook, hook))
+	nm.SetDevice(homeWifi())
+	nm.SetDevice(dbusapi.FakeDevice{Path: ethernetPath, Interface: "eth0", DeviceType: dbusapi.NM_DEVICE_TYPE_ETHERNET,
+		State: dbusapi.NM_DEVICE_STATE_ACTIVATED, Ip4Gateway: "10.0.0.1"})
+	routes.SetNeighbour("10.0.0.1", officeMac)
+	routes.SetDeviceType("eth0", "ethernet")
+
+	d.events.push(wifiPath, Connected)
+	waitForFile(t, started)
+
+	flooded := make(chan struct{})
+	go func() {
+		defer close(flooded)
+		for i := 0; i < 10*deviceEventQueueSize; i++ {
+			d.events.push(wifiPath, Disconnected)
+			d.events.push(wifiPath, Connected)
+			d.events.pushConnectivity(ConnectivityEventPrefix + dbusapi.ConnectivityName(dbusapi.NM_CONNECTIVITY_FULL))
+		}
+		device := homeWifi()
+		device.State = dbusapi.NM_DEVICE_STATE_DISCONNECTED
+		nm.SetDevice(device)
+		d.events.push(wifiPath, Disconnected)
+		d.events.push(ethernetPath, Connected)
+	}()
+	select {
+	case <-flooded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("signals are blocked by the hung script")
+	}
+	// the last disconnect kills the hung script, nothing is released by hand
+	waitDispatched(t, d)
+
+	// every connect is interrupted by the following disconnect
+	var wifiEvents []string
+	for _, event := range dispatchedEvents() {
+		if strings.HasPrefix(event, Connected+" wlan0") || strings.HasPrefix(event, Disconnected+" wlan0") {
+			wifiEvents = append(wifiEvents, event)
+		}
+	}
+	for i, event := range wifiEvents {
+		want := "connected wlan0 " + homeMac
+		if i%2 == 1 {
+			want = "disconnected wlan0 " + homeMac
+		}
+		if event != want {
+			t.Fatalf("wifi events = %q, want connected and disconnected one after another", wifiEvents)
+		}
+	}
+	if len(wifiEvents) == 0 || len(wifiEvents)%2 != 0 {
+		t.Errorf("wifi events = %q, want disconnect after every connect", wifiEvents)
+	}
+	if !slices.Contains(dispatchedEvents(), "connected eth0 "+officeMac) {
+		t.Errorf("ethernet connect is not dispatched. Dispatched events: %q", dispatchedEvents())
+	}
+	if got := savedNetworks(); !slices.Equal(got, []string{"eth0 " + officeMac}) {
+		t.Errorf("saved networks = %q, want only eth0", got)
+	}
+	assertNotRunning(t, started)
+}
+
+// TestDisconnectInterruptsHungConnectScript runs disconnect scripts while connect script of the device never exits
+func TestDisconnectInterruptsHungConnectScript(t *testing.T) {
+	d, nm, _ := newTestDispatcher(t)
+	dir := t.TempDir()
+	hung, started := writeHungScript(t, dir)
+	hook := filepath.Join(dir, "hook.sh")
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	loadConfig(t, dir, fmt.Sprintf(`{"Entities": [
+		{"Script": %q, "Event": "connected", "ContinueOnFail": true},
+		{"Script": %q, "Event": "connected"},
+		{"Script": %q, "Event": "disconnected"}]}`, hung, hook, hook))
+	nm.SetDevice(homeWifi())
+
+	d.events.push(wifiPath, Connected)
+	waitForFile(t, started)
+	device := homeWifi()
+	device.State = dbusapi.NM_DEVICE_STATE_DISCONNECTED
+	nm.SetDevice(device)
+	d.events.push(wifiPath, Disconnected)
+	waitDispatched(t, d)
+
+	want := []string{"connected wlan0 " + homeMac, "disconnected wlan0 " + homeMac}
+	if got := dispatchedEvents(); !slices.Equal(got, want) {
+		t.Fatalf("dispatched events = %q, want %q", got, want)
+	}
+	connected := state.status().Events[0].Scripts
+	if len(connected) != 2 || !strings.Contains(connected[0].Err, "killed: device disconnected") ||
+		!connected[1].Skipped || !strings.Contains(connected[1].Err, "interrupted") {
+		t.Errorf("connect scripts = %+v, want hung one killed and the next one skipped", connected)
+	}
+	if disconnected := state.status().Events[1].Scripts; len(disconnected) != 1 || disconnected[0].Err != "" {
+		t.Errorf("disconnect scripts = %+v, want hook run", disconnected)
+	}
+	assertNotRunning(t, started)
+}
+
+func TestEnqueueDropsSupersededEvents(t *testing.T) {
+	d, _, _ := newTestDispatcher(t)
+	q := d.events
+	var dispatched []string
+	release := make(chan struct{})
+	event := func(name string) deviceEvent {
+		return deviceEvent{key: "wlan0", event: name, dispatch: func(context.Context) {
+			<-release
+			dispatched = append(dispatched, name)
+		}}
+	}
+
+	q.enqueue(event(Connected))
+	// the first event is taken by the worker and blocks it
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		q.mu.Lock()
+		taken := len(q.queues["wlan0"].pending) == 0
+		q.mu.Unlock()
+		if taken {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("worker didn't take the first event")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	q.enqueue(event(Disconnected))
+	q.enqueue(event(Connected))
+	q.enqueue(event(Connected))
+	q.enqueue(event(PrimaryChanged))
+	q.enqueue(event(Disconnected))
+	q.mu.Lock()
+	var pending []string
+	for _, event := range q.queues["wlan0"].pending {
+		pending = append(pending, event.event)
+	}
+	q.mu.Unlock()
+	close(release)
+	q.wait()
+
+	wantPending := []string{Disconnected, PrimaryChanged, Disconnected}
+	if !slices.Equal(pending, wantPending) {
+		t.Errorf("pending events = %q, want %q", pending, wantPending)
+	}
+	want := append([]string{Connected}, wantPending...)
+	if !slices.Equal(dispatched, want) {
+		t.Errorf("dispatched events = %q, want %q", dispatched, want)
+	}
+}
@@ -5,9 +5,9 @@ go 1.21
 require (
 	github.com/godbus/dbus/v5 v5.1.0
 	github.com/vishvananda/netlink v1.1.0
+	golang.org/x/crypto v0.24.0
+	golang.org/x/net v0.26.0
+	golang.org/x/sys v0.21.0
 )
 
-require (
-	github.com/vishvananda/netns v0.0.4 // indirect
-	golang.org/x/sys v0.21.0 // indirect
-)
+require github.com/vishvananda/netns v0.0.4 // indirect
@@ -0,0 +1,119 @@
+package main
+
+import (
+	dbusapi "network-dispatcher/dbus_api"
+	"network-dispatcher/dbus_api/nmtest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const ipv6WifiPath = dbus.ObjectPath("/org/freedesktop/NetworkManager/Devices/4")
+
+// waitForEvents waits until events are dispatched after the first from ones
+func waitForEvents(t *testing.T, from int, want []string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for len(dispatchedEvents()) < from+len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := dispatchedEvents()[from:]; !slices.Equal(got, want) {
+		t.Fatalf("dispatched events = %q, want %q", got, want)
+	}
+}
+
+// TestNetworkManagerSignals runs the real signals loop against fake NetworkManager on the private bus.
+// Steps share the loop and build on the network state left by the previous ones
+func TestNetworkManagerSignals(t *testing.T) {
+	bus := nmtest.StartBus(t)
+	nm := nmtest.Export(t, bus)
+	d, _, _ := newTestDispatcher(t)
+	d.nm = dbusapi.SystemBus{}
+
+	wifi := homeWifi()
+	wifi.State = dbusapi.NM_DEVICE_STATE_DISCONNECTED
+	nm.SetDevice(wifi)
+	ipv6Wifi := homeWifi()
+	ipv6Wifi.Path, ipv6Wifi.Interface = ipv6WifiPath, "wlan1"
+	ipv6Wifi.State = dbusapi.NM_DEVICE_STATE_DISCONNECTED
+	ipv6Wifi.Ip4Gateway, ipv6Wifi.Ip6Gateway = "", ipv6Gateway
+	nm.SetDevice(ipv6Wifi)
+
+	backend := &networkManagerBackend{d: d}
+	backend.start()
+	go backend.monitor()
+	// the loop subscribes asynchronously. Signals emitted before that are lost
+	deadline := time.Now().Add(10 * time.Second)
+	for nm.Gets(wifiPath, "Interface") == 0 && time.Now().Before(deadline) {
+		nm.EmitStateChanged(wifiPath, dbusapi.NM_DEVICE_STATE_DISCONNECTED, dbusapi.NM_DEVICE_STATE_DISCONNECTED)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Run("activated device is connected", func(t *testing.T) {
+		from := len(dispatchedEvents())
+		nm.SetState(wifiPath, dbusapi.NM_DEVICE_STATE_ACTIVATED)
+		waitForEvents(t, from, []string{"connected wlan0 " + homeMac})
+		if network := state.findNetwork("wlan0", ""); network == nil || network.SSID != "Home" || network.ConnectionId != "Home" {
+			t.Errorf("network = %+v, want Home wifi network", network)
+		}
+	})
+
+	t.Run("disconnected device runs disconnect scripts", func(t *testing.T) {
+		from := len(dispatchedEvents())
+		nm.SetState(wifiPath, dbusapi.NM_DEVICE_STATE_DISCONNECTED)
+		waitForEvents(t, from, []string{"disconnected wlan0 " + homeMac})
+	})
+
+	t.Run("device without IPv4 config uses IPv6 gateway", func(t *testing.T) {
+		from := len(dispatchedEvents())
+		nm.SetState(ipv6WifiPath, dbusapi.NM_DEVICE_STATE_ACTIVATED)
+		waitForEvents(t, from, []string{"connected wlan1 " + ipv6Mac})
+		nm.SetState(ipv6WifiPath, dbusapi.NM_DEVICE_STATE_DISCONNECTED)
+		waitForEvents(t, from, []string{"connected wlan1 " + ipv6Mac, "disconnected wlan1 " + ipv6Mac})
+	})
+
+	t.Run("stale activated signal of deactivated device is ignored", func(t *testing.T) {
+		from := len(dispatchedEvents())
+		stateGets, ip4ConfigGets := nm.Gets(wifiPath, "State"), nm.Gets(wifiPath, "Ip4Config")
+		nm.EmitStateChanged(wifiPath, dbusapi.NM_DEVICE_STATE_ACTIVATED, dbusapi.NM_DEVICE_STATE_DISCONNECTED)
+		deadline := time.Now().Add(10 * time.Second)
+		for nm.Gets(wifiPath, "State") == stateGets && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(200 * time.Millisecond)
+		if got := nm.Gets(wifiPath, "Ip4Config"); got != ip4ConfigGets {
+			t.Errorf("Ip4Config was read %d times after device state, want no reads", got-ip4ConfigGets)
+		}
+		if got := dispatchedEvents()[from:]; len(got) != 0 {
+			t.Errorf("dispatched events = %q, want none", got)
+		}
+	})
+
+	t.Run("connectivity change runs for connected network", func(t *testing.T) {
+		from := len(dispatchedEvents())
+		nm.SetState(wifiPath, dbusapi.NM_DEVICE_STATE_ACTIVATED)
+		waitForEvents(t, from, []string{"connected wlan0 " + homeMac})
+		nm.SetConnectivity(dbusapi.NM_CONNECTIVITY_FULL)
+		waitForEvents(t, from, []string{"connected wlan0 " + homeMac, "connectivity-full wlan0 " + homeMac})
+	})
+
+	t.Run("NetworkManager restart resyncs missed disconnect", func(t *testing.T) {
+		from := len(dispatchedEvents())
+		nm.Stop()
+		wifi.State = dbusapi.NM_DEVICE_STATE_DISCONNECTED
+		nm.SetDevice(wifi)
+		nm.Start()
+		waitForEvents(t, from, []string{"disconnected wlan0 " + homeMac})
+	})
+
+	t.Run("bus restart resyncs missed connect", func(t *testing.T) {
+		from := len(dispatchedEvents())
+		bus.Restart()
+		wifi.State = dbusapi.NM_DEVICE_STATE_ACTIVATED
+		nm.SetDevice(wifi)
+		nm.Reconnect(bus)
+		waitForEvents(t, from, []string{"connected wlan0 " + homeMac})
+	})
+}
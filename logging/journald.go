@@ -0,0 +1,185 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// JournalSocket is the socket journald receives entries on in its native protocol
+const JournalSocket = "/run/systemd/journal/socket"
+
+// SyslogIdentifier is attached to every journal entry, so `journalctl -t network-dispatcher` shows them
+const SyslogIdentifier = "network-dispatcher"
+
+// JournalFieldPrefix is prepended to record keys to get journal field names, e.g. NETWORK_DISPATCHER_SCRIPT
+const JournalFieldPrefix = "NETWORK_DISPATCHER_"
+
+// journalFields are record keys stored under journal fields of their own instead of the prefixed name
+var journalFields = map[string]string{
+	Mac:        "GATEWAY_MAC",
+	Invocation: "INVOCATION_ID",
+}
+
+// NewInvocationID returns random 128 bit id in the systemd format. It's used to group records of a single script run
+func NewInvocationID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// JournalHandler sends records straight to journald with record fields as journal fields,
+// so entries could be filtered with e.g. `journalctl NETWORK_DISPATCHER_SCRIPT=share_mount.sh`
+type JournalHandler struct {
+	conn    *net.UnixConn
+	journal *net.UnixAddr
+	level   slog.Leveler
+	// prefix of keys of the group opened with WithGroup
+	prefix string
+	// fields added with WithAttrs in the native protocol format
+	fields []byte
+}
+
+// NewJournalHandler connects to journald listening on socketPath, usually JournalSocket
+func NewJournalHandler(socketPath string, level slog.Leveler) (*JournalHandler, error) {
+	if _, err := os.Stat(socketPath); err != nil {
+		return nil, fmt.Errorf("journald is not available: %v", err)
+	}
+	// not connected socket, because descriptors of the large entries are sent with the address
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create journald socket: %v", err)
+	}
+	return &JournalHandler{conn: conn, journal: &net.UnixAddr{Name: socketPath, Net: "unixgram"}, level: level}, nil
+}
+
+func (h *JournalHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *JournalHandler) Handle(_ context.Context, r slog.Record) error {
+	var entry bytes.Buffer
+	appendJournalField(&entry, "MESSAGE", r.Message)
+	appendJournalField(&entry, "PRIORITY", strconv.Itoa(journalPriority(r.Level)))
+	appendJournalField(&entry, "SYSLOG_IDENTIFIER", SyslogIdentifier)
+	if r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		appendJournalField(&entry, "CODE_FILE", frame.File)
+		appendJournalField(&entry, "CODE_LINE", strconv.Itoa(frame.Line))
+		appendJournalField(&entry, "CODE_FUNC", frame.Function)
+	}
+	entry.Write(h.fields)
+	r.Attrs(func(attr slog.Attr) bool {
+		appendJournalAttr(&entry, h.prefix, attr)
+		return true
+	})
+	return h.send(entry.Bytes())
+}
+
+func (h *JournalHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	fields := bytes.NewBuffer(bytes.Clone(h.fields))
+	for _, attr := range attrs {
+		appendJournalAttr(fields, h.prefix, attr)
+	}
+	return &JournalHandler{conn: h.conn, journal: h.journal, level: h.level, prefix: h.prefix, fields: fields.Bytes()}
+}
+
+func (h *JournalHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	return &JournalHandler{conn: h.conn, journal: h.journal, level: h.level, prefix: h.prefix + name + "_", fields: h.fields}
+}
+
+// send writes the entry as a single datagram. Entries exceeding the datagram size limit, e.g. long script output,
+// are written into the unlinked temporary file whose descriptor is passed to journald instead
+func (h *JournalHandler) send(entry []byte) error {
+	_, err := h.conn.WriteToUnix(entry, h.journal)
+	if err == nil || !(errors.Is(err, syscall.EMSGSIZE) || errors.Is(err, syscall.ENOBUFS)) {
+		return err
+	}
+	file, err := os.CreateTemp("/dev/shm", "network-dispatcher-journal-")
+	if err != nil {
+		return fmt.Errorf("failed to create journal entry file: %v", err)
+	}
+	defer file.Close()
+	os.Remove(file.Name())
+	if _, err := file.Write(entry); err != nil {
+		return fmt.Errorf("failed to write journal entry file: %v", err)
+	}
+	_, _, err = h.conn.WriteMsgUnix(nil, syscall.UnixRights(int(file.Fd())), h.journal)
+	return err
+}
+
+func appendJournalAttr(entry *bytes.Buffer, prefix string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		if attr.Key != "" {
+			prefix += attr.Key + "_"
+		}
+		for _, groupAttr := range attr.Value.Group() {
+			appendJournalAttr(entry, prefix, groupAttr)
+		}
+		return
+	}
+	appendJournalField(entry, journalFieldName(prefix+attr.Key), attr.Value.String())
+}
+
+// journalFieldName converts record key to the journal field name. Journal accepts only uppercase letters, digits and underscores
+func journalFieldName(key string) string {
+	if name, ok := journalFields[key]; ok {
+		return name
+	}
+	return JournalFieldPrefix + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, key)
+}
+
+// appendJournalField appends the field in the native protocol format.
+// Values with newlines are written as binary data prefixed with their little endian 64 bit length
+func appendJournalField(entry *bytes.Buffer, name string, value string) {
+	entry.WriteString(name)
+	if strings.Contains(value, "\n") {
+		entry.WriteByte('\n')
+		binary.Write(entry, binary.LittleEndian, uint64(len(value)))
+	} else {
+		entry.WriteByte('=')
+	}
+	entry.WriteString(value)
+	entry.WriteByte('\n')
+}
+
+// journalPriority maps record level to the syslog priority
+func journalPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
@@ -0,0 +1,134 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// fakeJournal listens on the unix datagram socket the same way journald does
+type fakeJournal struct {
+	t    *testing.T
+	conn *net.UnixConn
+	path string
+}
+
+func newFakeJournal(t *testing.T) *fakeJournal {
+	path := filepath.Join(t.TempDir(), "journal.socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &fakeJournal{t: t, conn: conn, path: path}
+}
+
+// read receives the next entry. Entries passed as file descriptors are read from the file
+func (j *fakeJournal) read() map[string]string {
+	data := make([]byte, 1<<16)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := j.conn.ReadMsgUnix(data, oob)
+	if err != nil {
+		j.t.Fatal(err)
+	}
+	data = data[:n]
+	if oobn > 0 {
+		messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			j.t.Fatal(err)
+		}
+		fds, err := syscall.ParseUnixRights(&messages[0])
+		if err != nil {
+			j.t.Fatal(err)
+		}
+		file := os.NewFile(uintptr(fds[0]), "entry")
+		defer file.Close()
+		// journald reads the whole file regardless of its offset
+		if data, err = io.ReadAll(io.NewSectionReader(file, 0, 1<<30)); err != nil {
+			j.t.Fatal(err)
+		}
+	}
+	return parseJournalEntry(j.t, data)
+}
+
+// parseJournalEntry parses the native protocol entry
+func parseJournalEntry(t *testing.T, data []byte) map[string]string {
+	fields := map[string]string{}
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF {
+			return fields
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		name, value, ok := strings.Cut(strings.TrimSuffix(line, "\n"), "=")
+		if !ok {
+			var size uint64
+			if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+				t.Fatal(err)
+			}
+			binaryValue := make([]byte, size+1)
+			if _, err := io.ReadFull(r, binaryValue); err != nil {
+				t.Fatal(err)
+			}
+			value = string(binaryValue[:size])
+		}
+		if _, ok := fields[name]; ok {
+			t.Errorf("field %s is sent twice", name)
+		}
+		fields[name] = value
+	}
+}
+
+func TestJournalHandler(t *testing.T) {
+	journal := newFakeJournal(t)
+	handler, err := NewJournalHandler(journal.path, slog.LevelInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := slog.New(handler).With(Event, "connected", Mac, "cc:ce:cc:ce:ce:cc", Script, "share_mount.sh", Invocation, "42")
+
+	logger.Warn("mount error(2): No such file or directory", Stream, StreamStderr, slog.Group("retry", "attempt", 2))
+	want := map[string]string{
+		"MESSAGE":                          "mount error(2): No such file or directory",
+		"PRIORITY":                         "4",
+		"SYSLOG_IDENTIFIER":                SyslogIdentifier,
+		"NETWORK_DISPATCHER_EVENT":         "connected",
+		"NETWORK_DISPATCHER_SCRIPT":        "share_mount.sh",
+		"NETWORK_DISPATCHER_STREAM":        StreamStderr,
+		"NETWORK_DISPATCHER_RETRY_ATTEMPT": "2",
+		"GATEWAY_MAC":                      "cc:ce:cc:ce:ce:cc",
+		"INVOCATION_ID":                    "42",
+	}
+	got := journal.read()
+	for name, value := range want {
+		if got[name] != value {
+			t.Errorf("%s = %q, want %q", name, got[name], value)
+		}
+	}
+	if got["CODE_FUNC"] != "network-dispatcher/logging.TestJournalHandler" {
+		t.Errorf("CODE_FUNC = %q, want the test function", got["CODE_FUNC"])
+	}
+
+	logger.Debug("not sent")
+	logger.Info("first line\nsecond line", Stream, StreamStdout)
+	if got := journal.read(); got["MESSAGE"] != "first line\nsecond line" || got["PRIORITY"] != "6" {
+		t.Errorf("MESSAGE = %q, PRIORITY = %q, want multiline message at info priority", got["MESSAGE"], got["PRIORITY"])
+	}
+
+	// exceeds the datagram size limit, so it's passed as file
+	long := strings.Repeat("x", 1<<20)
+	logger.Error(long)
+	if got := journal.read(); got["MESSAGE"] != long || got["PRIORITY"] != "3" {
+		t.Errorf("long MESSAGE of %d bytes at %q priority, want %d bytes at error priority", len(got["MESSAGE"]), got["PRIORITY"], len(long))
+	}
+}
@@ -0,0 +1,90 @@
+// Package logging configures log/slog for the daemon and defines fields shared by records of all packages
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Record fields. Records about networks, entities and scripts always use these keys, so logs could be filtered by them
+const (
+	Interface = "interface"
+	Event     = "event"
+	Gateway   = "gateway"
+	Mac       = "mac"
+	// NetworkManager device type name, e.g. wifi
+	DeviceType = "device_type"
+	SSID       = "ssid"
+	BSSID      = "bssid"
+	// NetworkManager connection profile name
+	Connection = "connection"
+	// Index of the entity in the config
+	Entity   = "entity"
+	Script   = "script"
+	Pid      = "pid"
+	Duration = "duration"
+	// Script output stream, StreamStdout or StreamStderr
+	Stream = "stream"
+	// Id of the single script run shared by all its records. See NewInvocationID
+	Invocation = "invocation_id"
+	Error      = "error"
+)
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// Output formats selected with --log-format
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+	// Records are sent to JournalSocket instead of stderr. See JournalHandler
+	FormatJournald = "journald"
+)
+
+var Formats = []string{FormatText, FormatJSON, FormatJournald}
+
+// ParseLevel parses level name: debug, info, warn or error
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return level, fmt.Errorf("unsupported log level %q. Supported levels: debug, info, warn, error", name)
+	}
+	return level, nil
+}
+
+// NewHandler returns handler writing records of the level and above to w in the format
+func NewHandler(w io.Writer, level slog.Level, format string) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case FormatText:
+		return slog.NewTextHandler(w, opts), nil
+	case FormatJSON:
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unsupported log format %q. Supported formats: %s", format, strings.Join(Formats, ", "))
+}
+
+// Setup writes records to stderr, or to journald with FormatJournald, and makes it the default logger.
+// The standard log package is redirected there as well at info level
+func Setup(levelName string, format string) error {
+	level, err := ParseLevel(levelName)
+	if err != nil {
+		return err
+	}
+	var handler slog.Handler
+	if format == FormatJournald {
+		handler, err = NewJournalHandler(JournalSocket, level)
+	} else {
+		handler, err = NewHandler(os.Stderr, level, format)
+	}
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
@@ -0,0 +1,285 @@
+package mount
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"network-dispatcher/logging"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Result statuses
+const (
+	StatusMounted        = "mounted"
+	StatusAlreadyMounted = "already-mounted"
+	StatusUnmounted      = "unmounted"
+	StatusNotMounted     = "not-mounted"
+	StatusFailed         = "failed"
+)
+
+const unmountPollInterval = 100 * time.Millisecond
+
+// Share is fstab entry mounted and unmounted by the daemon.
+// fstab entry must have noauto and user or users options to be mounted without root
+type Share struct {
+	// fstab source, e.g. //192.168.1.1/Storage. Used to find Target in fstab when it's empty
+	Source string
+	// Mount directory
+	Target string
+	// Symlink pointed to the Target after mount. Not managed when empty
+	Link string
+	// Number of mount attempts
+	Attempts int
+	// Delay after the first failed attempt. Doubled after each next one up to MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// mount command is killed when single attempt runs longer. Not limited when zero
+	AttemptTimeout time.Duration
+	// Time given to lazy unmount to detach the share
+	UnmountTimeout time.Duration
+
+	// Allows to use other files in tests
+	MountInfoPath string
+	FstabPath     string
+}
+
+// Result of the mount or unmount
+type Result struct {
+	Status   string
+	Source   string
+	Target   string
+	FSType   string `json:",omitempty"`
+	Link     string `json:",omitempty"`
+	Attempts int    `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+func (r *Result) String() string {
+	out := fmt.Sprintf("%s %s on %s", r.Status, r.Source, r.Target)
+	if r.FSType != "" {
+		out += " type " + r.FSType
+	}
+	if r.Attempts > 1 {
+		out += fmt.Sprintf(" after %d attempts", r.Attempts)
+	}
+	if r.Link != "" {
+		out += ", link " + r.Link
+	}
+	return out
+}
+
+// Mount mounts the share unless it's already mounted and points Link to it.
+// Retries failed mount with backoff until attempts are exhausted or ctx is done
+func (s *Share) Mount(ctx context.Context) (*Result, error) {
+	result, err := s.resolve()
+	if err != nil {
+		return result, err
+	}
+	mounted, err := s.findMount(result.Target)
+	if err != nil {
+		return s.fail(result, err)
+	}
+	if mounted != nil {
+		result.Status = StatusAlreadyMounted
+		result.FSType = mounted.FSType
+		return s.link(result)
+	}
+
+	delay := s.RetryDelay
+	for {
+		result.Attempts++
+		err = s.runAttempt(ctx, result.Target)
+		// mount helpers might return error even when share got mounted
+		if mounted, findErr := s.findMount(result.Target); findErr == nil && mounted != nil {
+			result.Status = StatusMounted
+			result.FSType = mounted.FSType
+			return s.link(result)
+		}
+		if err == nil {
+			err = errors.New("mount succeeded but share is absent in mountinfo")
+		}
+		if ctx.Err() != nil {
+			return s.fail(result, fmt.Errorf("mount stopped after %d attempts: %w", result.Attempts, context.Cause(ctx)))
+		}
+		if result.Attempts >= s.Attempts {
+			return s.fail(result, fmt.Errorf("failed to mount in %d attempts: %w", result.Attempts, err))
+		}
+		slog.Warn("Mount attempt failed", "attempt", result.Attempts, "target", result.Target, "retry_in", delay, logging.Error, err)
+		select {
+		case <-ctx.Done():
+			return s.fail(result, fmt.Errorf("mount stopped after %d attempts: %w", result.Attempts, context.Cause(ctx)))
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, s.MaxRetryDelay)
+	}
+}
+
+// runAttempt runs mount command which is killed after AttemptTimeout
+func (s *Share) runAttempt(ctx context.Context, target string) error {
+	if s.AttemptTimeout <= 0 {
+		return runCommand(ctx, "mount", target)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, s.AttemptTimeout)
+	defer cancel()
+	err := runCommand(attemptCtx, "mount", target)
+	if err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("mount did not finish in %s", s.AttemptTimeout)
+	}
+	return err
+}
+
+// Unmount detaches the share lazily, so it never hangs on unreachable server.
+//
+// umount itself is killed when share is gone but umount process still hangs
+func (s *Share) Unmount() (*Result, error) {
+	result, err := s.resolve()
+	if err != nil {
+		return result, err
+	}
+	// link is kept to not break paths of the share, it's repointed on the next mount
+	result.Link = ""
+	mounted, err := s.findMount(result.Target)
+	if err != nil {
+		return s.fail(result, err)
+	}
+	if mounted == nil {
+		result.Status = StatusNotMounted
+		return result, nil
+	}
+	result.FSType = mounted.FSType
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.UnmountTimeout)
+	defer cancel()
+	umountErr := make(chan error, 1)
+	go func() { umountErr <- runCommand(ctx, "umount", "-l", result.Target) }()
+
+	ticker := time.NewTicker(unmountPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-umountErr:
+			if mounted, findErr := s.findMount(result.Target); findErr == nil && mounted == nil {
+				result.Status = StatusUnmounted
+				return result, nil
+			}
+			if err == nil {
+				err = errors.New("umount succeeded but share is still in mountinfo")
+			}
+			return s.fail(result, err)
+		case <-ticker.C:
+			if mounted, err := s.findMount(result.Target); err == nil && mounted == nil {
+				// deferred cancel kills umount if it still hangs
+				result.Status = StatusUnmounted
+				return result, nil
+			}
+		case <-ctx.Done():
+			return s.fail(result, fmt.Errorf("share is still mounted after %s", s.UnmountTimeout))
+		}
+	}
+}
+
+// resolve finds mount directory of the share in fstab
+func (s *Share) resolve() (*Result, error) {
+	result := &Result{Source: s.Source, Target: s.Target, Link: s.Link}
+	if result.Target != "" {
+		return result, nil
+	}
+	entries, err := readFstab(s.fstabPath())
+	if err != nil {
+		return s.fail(result, err)
+	}
+	for _, entry := range entries {
+		if entry.Source == s.Source {
+			result.Target = entry.Target
+			return result, nil
+		}
+	}
+	return s.fail(result, fmt.Errorf("%s is absent in %s", s.Source, s.fstabPath()))
+}
+
+// findMount returns the top most mount on the target or nil when nothing is mounted there
+func (s *Share) findMount(target string) (*MountInfo, error) {
+	mounts, err := readMountInfo(s.mountInfoPath())
+	if err != nil {
+		return nil, err
+	}
+	target = filepath.Clean(target)
+	var found *MountInfo
+	for i := range mounts {
+		if mounts[i].MountPoint == target {
+			found = &mounts[i]
+		}
+	}
+	return found, nil
+}
+
+// link points Link symlink to the mounted share. Never replaces regular files or directories
+func (s *Share) link(result *Result) (*Result, error) {
+	if s.Link == "" {
+		return result, nil
+	}
+	info, err := os.Lstat(s.Link)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return s.fail(result, err)
+	case info.Mode()&os.ModeSymlink == 0:
+		return s.fail(result, fmt.Errorf("%s is regular file or directory. Provide another link path", s.Link))
+	default:
+		if current, err := os.Readlink(s.Link); err == nil && current == result.Target {
+			return result, nil
+		}
+	}
+	// replace the link atomically, so it never points nowhere
+	tmpLink := s.Link + ".tmp"
+	os.Remove(tmpLink)
+	if err := os.Symlink(result.Target, tmpLink); err != nil {
+		return s.fail(result, err)
+	}
+	if err := os.Rename(tmpLink, s.Link); err != nil {
+		os.Remove(tmpLink)
+		return s.fail(result, err)
+	}
+	return result, nil
+}
+
+func (s *Share) fail(result *Result, err error) (*Result, error) {
+	result.Status = StatusFailed
+	result.Error = err.Error()
+	return result, err
+}
+
+func (s *Share) mountInfoPath() string {
+	if s.MountInfoPath != "" {
+		return s.MountInfoPath
+	}
+	return MountInfoPath
+}
+
+func (s *Share) fstabPath() string {
+	if s.FstabPath != "" {
+		return s.FstabPath
+	}
+	return FstabPath
+}
+
+// runCommand returns command error with its output
+func runCommand(ctx context.Context, name string, args ...string) error {
+	var output bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		if out := strings.TrimSpace(output.String()); out != "" {
+			return fmt.Errorf("%s: %v: %s", name, err, out)
+		}
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
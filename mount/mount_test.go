@@ -0,0 +1,182 @@
+package mount
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []MountInfo
+		wantErr bool
+	}{
+		{name: "optional fields",
+			content: "36 35 98:0 /mnt1 /mnt/parent rw,noatime master:1 shared:2 - ext3 /dev/root rw,errors=continue\n",
+			want: []MountInfo{{ID: 36, ParentID: 35, Device: "98:0", Root: "/mnt1", MountPoint: "/mnt/parent", Options: "rw,noatime",
+				FSType: "ext3", Source: "/dev/root", SuperOptions: "rw,errors=continue"}}},
+		{name: "escaped spaces",
+			content: `120 25 0:52 / /mnt/My\040Storage rw,relatime - cifs //192.168.1.1/My\040Storage rw,vers=3.1.1` + "\n\n",
+			want: []MountInfo{{ID: 120, ParentID: 25, Device: "0:52", Root: "/", MountPoint: "/mnt/My Storage", Options: "rw,relatime",
+				FSType: "cifs", Source: "//192.168.1.1/My Storage", SuperOptions: "rw,vers=3.1.1"}}},
+		{name: "no super options",
+			content: "22 1 0:21 / /proc rw - proc proc",
+			want:    []MountInfo{{ID: 22, ParentID: 1, Device: "0:21", Root: "/", MountPoint: "/proc", Options: "rw", FSType: "proc", Source: "proc"}}},
+		{name: "no separator", content: "22 1 0:21 / /proc rw proc proc rw\n", wantErr: true},
+		{name: "missing mount fields", content: "22 1 0:21 / /proc - proc proc rw\n", wantErr: true},
+		{name: "missing source", content: "22 1 0:21 / /proc rw - proc\n", wantErr: true},
+		{name: "invalid id", content: "x 1 0:21 / /proc rw - proc proc rw\n", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseMountInfo(strings.NewReader(test.content))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseMountInfo() error = %v, want error %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseMountInfo() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseFstab(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []FstabEntry
+		wantErr bool
+	}{
+		{name: "comments and empty lines",
+			content: "# <file system> <mount point> <type> <options> <dump> <pass>\n\n  # indented comment\nUUID=1234 / ext4 defaults 0 1\n",
+			want:    []FstabEntry{{Source: "UUID=1234", Target: "/", FSType: "ext4", Options: "defaults"}}},
+		{name: "escaped spaces",
+			content: `//192.168.1.1/My\040Storage	/mnt/My\040Storage	cifs	noauto,user	0 0`,
+			want:    []FstabEntry{{Source: "//192.168.1.1/My Storage", Target: "/mnt/My Storage", FSType: "cifs", Options: "noauto,user"}}},
+		{name: "no options",
+			content: "proc /proc proc\n",
+			want:    []FstabEntry{{Source: "proc", Target: "/proc", FSType: "proc"}}},
+		{name: "backslash which is not escape",
+			content: `C:\share /mnt/share vfat`,
+			want:    []FstabEntry{{Source: `C:\share`, Target: "/mnt/share", FSType: "vfat"}}},
+		{name: "missing type", content: "//server/share /mnt/share\n", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseFstab(strings.NewReader(test.content))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("ParseFstab() error = %v, want error %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseFstab() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+// testShare returns share which reads mountinfo and fstab fixtures from the temporary directory
+func testShare(t *testing.T, mountInfo string) *Share {
+	dir := t.TempDir()
+	share := &Share{Source: "//192.168.1.1/My Storage", Link: filepath.Join(dir, "storage"), Attempts: 1,
+		MountInfoPath: filepath.Join(dir, "mountinfo"), FstabPath: filepath.Join(dir, "fstab")}
+	fstab := `//192.168.1.1/My\040Storage /mnt/My\040Storage cifs noauto,user 0 0` + "\n"
+	if err := os.WriteFile(share.FstabPath, []byte(fstab), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(share.MountInfoPath, []byte(mountInfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return share
+}
+
+const mountedStorage = "22 1 0:21 / /proc rw - proc proc rw\n" +
+	`120 25 0:52 / /mnt/My\040Storage rw,relatime - cifs //192.168.1.1/My\040Storage rw` + "\n"
+
+func TestMountAlreadyMounted(t *testing.T) {
+	share := testShare(t, mountedStorage)
+	result, err := share.Mount(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Result{Status: StatusAlreadyMounted, Source: share.Source, Target: "/mnt/My Storage", FSType: "cifs", Link: share.Link}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("Mount() = %+v, want %+v", result, want)
+	}
+	if target, err := os.Readlink(share.Link); err != nil || target != "/mnt/My Storage" {
+		t.Errorf("link points to %q, %v, want the mount directory", target, err)
+	}
+}
+
+func TestMountRefusesToReplaceDirectory(t *testing.T) {
+	share := testShare(t, mountedStorage)
+	if err := os.Mkdir(share.Link, 0755); err != nil {
+		t.Fatal(err)
+	}
+	result, err := share.Mount(context.Background())
+	if err == nil || result.Status != StatusFailed {
+		t.Errorf("Mount() = %+v, %v, want failure", result, err)
+	}
+}
+
+func TestUnmountNotMounted(t *testing.T) {
+	share := testShare(t, "22 1 0:21 / /proc rw - proc proc rw\n")
+	result, err := share.Unmount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Result{Status: StatusNotMounted, Source: share.Source, Target: "/mnt/My Storage"}
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("Unmount() = %+v, want %+v", result, want)
+	}
+}
+
+func TestResolveAbsentInFstab(t *testing.T) {
+	share := testShare(t, mountedStorage)
+	share.Source = "//192.168.1.1/Other"
+	if result, err := share.Unmount(); err == nil || result.Status != StatusFailed {
+		t.Errorf("Unmount() = %+v, %v, want failure", result, err)
+	}
+}
+
+// hangingMount puts mount command which never exits first in PATH
+func hangingMount(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "mount"), []byte("#!/bin/sh\nexec sleep 60\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+}
+
+func TestMountKillsHungAttempt(t *testing.T) {
+	hangingMount(t)
+	share := testShare(t, "22 1 0:21 / /proc rw - proc proc rw\n")
+	share.Attempts = 2
+	share.AttemptTimeout = 100 * time.Millisecond
+	share.RetryDelay = 10 * time.Millisecond
+	started := time.Now()
+	result, err := share.Mount(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "failed to mount in 2 attempts: mount did not finish in 100ms") {
+		t.Errorf("Mount() = %+v, %v, want attempts timed out", result, err)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Errorf("Mount() took %s, want hung attempts killed", elapsed)
+	}
+}
+
+func TestMountStopsOnContextDone(t *testing.T) {
+	hangingMount(t)
+	share := testShare(t, "22 1 0:21 / /proc rw - proc proc rw\n")
+	ctx, cancel := context.WithTimeoutCause(context.Background(), 100*time.Millisecond, errors.New("device disconnected"))
+	defer cancel()
+	result, err := share.Mount(ctx)
+	if err == nil || !strings.Contains(err.Error(), "mount stopped after 1 attempts: device disconnected") {
+		t.Errorf("Mount() = %+v, %v, want stopped", result, err)
+	}
+}
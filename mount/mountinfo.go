@@ -0,0 +1,151 @@
+package mount
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const MountInfoPath = "/proc/self/mountinfo"
+
+const FstabPath = "/etc/fstab"
+
+// MountInfo is a single line of /proc/self/mountinfo. See proc(5)
+type MountInfo struct {
+	ID       int
+	ParentID int
+	// major:minor of the device
+	Device string
+	// Root of the mount within the filesystem
+	Root       string
+	MountPoint string
+	Options    string
+	FSType     string
+	Source     string
+	// Per superblock options
+	SuperOptions string
+}
+
+// FstabEntry is a single line of /etc/fstab. See fstab(5)
+type FstabEntry struct {
+	Source  string
+	Target  string
+	FSType  string
+	Options string
+}
+
+// ParseMountInfo parses mountinfo content.
+//
+// Fields are separated by spaces and special characters in paths are octal escaped, e.g. space is \040
+func ParseMountInfo(r io.Reader) ([]MountInfo, error) {
+	var mounts []MountInfo
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		// optional fields are terminated by the single hyphen
+		before, after, found := strings.Cut(line, " - ")
+		if !found {
+			return nil, fmt.Errorf("invalid mountinfo line %d: no separator: %q", lineNumber, line)
+		}
+		fields := strings.Fields(before)
+		fsFields := strings.Fields(after)
+		if len(fields) < 6 || len(fsFields) < 2 {
+			return nil, fmt.Errorf("invalid mountinfo line %d: %q", lineNumber, line)
+		}
+		id, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid mount id on mountinfo line %d: %v", lineNumber, err)
+		}
+		parentID, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid parent id on mountinfo line %d: %v", lineNumber, err)
+		}
+		mount := MountInfo{
+			ID:         id,
+			ParentID:   parentID,
+			Device:     fields[2],
+			Root:       unescape(fields[3]),
+			MountPoint: unescape(fields[4]),
+			Options:    fields[5],
+			FSType:     fsFields[0],
+			Source:     unescape(fsFields[1])}
+		if len(fsFields) > 2 {
+			mount.SuperOptions = fsFields[2]
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, scanner.Err()
+}
+
+// ParseFstab parses fstab content skipping comments and empty lines
+func ParseFstab(r io.Reader) ([]FstabEntry, error) {
+	var entries []FstabEntry
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid fstab line %d: %q", lineNumber, line)
+		}
+		entry := FstabEntry{Source: unescape(fields[0]), Target: unescape(fields[1]), FSType: fields[2]}
+		if len(fields) > 3 {
+			entry.Options = fields[3]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// unescape decodes octal escapes used by the kernel and fstab for space, tab, newline and backslash
+func unescape(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+3 < len(value) && isOctal(value[i+1:i+4]) {
+			code, _ := strconv.ParseUint(value[i+1:i+4], 8, 8)
+			b.WriteByte(byte(code))
+			i += 3
+			continue
+		}
+		b.WriteByte(value[i])
+	}
+	return b.String()
+}
+
+func isOctal(value string) bool {
+	for _, c := range value {
+		if c < '0' || c > '7' {
+			return false
+		}
+	}
+	return true
+}
+
+func readMountInfo(path string) ([]MountInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseMountInfo(file)
+}
+
+func readFstab(path string) ([]FstabEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseFstab(file)
+}
@@ -0,0 +1,169 @@
+package netlink_api
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+)
+
+// FakeRoutes is in-memory Routes, e.g. for tests of the event flows.
+//
+// Routes and neighbours could be changed at any time, also while the dispatcher is looking them up
+type FakeRoutes struct {
+	mu          sync.Mutex
+	routes      []DefaultRoute
+	neighbours  map[string]string
+	deviceTypes map[string]string
+	// OnNeighbourLookup is called before every neighbour lookup.
+	// Allows to resolve gateway macaddress only after a few attempts. Optional
+	OnNeighbourLookup func(ip string)
+	// channels of LinkUpdates subscribers
+	subscribers []chan struct{}
+}
+
+func NewFakeRoutes() *FakeRoutes {
+	return &FakeRoutes{neighbours: map[string]string{}, deviceTypes: map[string]string{}}
+}
+
+// AddRoute adds default route via gateway on the interface
+func (f *FakeRoutes) AddRoute(route DefaultRoute) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.routes = append(f.routes, route)
+	f.notify()
+}
+
+// RemoveRoutes removes all default routes of the interface, e.g. when it goes down
+func (f *FakeRoutes) RemoveRoutes(ifName string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.routes = slices.DeleteFunc(f.routes, func(route DefaultRoute) bool { return route.Interface == ifName })
+	f.notify()
+}
+
+// Subscribe notifies about added and removed routes
+func (f *FakeRoutes) Subscribe(done <-chan struct{}) (<-chan struct{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	changes := make(chan struct{}, 1)
+	f.subscribers = append(f.subscribers, changes)
+	go func() {
+		<-done
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.unsubscribe(changes)
+	}()
+	return changes, nil
+}
+
+// DropSubscriptions closes channels of all subscribers, like lost netlink subscription
+func (f *FakeRoutes) DropSubscriptions() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, changes := range f.subscribers {
+		close(changes)
+	}
+	f.subscribers = nil
+}
+
+func (f *FakeRoutes) unsubscribe(changes chan struct{}) {
+	if i := slices.Index(f.subscribers, changes); i >= 0 {
+		close(changes)
+		f.subscribers = slices.Delete(f.subscribers, i, i+1)
+	}
+}
+
+func (f *FakeRoutes) notify() {
+	for _, changes := range f.subscribers {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// SetNeighbour resolves ip address into macaddress. Empty macaddress removes the neighbour
+func (f *FakeRoutes) SetNeighbour(ip string, macAddress string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if macAddress == "" {
+		delete(f.neighbours, ip)
+		return
+	}
+	f.neighbours[ip] = macAddress
+}
+
+func (f *FakeRoutes) SetDeviceType(ifName string, deviceType string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deviceTypes[ifName] = deviceType
+}
+
+// GetDefaultRoute prefers IPv4 routes over IPv6 ones the same way as the kernel lookup does
+func (f *FakeRoutes) GetDefaultRoute() (*DefaultRoute, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var best *DefaultRoute
+	for i, route := range f.routes {
+		if best == nil || isBetterRoute(&route, best) {
+			best = &f.routes[i]
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	route := *best
+	return &route, nil
+}
+
+func (f *FakeRoutes) GetDefaultGateways() (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	best := map[string]DefaultRoute{}
+	for _, route := range f.routes {
+		if saved, ok := best[route.Interface]; !ok || isBetterRoute(&route, &saved) {
+			best[route.Interface] = route
+		}
+	}
+	gateways := map[string]string{}
+	for ifName, route := range best {
+		gateways[ifName] = route.Gateway
+	}
+	return gateways, nil
+}
+
+func (f *FakeRoutes) GetNeighbourMacAddress(ip string) (string, error) {
+	if onLookup := f.OnNeighbourLookup; onLookup != nil {
+		onLookup(ip)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if macAddress, ok := f.neighbours[ip]; ok {
+		return macAddress, nil
+	}
+	return "", fmt.Errorf("failed to receive macaddress for gateway %s", ip)
+}
+
+func (f *FakeRoutes) GetDeviceType(ifName string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if deviceType, ok := f.deviceTypes[ifName]; ok {
+		return deviceType
+	}
+	return "unknown"
+}
+
+// isBetterRoute tells whether route is preferred over the other one: IPv4 first, then the lowest metric
+func isBetterRoute(route *DefaultRoute, other *DefaultRoute) bool {
+	isV4, otherIsV4 := isIPv4(route.Gateway), isIPv4(other.Gateway)
+	if isV4 != otherIsV4 {
+		return isV4
+	}
+	return route.Metric < other.Metric
+}
+
+func isIPv4(address string) bool {
+	ip := net.ParseIP(address)
+	return ip != nil && ip.To4() != nil
+}
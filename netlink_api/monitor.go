@@ -0,0 +1,200 @@
+package netlink_api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"network-dispatcher/logging"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// LinkHandlers are called by MonitorDefaultRoutes in the order changes happened. Must not block
+type LinkHandlers struct {
+	// Interface got default route via gateway or its default gateway changed
+	OnConnected func(ifName string, gateway string)
+	// Interface lost its last default route or went down
+	OnDisconnected func(ifName string)
+}
+
+// GetDefaultGateways returns gateway of the lowest metric default route of every interface which is up.
+//
+// IPv6 default route is used only for interfaces without IPv4 one
+func GetDefaultGateways() (map[string]string, error) {
+	gateways := map[string]string{}
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteList(nil, family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list routes: %v", err)
+		}
+		// interface name -> the lowest metric default route of this family
+		best := map[string]netlink.Route{}
+		for _, route := range routes {
+			if !isDefaultRoute(&route) || route.Gw == nil || route.Flags&unix.RTNH_F_LINKDOWN != 0 {
+				continue
+			}
+			link, err := netlink.LinkByIndex(route.LinkIndex)
+			if err != nil || !isLinkUp(link) {
+				continue
+			}
+			ifName := link.Attrs().Name
+			if saved, ok := best[ifName]; !ok || route.Priority < saved.Priority {
+				best[ifName] = route
+			}
+		}
+		for ifName, route := range best {
+			if _, ok := gateways[ifName]; !ok {
+				gateways[ifName] = route.Gw.String()
+			}
+		}
+	}
+	return gateways, nil
+}
+
+// isLinkUp treats unknown operational state as up. Some drivers, e.g. tun, never report it
+func isLinkUp(link netlink.Link) bool {
+	attrs := link.Attrs()
+	if attrs.Flags&unix.IFF_UP == 0 {
+		return false
+	}
+	return attrs.OperState == netlink.OperUp || attrs.OperState == netlink.OperUnknown
+}
+
+// GetDeviceType returns device type name of the interface, the same as NetworkManager device type names
+func GetDeviceType(ifName string) string {
+	// wireless drivers expose phy80211 regardless of link type
+	if _, err := os.Stat(filepath.Join("/sys/class/net", ifName, "phy80211")); err == nil {
+		return "wifi"
+	}
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return "unknown"
+	}
+	switch link.Type() {
+	case "device":
+		return "ethernet"
+	case "tuntap":
+		return "tun"
+	default:
+		return link.Type()
+	}
+}
+
+// LinkUpdates notifies about kernel changes MonitorDefaultRoutes derives events from.
+//
+// Kernel subscribes through netlink, FakeRoutes notifies about its own changes
+type LinkUpdates interface {
+	// Subscribe sends to the returned channel on default route or link changes until done is closed.
+	// Changes happened before the previous value was received are merged into it.
+	// Channel is closed when done is closed or subscription is lost
+	Subscribe(done <-chan struct{}) (<-chan struct{}, error)
+}
+
+func (Kernel) Subscribe(done <-chan struct{}) (<-chan struct{}, error) {
+	routeUpdates := make(chan netlink.RouteUpdate, 64)
+	linkUpdates := make(chan netlink.LinkUpdate, 64)
+	subscription := make(chan struct{})
+	onError := func(err error) { slog.Warn("Netlink subscription error", logging.Error, err) }
+	err := netlink.RouteSubscribeWithOptions(routeUpdates, subscription, netlink.RouteSubscribeOptions{ErrorCallback: onError})
+	if err == nil {
+		err = netlink.LinkSubscribeWithOptions(linkUpdates, subscription, netlink.LinkSubscribeOptions{ErrorCallback: onError})
+	}
+	if err != nil {
+		close(subscription)
+		return nil, err
+	}
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		defer func() {
+			close(subscription)
+			// netlink closes update channels once it sees the subscription is closed
+			go func() {
+				for range routeUpdates {
+				}
+			}()
+			go func() {
+				for range linkUpdates {
+				}
+			}()
+		}()
+		for {
+			select {
+			case <-done:
+				return
+			case update, ok := <-routeUpdates:
+				if !ok {
+					return
+				}
+				if !isDefaultRoute(&update.Route) {
+					continue
+				}
+			case _, ok := <-linkUpdates:
+				if !ok {
+					return
+				}
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes, nil
+}
+
+// MonitorDefaultRoutes derives connected and disconnected events from default route and link changes until ctx is done.
+//
+// Default gateways are compared with the previous ones after every change, so missed updates are never lost.
+// initial are gateways already known to the caller. Resubscribes with backoff when subscription is lost
+func MonitorDefaultRoutes(ctx context.Context, routes Routes, updates LinkUpdates, initial map[string]string, handlers LinkHandlers) {
+	current := initial
+	delay := time.Second
+	for {
+		changes, err := updates.Subscribe(ctx.Done())
+		if err != nil {
+			slog.Warn("Failed to subscribe to netlink updates", "retry_in", delay, logging.Error, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, time.Minute)
+			continue
+		}
+		delay = time.Second
+		// changes might have happened before subscription
+		current = diffGateways(routes, current, handlers)
+		for range changes {
+			current = diffGateways(routes, current, handlers)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("Netlink subscription closed. Resubscribing")
+	}
+}
+
+// diffGateways reports interfaces which default gateways changed since previous ones and returns the current ones
+func diffGateways(routes Routes, previous map[string]string, handlers LinkHandlers) map[string]string {
+	current, err := routes.GetDefaultGateways()
+	if err != nil {
+		slog.Warn("Failed to get default gateways", logging.Error, err)
+		return previous
+	}
+	for ifName := range previous {
+		if _, ok := current[ifName]; !ok {
+			handlers.OnDisconnected(ifName)
+		}
+	}
+	for ifName, gateway := range current {
+		if previous[ifName] != gateway {
+			handlers.OnConnected(ifName, gateway)
+		}
+	}
+	return current
+}
@@ -1,113 +1,136 @@
 package netlink_api
 
 import (
-	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
-	"network-dispatcher/config"
+	"network-dispatcher/logging"
 	"time"
 
 	"github.com/vishvananda/netlink"
 )
 
-// Gets gateway through netlink
-func GetGatewayFromTheSystem() *config.ConnectedGateway {
-	gateway, _, err := ParseDefaultGateway()
-	if err != nil {
-		log.Printf("Error while  parseDefaultGateway using netlink : %v\n", err)
-		return nil
-	}
-	if gateway == "" {
-		log.Println("Netlink returned empty gateway. Will wait for dbus update")
-		return nil
-	}
-	macAddress, err := GetGatewayMacAddress(gateway)
-	if err != nil {
-		log.Printf("Failed to parse gw %s mac address using netlink : %v\n", gateway, err)
-		return nil
-	}
-	if macAddress == "" {
-		log.Printf("Netlink returned empty macaddress for %s gateway. Will wait for dbus update\n", gateway)
-		return nil
-	}
-	gatewayEntity := config.ConnectedGateway{Gateway: gateway, MacAddress: macAddress}
-	log.Printf("Default gateway received early through netlink: %s\n", gatewayEntity)
-	return &gatewayEntity
+// Routes is the part of the kernel network state the dispatcher looks up on events.
+//
+// Kernel reads it through netlink, FakeRoutes keeps everything in memory
+type Routes interface {
+	// GetDefaultRoute returns the default route with the lowest metric. Nil when there are no default routes
+	GetDefaultRoute() (*DefaultRoute, error)
+	// GetDefaultGateways returns gateway of the default route of every interface which is up
+	GetDefaultGateways() (map[string]string, error)
+	// GetNeighbourMacAddress looks up macaddress of the ip address in the neighbour table once
+	GetNeighbourMacAddress(ip string) (string, error)
+	// GetDeviceType returns device type name of the interface, the same as NetworkManager device type names
+	GetDeviceType(ifName string) string
+}
+
+// Kernel looks up routes and neighbours of the current network namespace through netlink
+type Kernel struct{}
+
+func (Kernel) GetDefaultRoute() (*DefaultRoute, error) {
+	return GetDefaultRoute()
+}
+
+func (Kernel) GetDefaultGateways() (map[string]string, error) {
+	return GetDefaultGateways()
+}
+
+func (Kernel) GetNeighbourMacAddress(ip string) (string, error) {
+	return GetNeighbourMacAddress(ip)
+}
+
+func (Kernel) GetDeviceType(ifName string) string {
+	return GetDeviceType(ifName)
 }
 
-// parseDefaultGateway gets gateway using go binding for ip route show command
-func ParseDefaultGateway() (string, string, error) {
-	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+// GetNeighbourMacAddress looks up macaddress of the ip address in the neighbour table once.
+//
+// Returns error when address is not resolved yet, e.g. arp reply from the just connected gateway is not received
+func GetNeighbourMacAddress(ip string) (string, error) {
+	filterIP := net.ParseIP(ip) // IP to filter for
+
+	// equivalent to ip neigh show <gateway_ip_address>
+	neighbors, err := netlink.NeighList(0, netlink.FAMILY_ALL)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to parse default IPv4 gateway: %v", err)
-	}
-	// Get Ipv4 gateway
-	for _, route := range routes {
-		// equivalent to ip route show default
-		if route.Dst == nil || route.Dst.String() == "0.0.0.0/0" || route.Dst.String() == "::/0" {
-			link, err := netlink.LinkByIndex(route.LinkIndex)
-			if err != nil {
-				return "", "", fmt.Errorf("failed to get link for gateway: %v", err)
-			}
-			return route.Gw.To4().String(), link.Attrs().Name, nil
-		}
+		return "", fmt.Errorf("failed to receive macaddress for gateway %s using netlink: %v", ip, err)
 	}
-	// Get Ipv6 gateway if noIpv4 were found
-	ipv6Routes, err := netlink.RouteList(nil, netlink.FAMILY_V6)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to parse default IPv6 gateway: %v", err)
-	} else {
-		for _, route := range ipv6Routes {
-			if route.Gw != nil {
-				link, err := netlink.LinkByIndex(route.LinkIndex)
-				if err != nil {
-					return "", "", fmt.Errorf("failed to get link for gateway: %v", err)
-				}
-				return route.Gw.String(), link.Attrs().Name, nil
-			}
+	for _, neighbor := range neighbors {
+		if neighbor.IP.Equal(filterIP) {
+			return neighbor.HardwareAddr.String(), nil
 		}
 	}
-	return "", "", errors.New("failed to find default gateway in the routes table")
+	return "", fmt.Errorf("failed to receive macaddress for gateway %s using netlink", ip)
 }
 
-func GetGatewayMacAddress(gateway string) (string, error) {
-	getMacAddress := func() (string, error) {
-		filterIP := net.ParseIP(gateway) // IP to filter for
+// DefaultRoute is the default route with the lowest metric, the one kernel uses for outgoing traffic
+type DefaultRoute struct {
+	Interface string
+	Gateway   string
+	Metric    int
+}
 
-		// equivalent to ip neigh show <gateway_ip_address>
-		neighbors, err := netlink.NeighList(0, netlink.FAMILY_ALL)
+// GetDefaultRoute returns IPv4 default route with the lowest metric.
+// Falls back to IPv6 one when there are no IPv4 default routes. Returns nil when there are no default routes at all
+func GetDefaultRoute() (*DefaultRoute, error) {
+	for _, family := range []int{netlink.FAMILY_V4, netlink.FAMILY_V6} {
+		routes, err := netlink.RouteList(nil, family)
 		if err != nil {
-			return "", fmt.Errorf("failed to receive macaddress for gateway %s using netlink: %v", gateway, err)
+			return nil, fmt.Errorf("failed to list routes: %v", err)
 		}
-		for _, neighbor := range neighbors {
-			if neighbor.IP.Equal(filterIP) {
-				return neighbor.HardwareAddr.String(), nil
+		var best *netlink.Route
+		for i, route := range routes {
+			if !isDefaultRoute(&route) || route.Gw == nil {
+				continue
+			}
+			if best == nil || route.Priority < best.Priority {
+				best = &routes[i]
 			}
 		}
-		return "", fmt.Errorf("failed to receive macaddress for gateway %s using netlink", gateway)
+		if best == nil {
+			continue
+		}
+		link, err := netlink.LinkByIndex(best.LinkIndex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get link for gateway: %v", err)
+		}
+		return &DefaultRoute{Interface: link.Attrs().Name, Gateway: best.Gw.String(), Metric: best.Priority}, nil
 	}
-	return GetGatewayMacAddressWithRetries(getMacAddress)
+	return nil, nil
 }
 
-func GetGatewayMacAddressWithRetries(macaddressFunc func() (string, error)) (string, error) {
-	retries := 1
-	// it's 5 seconds
-	retries_count := 50
-	var err error
-	var address string
+// equivalent to ip route show default
+func isDefaultRoute(route *netlink.Route) bool {
+	if route.Dst == nil {
+		return true
+	}
+	ones, _ := route.Dst.Mask.Size()
+	return ones == 0
+}
 
-	for retries <= retries_count {
-		address, err = macaddressFunc()
+// WatchDefaultRoutes calls onChange on every added or removed default route, e.g. when ethernet is docked.
+// Resubscribes with backoff when netlink subscription is lost
+func WatchDefaultRoutes(onChange func()) {
+	delay := time.Second
+	for {
+		updates := make(chan netlink.RouteUpdate, 64)
+		done := make(chan struct{})
+		err := netlink.RouteSubscribeWithOptions(updates, done, netlink.RouteSubscribeOptions{
+			ErrorCallback: func(err error) { slog.Warn("Netlink route subscription error", logging.Error, err) }})
 		if err != nil {
+			slog.Warn("Failed to subscribe to netlink route updates", "retry_in", delay, logging.Error, err)
+			time.Sleep(delay)
+			delay = min(delay*2, time.Minute)
 			continue
 		}
-		if address != "" {
-			fmt.Printf("Received macaddress %s from %d attempt\n", address, retries)
-			return address, nil
+		delay = time.Second
+		for update := range updates {
+			if isDefaultRoute(&update.Route) {
+				onChange()
+			}
 		}
-		time.Sleep(100 * time.Millisecond)
-		retries++
+		close(done)
+		slog.Warn("Netlink route subscription closed. Resubscribing")
+		// routes might have changed while subscription was down
+		onChange()
 	}
-	return "", fmt.Errorf("%v in %d attempts: %v", err, retries_count, err)
 }
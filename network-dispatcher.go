@@ -1,18 +1,24 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
+	"maps"
 	"network-dispatcher/config"
+	"network-dispatcher/control"
 	dbusapi "network-dispatcher/dbus_api"
-	"network-dispatcher/netlink_api"
+	"network-dispatcher/logging"
 	"network-dispatcher/shell"
+	"network-dispatcher/trace"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/godbus/dbus/v5"
@@ -23,49 +29,110 @@ import (
 // dbus-monitor --system "type='signal',sender='org.freedesktop.NetworkManager',interface='org.freedesktop.NetworkManager'"
 const ApplicationName = "network-dispatcher"
 const ConfigFileName = "config.json"
-const ConnectedGatewayFileName = "connected_gateway.json"
+const ConnectedNetworksFileName = "connected_networks.json"
+
+// Single gateway state file used before networks were tracked per interface
+const LegacyConnectedGatewayFileName = "connected_gateway.json"
 const (
 	Connected    string = "connected"
 	Disconnected string = "disconnected"
+	// Connected to the same gateway again within entity Debounce window
+	Reconnected string = "reconnected"
 )
 
 // Supported environment variables passed to the dispatched scripts
 const DISPATCHER_GATEWAY = "DISPATCHER_GATEWAY"
 const DISPATCHER_GATEWAY_MACADDRESS = "DISPATCHER_GATEWAY_MACADDRESS"
+const DISPATCHER_DEVICE_TYPE = "DISPATCHER_DEVICE_TYPE"
+const DISPATCHER_SSID = "DISPATCHER_SSID"
+const DISPATCHER_BSSID = "DISPATCHER_BSSID"
+const DISPATCHER_CONNECTION_ID = "DISPATCHER_CONNECTION_ID"
+const DISPATCHER_CONNECTION_UUID = "DISPATCHER_CONNECTION_UUID"
+const DISPATCHER_CONNECTION_TYPE = "DISPATCHER_CONNECTION_TYPE"
+const DISPATCHER_INTERFACE = "DISPATCHER_INTERFACE"
 
 // end of supported variables
 
 var ErrDeviceNotActivated = errors.New("device not activated")
 
-type configuration struct {
-	Entities []config.Entity
-}
-
 var configFilePath string
 
+// Holds the last valid configuration. Reloaded on config file change or SIGHUP
+var configStore *config.Store
+
+// Runs entity scripts. Tracks running scripts per entity to apply entity concurrency policy
+var executor = shell.NewExecutor()
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidate(os.Args[2:]))
+		case "status":
+			os.Exit(runStatus(os.Args[2:]))
+		case "simulate":
+			os.Exit(runSimulate(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplay(os.Args[2:]))
+		}
+	}
+
 	flag.StringVar(&configFilePath, "config", getConfigFilePath(), "Path to the configuration file")
+	socketPath := flag.String("socket", control.DefaultSocketPath(), "Path to the control socket used by the status command")
+	backendName := flag.String("backend", BackendNetworkManager, "Source of network events: networkmanager or netlink")
+	recordPath := flag.String("record", "", "Write received NetworkManager signals and queried properties into the file as jsonl trace for the replay command")
+	logLevel := flag.String("log-level", "info", "Minimal level of logged records: debug, info, warn or error")
+	logFormat := flag.String("log-format", logging.FormatText, "Format of logged records: text, json or journald. journald sends records to the journal with structured fields")
 	flag.Parse()
+	if err := logging.Setup(*logLevel, *logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	backend, err := newEventBackend(*backendName, dispatcher)
+	if err != nil {
+		fatal("Failed to start", logging.Error, err)
+	}
+	if *recordPath != "" {
+		if *backendName != BackendNetworkManager {
+			fatal("--record is supported only by networkmanager backend", "backend", *backendName)
+		}
+		recorder, err := trace.Create(*recordPath)
+		if err != nil {
+			fatal("Failed to start recording", logging.Error, err)
+		}
+		slog.Info("Recording NetworkManager signals", "trace", *recordPath)
+		dispatcher.record(recorder)
+	}
 
-	if err := dbusapi.Connect(); err != nil {
-		log.Fatalf("Failed to connect to DBus: %v", err)
+	configStore = config.NewStore(configFilePath)
+	if err := configStore.Reload(); err != nil {
+		slog.Error("Failed to load config. No scripts will be executed until it's fixed", logging.Error, err)
+	}
+	if err := config.Watch(configStore); err != nil {
+		slog.Warn("Config file changes will not be picked up automatically. Send SIGHUP to reload", logging.Error, err)
+	}
+	reloadConfigOnSighup()
+	if err := serveControlSocket(*socketPath); err != nil {
+		slog.Warn("Status command will not be available", logging.Error, err)
 	}
 
-	// Make sure there are no leftovers of of the saved old gateway
-	deleteGatewayFilePathIfPresent()
+	// Make sure there are no leftovers of the networks saved by the previous run
+	deleteFileIfPresent(getStateFilePath(LegacyConnectedGatewayFileName))
+	deleteFileIfPresent(getStateFilePath(ConnectedNetworksFileName))
+	state.networksFilePath = getStateFilePath(ConnectedNetworksFileName)
 
-	// perform initial gateway aquire.
-	// when service starts on boot then gateway is not yet available. But it's fine because gateway is used only by disconnect hooks
-	// onConnect event updates gateway in realtime from the received config and does not rely on saveNetworkStateOnStartup
-	saveNetworkStateOnStartup()
+	backend.start()
+	backend.monitor()
+}
 
-	dbusapi.MonitorNetworkCardStateChanged(
-		onConnected,
-		onDisconnected)
+// fatal logs the error record and exits
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
 }
 
-func onConnected(signal *dbus.Signal) {
-	netCard := dbusapi.NewNetworkAdapter(signal.Path)
+func (d *networkDispatcher) onConnected(ctx context.Context, devicePath dbus.ObjectPath) {
+	netCard := d.nm.Device(devicePath)
 	ifName, _ := netCard.GetInterfaceName()
 	if ifName == "" {
 		ifName = "unknown"
@@ -73,45 +140,186 @@ func onConnected(signal *dbus.Signal) {
 
 	deviceType, err := netCard.GetDeviceType()
 	if err != nil {
-		log.Printf("Failed to get device type for %s: %v\n", ifName, err)
+		slog.Warn("Failed to get device type", logging.Interface, ifName, logging.Error, err)
 		return
 	}
-	if deviceType != dbusapi.NM_DEVICE_TYPE_WIFI {
+	deviceTypeName := dbusapi.DeviceTypeName(deviceType)
+	if !isDeviceTypeDispatched(deviceTypeName) {
 		return
 	}
 
-	fmt.Printf("Dbus network connected event for %s\n", ifName)
+	slog.Info("Dbus network connected event", logging.Interface, ifName, "device_path", devicePath)
 
-	gateway, err := getGatewayFromDbus(signal)
+	gateway, err := d.getGatewayFromDbus(devicePath)
 	if err != nil {
 		if errors.Is(err, ErrDeviceNotActivated) {
-			log.Printf("Aborting gateway retrieval for %s: device not activated\n", ifName)
+			slog.Info("Aborting gateway retrieval: device not activated", logging.Interface, ifName)
 			return
 		}
-		log.Printf("Failed to receive gateway for %s on connected: %v\n", ifName, err)
+		slog.Warn("Failed to receive gateway on connected", logging.Interface, ifName, logging.Error, err)
 		return
 	}
 	if gateway == "" {
-		log.Printf("Device %s connected but no gateway found. Skipping.\n", ifName)
+		slog.Info("Device connected but no gateway found. Skipping", logging.Interface, ifName)
 		return
 	}
 
-	gatewayEntity, err := getGatewayEntity(gateway)
+	gatewayEntity, err := d.getGatewayEntity(gateway)
 	if err != nil {
-		log.Printf("Failed to create gateway entity: %v\n", err)
+		slog.Warn("Failed to create gateway entity", logging.Interface, ifName, logging.Error, err)
+		return
+	}
+	if deviceType == dbusapi.NM_DEVICE_TYPE_WIFI {
+		gatewayEntity.SSID, gatewayEntity.BSSID = getAccessPoint(netCard)
+	}
+	setActiveConnection(netCard, gatewayEntity)
+	gatewayEntity.Interface = ifName
+	gatewayEntity.DevicePath = string(devicePath)
+	gatewayEntity.DeviceType = deviceTypeName
+	gatewayEntity.ConnectedAt = time.Now()
+	networkConnected(ctx, gatewayEntity)
+}
+
+// networkConnected remembers network connected on the interface and runs connect scripts.
+// Used by all event backends once network details are resolved
+func networkConnected(ctx context.Context, gatewayEntity *config.ConnectedGateway) {
+	ifName := gatewayEntity.Interface
+	if previous := state.findNetwork(ifName, gatewayEntity.DevicePath); previous != nil {
+		if sameNetwork(previous, gatewayEntity) {
+			// e.g. coalesced connected -> disconnected -> connected flap
+			slog.Info("Still connected to the same network. Connect scripts will not run again", networkAttrs(gatewayEntity)...)
+			return
+		}
+		// roamed to another network without disconnect event in between
+		if old := state.removeNetwork(previous.Interface, previous.DevicePath); old != nil {
+			dispatchDisconnected(old)
+		}
+	}
+	slog.Info("Network connected", networkAttrs(gatewayEntity)...)
+
+	state.setNetwork(*gatewayEntity)
+	dispatchConnected(ctx, gatewayEntity)
+}
+
+// sameNetwork reports whether both are the same network: the same gateway and wifi network.
+// Ssid is compared only when both are known, e.g. network saved on startup without NetworkManager has none
+func sameNetwork(a *config.ConnectedGateway, b *config.ConnectedGateway) bool {
+	if a.MacAddress != b.MacAddress || a.Gateway != b.Gateway {
+		return false
+	}
+	return a.SSID == "" || b.SSID == "" || a.SSID == b.SSID
+}
+
+// dispatchConnected runs connect scripts.
+//
+// When network came back within entity Debounce window after disconnect, entity disconnect script did not run.
+// So its connect script doesn't run either and reconnected entities run instead
+func dispatchConnected(ctx context.Context, gatewayEntity *config.ConnectedGateway) {
+	event := newEvent(gatewayEntity, Connected)
+	entities := getMatchingEntities(event)
+	pending := disconnects.reconnected(gatewayEntity.Interface, gatewayEntity.MacAddress)
+	if pending == nil {
+		runEntityScripts(ctx, event, entities)
 		return
 	}
-	log.Println(gatewayEntity)
-	log.Printf("Wifi connected on %s\n", ifName)
+	slog.Info("Network came back after disconnect", logging.Interface, gatewayEntity.Interface, logging.Mac, gatewayEntity.MacAddress,
+		"after", disconnects.clock.Now().Sub(pending.disconnectedAt).Round(time.Millisecond))
+	global := configStore.Current().Debounce
+	entities = slices.DeleteFunc(entities, func(entity matchedEntity) bool {
+		return pending.cameBackWithin(entity.GetDebounce(global))
+	})
+	if len(entities) > 0 {
+		runEntityScripts(ctx, event, entities)
+	}
+
+	event.Event = Reconnected
+	reconnectedEntities := slices.DeleteFunc(getMatchingEntities(event), func(entity matchedEntity) bool {
+		return !pending.cameBackWithin(entity.GetDebounce(global))
+	})
+	runEntityScripts(ctx, event, reconnectedEntities)
+}
+
+func newEvent(gateway *config.ConnectedGateway, event string) config.Event {
+	return config.Event{
+		Gateway:        gateway.Gateway,
+		MacAddress:     gateway.MacAddress,
+		Event:          event,
+		DeviceType:     gateway.DeviceType,
+		Interface:      gateway.Interface,
+		SSID:           gateway.SSID,
+		BSSID:          gateway.BSSID,
+		ConnectionId:   gateway.ConnectionId,
+		ConnectionUuid: gateway.ConnectionUuid,
+		ConnectionType: gateway.ConnectionType}
+}
+
+// eventAttrs are log fields of the dispatched event
+func eventAttrs(event config.Event) []any {
+	return []any{logging.Event, event.Event, logging.Interface, event.Interface, logging.Gateway, event.Gateway, logging.Mac, event.MacAddress}
+}
+
+// networkAttrs are log fields of the connected network. Optional details are added only when known
+func networkAttrs(gateway *config.ConnectedGateway) []any {
+	attrs := []any{logging.Interface, gateway.Interface, logging.Gateway, gateway.Gateway, logging.Mac, gateway.MacAddress,
+		logging.DeviceType, gateway.DeviceType}
+	if gateway.SSID != "" {
+		attrs = append(attrs, logging.SSID, gateway.SSID, logging.BSSID, gateway.BSSID)
+	}
+	if gateway.ConnectionId != "" {
+		attrs = append(attrs, logging.Connection, gateway.ConnectionId)
+	}
+	return attrs
+}
 
-	saveLastConnectedGatewayToConfig(getConnectedGatewayFilePath(), gatewayEntity)
-	executeEntityScripts(config.Event{Gateway: gatewayEntity.Gateway, MacAddress: gatewayEntity.MacAddress, Event: Connected})
+// setActiveConnection fills connection profile details of the adapter into the gateway.
+//
+// Keeps them empty if connection could not be received. Connection filters just won't match then
+func setActiveConnection(netCard dbusapi.Device, gateway *config.ConnectedGateway) {
+	activeConnection, err := netCard.ActiveConnection()
+	if err != nil {
+		slog.Warn("Failed to get active connection", logging.Error, err)
+		return
+	}
+	if activeConnection.Path() == "/" {
+		return
+	}
+	if gateway.ConnectionId, err = activeConnection.Id(); err != nil {
+		slog.Warn("Failed to get id of connection", "connection_path", activeConnection.Path(), logging.Error, err)
+	}
+	if gateway.ConnectionUuid, err = activeConnection.Uuid(); err != nil {
+		slog.Warn("Failed to get uuid of connection", "connection_path", activeConnection.Path(), logging.Error, err)
+	}
+	if gateway.ConnectionType, err = activeConnection.Type(); err != nil {
+		slog.Warn("Failed to get type of connection", "connection_path", activeConnection.Path(), logging.Error, err)
+	}
+}
 
+// getAccessPoint returns ssid and bssid of the wifi network adapter is connected to.
+//
+// Returns empty values if access point could not be received. Ssid filters just won't match then
+func getAccessPoint(netCard dbusapi.Device) (string, string) {
+	ap, err := netCard.ActiveAccessPoint()
+	if err != nil {
+		slog.Warn("Failed to get active access point", logging.Error, err)
+		return "", ""
+	}
+	if ap.Path() == "/" {
+		return "", ""
+	}
+	ssid, err := ap.Ssid()
+	if err != nil {
+		slog.Warn("Failed to get ssid of access point", "access_point_path", ap.Path(), logging.Error, err)
+	}
+	bssid, err := ap.Bssid()
+	if err != nil {
+		slog.Warn("Failed to get bssid of access point", "access_point_path", ap.Path(), logging.Error, err)
+	}
+	return ssid, bssid
 }
 
-func getGatewayFromDbus(signal *dbus.Signal) (string, error) {
+func (d *networkDispatcher) getGatewayFromDbus(devicePath dbus.ObjectPath) (string, error) {
 	getGateway := func() (string, error) {
-		netCard := dbusapi.NewNetworkAdapter(signal.Path)
+		netCard := d.nm.Device(devicePath)
 
 		state, err := netCard.GetState()
 		if err == nil && state != dbusapi.NM_DEVICE_STATE_ACTIVATED {
@@ -124,7 +332,7 @@ func getGatewayFromDbus(signal *dbus.Signal) (string, error) {
 			return "", fmt.Errorf("failed to get Ip4Config: %v", err)
 		}
 
-		if ip4.Path == "/" {
+		if ip4.Path() == "/" {
 			// This is NOT an error, it just means no IPv4 config exists yet.
 			// We continue to check IPv6.
 		} else {
@@ -132,7 +340,7 @@ func getGatewayFromDbus(signal *dbus.Signal) (string, error) {
 			if err != nil {
 				// If we have a valid path but fail to get Gateway, that IS an error worth retrying?
 				// Actually, often better to log and continue to IPv6 to avoid blocking
-				fmt.Printf("Warning: Failed to get IPv4 gateway: %v\n", err)
+				slog.Warn("Failed to get IPv4 gateway", "device_path", devicePath, logging.Error, err)
 			} else if gateway != "" {
 				return gateway, nil
 			}
@@ -144,12 +352,12 @@ func getGatewayFromDbus(signal *dbus.Signal) (string, error) {
 			return "", fmt.Errorf("failed to get Ip6Config: %v", err)
 		}
 
-		if ip6.Path == "/" {
+		if ip6.Path() == "/" {
 			// No IPv6 config
 		} else {
 			gateway, err := ip6.Gateway()
 			if err != nil {
-				fmt.Printf("Warning: Failed to get IPv6 gateway: %v\n", err)
+				slog.Warn("Failed to get IPv6 gateway", "device_path", devicePath, logging.Error, err)
 			} else if gateway != "" {
 				return gateway, nil
 			}
@@ -162,13 +370,12 @@ func getGatewayFromDbus(signal *dbus.Signal) (string, error) {
 		return "", nil
 	}
 
-	return getGatewayFromDbusWithRetries(getGateway)
+	return d.getGatewayFromDbusWithRetries(getGateway)
 }
 
-func getGatewayFromDbusWithRetries(gatewayFunc func() (string, error)) (string, error) {
+func (d *networkDispatcher) getGatewayFromDbusWithRetries(gatewayFunc func() (string, error)) (string, error) {
 	retries := 1
-	// it's 5 seconds
-	retries_count := 50
+	retries_count := d.retry.attempts
 	var err error
 	var gateway string
 
@@ -178,10 +385,10 @@ func getGatewayFromDbusWithRetries(gatewayFunc func() (string, error)) (string,
 			return "", err
 		}
 		if err == nil && gateway != "" {
-			fmt.Printf("Received dbus gateway %s from %d attempt\n", gateway, retries)
+			slog.Debug("Received dbus gateway", logging.Gateway, gateway, "attempt", retries)
 			return gateway, nil
 		}
-		time.Sleep(100 * time.Millisecond)
+		time.Sleep(d.retry.delay)
 		retries++
 	}
 	if err == nil {
@@ -190,92 +397,167 @@ func getGatewayFromDbusWithRetries(gatewayFunc func() (string, error)) (string,
 	return "", fmt.Errorf("timeout waiting for gateway in %d attempts (last error: %v)", retries_count, err)
 }
 
-func onDisconnected(signal *dbus.Signal) {
-	netCard := dbusapi.NewNetworkAdapter(signal.Path)
+func (d *networkDispatcher) onDisconnected(devicePath dbus.ObjectPath) {
+	netCard := d.nm.Device(devicePath)
 
-	deviceType, err := netCard.GetDeviceType()
-	if err == nil && deviceType != dbusapi.NM_DEVICE_TYPE_WIFI {
+	// interface name is not always available for removed devices. Saved network is looked up by device path then
+	ifName, _ := netCard.GetInterfaceName()
+	slog.Info("Dbus network disconnected event", logging.Interface, ifName, "device_path", devicePath)
+	// forget the network first to not keep stale network if scripts hang
+	gatewayEntity := state.removeNetwork(ifName, string(devicePath))
+	if gatewayEntity == nil {
+		slog.Info("No connected network saved. Disconnect scripts will not run", logging.Interface, ifName, "device_path", devicePath)
 		return
 	}
+	dispatchDisconnected(gatewayEntity)
+}
 
-	ifName, _ := netCard.GetInterfaceName()
-	if ifName == "" {
-		ifName = "unknown"
+// dispatchDisconnected runs disconnect scripts.
+//
+// Scripts of entities with Debounce run only when network doesn't come back to the same gateway within the window
+func dispatchDisconnected(gatewayEntity *config.ConnectedGateway) {
+	slog.Info("Network disconnected", networkAttrs(gatewayEntity)...)
+	event := newEvent(gatewayEntity, Disconnected)
+	immediate, debounced := splitDebounced(getMatchingEntities(event))
+	disconnects.schedule(event, debounced)
+	if len(immediate) > 0 || len(debounced) == 0 {
+		runEntityScripts(context.Background(), event, immediate)
 	}
-	fmt.Printf("Dbus network disconnected event for %s\n", ifName)
-	gatewayEntity := getLastConnectedGatewayFromConfig(getConnectedGatewayFilePath())
-	log.Printf("Wifi disconnected on %s\n", ifName)
-	if gatewayEntity.MacAddress == "" {
-		log.Printf("Last active gateway macaddress is not detected %v. Gateway specific disconnect events will not run\n", gatewayEntity)
-	} else {
-		log.Println(gatewayEntity)
-		executeEntityScripts(config.Event{Gateway: gatewayEntity.Gateway, MacAddress: gatewayEntity.MacAddress, Event: Disconnected})
+}
+
+// onResync is called when bus connection is restored or NetworkManager restarted
+func (d *networkDispatcher) onResync() {
+	// lock is lost when daemon started without bus connection or logind restarted
+	takeSleepLock()
+	d.reconcileNetworks()
+	d.syncConnectivity(true)
+}
+
+// reconcileNetworks dispatches connect and disconnect events missed
+// while system bus or NetworkManager were not available.
+//
+// Compares saved networks with devices activated right now.
+// Devices are matched by interface name since NetworkManager assigns new object paths to devices after restart.
+// Devices still activated are dispatched as connected again, which runs disconnect and connect scripts
+// only when they are connected to another network now, e.g. another wifi after resume
+func (d *networkDispatcher) reconcileNetworks() {
+	devicePaths, err := d.nm.GetDevicePaths()
+	if err != nil {
+		slog.Warn("Failed to get NetworkManager devices to resync network state", logging.Error, err)
+		return
+	}
+	// interface name -> device path of activated devices
+	activated := map[string]dbus.ObjectPath{}
+	for _, devicePath := range devicePaths {
+		netCard := d.nm.Device(devicePath)
+		if deviceState, err := netCard.GetState(); err != nil || deviceState != dbusapi.NM_DEVICE_STATE_ACTIVATED {
+			continue
+		}
+		if ifName, err := netCard.GetInterfaceName(); err == nil && ifName != "" {
+			activated[ifName] = devicePath
+		}
+	}
+
+	for _, network := range state.getNetworks() {
+		devicePath, ok := activated[network.Interface]
+		if !ok {
+			slog.Info("Network was disconnected while NetworkManager was not available", networkAttrs(&network)...)
+			d.events.pushDisconnectedNetwork(network)
+			continue
+		}
+		delete(activated, network.Interface)
+		if network.DevicePath != string(devicePath) {
+			network.DevicePath = string(devicePath)
+			state.setNetwork(network)
+		}
+		d.events.push(devicePath, Connected)
+	}
+	for ifName, devicePath := range activated {
+		slog.Info("Network was connected while NetworkManager was not available", logging.Interface, ifName)
+		d.events.push(devicePath, Connected)
 	}
-	// cleanup gateway config file to avoid stale gateway information
-	deleteGatewayFilePathIfPresent()
 }
 
-func deleteGatewayFilePathIfPresent() {
-	gwPath := getConnectedGatewayFilePath()
-	if _, err := os.Stat(gwPath); err == nil {
-		err := os.Remove(gwPath)
+func deleteFileIfPresent(path string) {
+	if _, err := os.Stat(path); err == nil {
+		err := os.Remove(path)
 		if err != nil {
-			fmt.Printf("Error deleting gateway config file '%s': %v\n", gwPath, err)
+			slog.Warn("Failed to delete file", "path", path, logging.Error, err)
 		} else {
-			log.Println("Gateway config file deleted")
+			slog.Debug("Deleted file", "path", path)
 		}
 	} else if !os.IsNotExist(err) {
-		fmt.Printf("Error checking file stat'%s': %v\n", gwPath, err)
+		slog.Warn("Failed to check file", "path", path, logging.Error, err)
 	}
 }
 
 // saveNetworkStateOnStartup saves the current network to reuse it later.
 //
 // network state used in disconnect event to trigger disconnect related hooks specified in config
-func saveNetworkStateOnStartup() {
-	startupGateway, ifaceName, err := netlink_api.ParseDefaultGateway()
+func (d *networkDispatcher) saveNetworkStateOnStartup() {
+	route, err := d.routes.GetDefaultRoute()
 	if err != nil {
-		fmt.Printf("Failed to receive gateway on startup. Gateway dependant scripts will not run: %v\n", err)
+		slog.Warn("Failed to receive gateway on startup. Gateway dependant scripts will not run", logging.Error, err)
 		return
 	}
-	if startupGateway == "" {
-		fmt.Println("Failed to receive gateway on startup. Gateway dependant scripts will not run")
+	if route == nil || route.Gateway == "" {
+		slog.Info("No default gateway on startup. Gateway dependant scripts will not run")
 		return
 	}
+	startupGateway, ifaceName := route.Gateway, route.Interface
 
+	var netCard dbusapi.Device
+	var deviceType uint32 = dbusapi.NM_DEVICE_TYPE_UNKNOWN
 	if ifaceName != "" {
-		netCard, err := dbusapi.GetDeviceByInterfaceName(ifaceName)
+		netCard, err = d.nm.GetDeviceByInterfaceName(ifaceName)
 		if err == nil {
 			dt, err := netCard.GetDeviceType()
-			if err == nil && dt != dbusapi.NM_DEVICE_TYPE_WIFI {
-				fmt.Printf("Startup gateway found on non-wifi interface %s. Ignoring.\n", ifaceName)
+			if err == nil && !isDeviceTypeDispatched(dbusapi.DeviceTypeName(dt)) {
+				slog.Info("Startup gateway found on device type not used by any entity. Ignoring", logging.Interface, ifaceName,
+					logging.DeviceType, dbusapi.DeviceTypeName(dt))
 				return
 			}
+			deviceType = dt
 		} else {
-			fmt.Printf("Warning: Failed to get device info for interface %s: %v\n", ifaceName, err)
+			netCard = nil
+			slog.Warn("Failed to get device info", logging.Interface, ifaceName, logging.Error, err)
 		}
 	}
 
-	macAddress, err := netlink_api.GetGatewayMacAddress(startupGateway)
+	macAddress, err := d.getGatewayMacAddress(startupGateway)
 	if err != nil {
-		log.Printf("Failed to receive gateway %s macaddress on startup. Gateway dependant scripts will not run: %v\n", startupGateway, err)
+		slog.Warn("Failed to receive gateway macaddress on startup. Gateway dependant scripts will not run",
+			logging.Interface, ifaceName, logging.Gateway, startupGateway, logging.Error, err)
 		return
 	}
 	if macAddress == "" {
-		fmt.Printf("Failed to receive gateway %s macaddress on startup. Gateway dependant scripts will not run\n", startupGateway)
+		slog.Warn("Gateway macaddress is empty on startup. Gateway dependant scripts will not run",
+			logging.Interface, ifaceName, logging.Gateway, startupGateway)
 		return
 	}
-	gatewayEntity := config.ConnectedGateway{Gateway: startupGateway, MacAddress: macAddress}
-	fmt.Printf("Found gateway on startup: %s\n", gatewayEntity)
-	saveLastConnectedGatewayToConfig(getConnectedGatewayFilePath(), &gatewayEntity)
+	gatewayEntity := config.ConnectedGateway{
+		Interface:   ifaceName,
+		DeviceType:  dbusapi.DeviceTypeName(deviceType),
+		ConnectedAt: time.Now(),
+		Gateway:     startupGateway,
+		MacAddress:  macAddress}
+	if netCard != nil {
+		gatewayEntity.DevicePath = string(netCard.Path())
+		if deviceType == dbusapi.NM_DEVICE_TYPE_WIFI {
+			gatewayEntity.SSID, gatewayEntity.BSSID = getAccessPoint(netCard)
+		}
+		setActiveConnection(netCard, &gatewayEntity)
+	}
+	slog.Info("Found gateway on startup", networkAttrs(&gatewayEntity)...)
+	state.setNetwork(gatewayEntity)
 }
 
 // Parses gateway from dbus event and fetches macaddress for it using netlink
-func getGatewayEntity(gateway string) (*config.ConnectedGateway, error) {
+func (d *networkDispatcher) getGatewayEntity(gateway string) (*config.ConnectedGateway, error) {
 	if gateway == "" {
 		return nil, errors.New("failed to parse gateway from dbus: it's empty")
 	}
-	macAddress, err := netlink_api.GetGatewayMacAddress(gateway)
+	macAddress, err := d.getGatewayMacAddress(gateway)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse macaddress for gateway %s from dbus: %v", gateway, err)
 	}
@@ -285,112 +567,157 @@ func getGatewayEntity(gateway string) (*config.ConnectedGateway, error) {
 	return &config.ConnectedGateway{Gateway: gateway, MacAddress: macAddress}, nil
 }
 
-func readConfigurationFile(jsonPath string) (*configuration, error) {
-	fmt.Printf("Read config file from %s\n", jsonPath)
-	content, err := os.ReadFile(jsonPath)
-	// file does not exist is expected behavior and just use empty configuration
-	config := configuration{}
-	if err == nil {
-		err = json.Unmarshal(content, &config)
-		if err != nil {
-			log.Fatalf("failed to parse %s: %v", jsonPath, err)
-		}
-	} else if err != nil {
-		if !errors.Is(err, os.ErrNotExist) {
-			return nil, fmt.Errorf("failed to parse config.json: %v", err)
-		} else {
-			return nil, fmt.Errorf("config file not found at %s", jsonPath)
+// reloadConfigOnSighup allows to force config reload with systemctl reload or kill -HUP
+func reloadConfigOnSighup() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			slog.Info("Received SIGHUP. Reloading config")
+			if err := configStore.Reload(); err != nil {
+				slog.Error("Config reload failed. Keeping previous configuration", "generation", configStore.Generation(), logging.Error, err)
+			}
 		}
-	}
-	return &config, nil
-}
-
-func saveLastConnectedGatewayToConfig(jsonPath string, gateway *config.ConnectedGateway) {
-	content, err := json.MarshalIndent(gateway, "", " ")
-	if err != nil {
-		log.Println(err)
-		return
-	}
-	err = os.WriteFile(jsonPath, content, 0644)
-	if err != nil {
-		log.Println(err)
-		return
-	}
+	}()
 }
 
-func getLastConnectedGatewayFromConfig(jsonPath string) *config.ConnectedGateway {
-	content, err := os.ReadFile(jsonPath)
-	gatewayEntity := config.ConnectedGateway{}
-	if err == nil {
-		err = json.Unmarshal(content, &gatewayEntity)
-		if err != nil {
-			log.Fatal(err)
+// isDeviceTypeDispatched checks whether any entity is interested in events from the given device type.
+//
+// Events from other device types are ignored completely, e.g. no need to resolve gateway of vpn device
+// when all entities are wifi only
+func isDeviceTypeDispatched(deviceType string) bool {
+	for _, entity := range configStore.Current().Entities {
+		if entity.ContainsDeviceType(deviceType) {
+			return true
 		}
-	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
-		log.Fatal(err)
 	}
-	return &gatewayEntity
+	return false
 }
 
 func getConfigFilePath() string {
 	configDir, err := os.UserConfigDir()
 	if err != nil {
-		log.Fatal(err)
+		fatal("Failed to find config directory", logging.Error, err)
 	}
 	return filepath.Join(configDir, ApplicationName, ConfigFileName)
 }
 
-func getConnectedGatewayFilePath() string {
+func getStateFilePath(fileName string) string {
 	configDir, err := os.UserConfigDir()
 	if err != nil {
-		log.Fatal(err)
+		fatal("Failed to find config directory", logging.Error, err)
 	}
-	return filepath.Join(configDir, ApplicationName, ConnectedGatewayFileName)
+	return filepath.Join(configDir, ApplicationName, fileName)
 }
 
-func executeEntityScripts(event config.Event) {
-	var entities []config.Entity
-	config, err := readConfigurationFile(configFilePath)
-	if err != nil {
-		log.Println(err)
-		log.Println("Script execution will be skipped")
-		return
-	}
+// Entity with its position in the config
+type matchedEntity struct {
+	config.Entity
+	Index int
+}
 
-	for _, entity := range config.Entities {
-		if strings.ToLower(entity.Event) != event.Event {
-			continue
-		}
-		// Skip excluded mac addresses
-		if entity.ContainsExcludedMacAddress(event.MacAddress) {
-			continue
-		}
+// key identifies entity scripts in the executor. Includes script since config could be reloaded
+func (m *matchedEntity) key() string {
+	return fmt.Sprintf("%d:%s", m.Index, m.Script)
+}
 
-		// empty entity.MacAddress applies script on all networks
-		if !entity.HasIncludedMacAddresses() || entity.ContainsIncludedMacAddress(event.MacAddress) {
-			entities = append(entities, entity)
+// name of the entity script or action shown in logs and status
+func (m *matchedEntity) name() string {
+	if m.Action != "" {
+		return m.Action
+	}
+	return filepath.Base(os.ExpandEnv(m.Script))
+}
+
+// getMatchingEntities returns entities which should run for the event in the config order
+func getMatchingEntities(event config.Event) []matchedEntity {
+	var entities []matchedEntity
+	for i, entity := range configStore.Current().Entities {
+		if entityMatchesEvent(&entity, event) {
+			entities = append(entities, matchedEntity{Entity: entity, Index: i})
 		}
 	}
+	return entities
+}
+
+// getScriptEnvVariables returns variables passed to the entity script in addition to the daemon environment
+func getScriptEnvVariables(entity *config.Entity, event config.Event) map[string]string {
+	envVars := make(map[string]string)
+	envVars[DISPATCHER_GATEWAY] = event.Gateway
+	envVars[DISPATCHER_GATEWAY_MACADDRESS] = event.MacAddress
+	envVars[DISPATCHER_DEVICE_TYPE] = event.DeviceType
+	envVars[DISPATCHER_SSID] = event.SSID
+	envVars[DISPATCHER_BSSID] = event.BSSID
+	envVars[DISPATCHER_CONNECTION_ID] = event.ConnectionId
+	envVars[DISPATCHER_CONNECTION_UUID] = event.ConnectionUuid
+	envVars[DISPATCHER_CONNECTION_TYPE] = event.ConnectionType
+	envVars[DISPATCHER_INTERFACE] = event.Interface
+	if event.Event == PrimaryChanged {
+		envVars[DISPATCHER_PREVIOUS_INTERFACE] = event.PreviousInterface
+		envVars[DISPATCHER_PREVIOUS_GATEWAY] = event.PreviousGateway
+		envVars[DISPATCHER_PREVIOUS_GATEWAY_MACADDRESS] = event.PreviousMacAddress
+	}
+
+	for key, value := range entity.EnvVariables {
+		// allow to have variables like $HOME in EnvVariables values.
+		envVars[key] = os.ExpandEnv(value)
+	}
+	return envVars
+}
+
+func executeEntityScripts(event config.Event) {
+	runEntityScripts(context.Background(), event, getMatchingEntities(event))
+}
+
+// runEntityScripts runs scripts of the entities matched the event in order.
+//
+// Once ctx is done the rest of the entities are skipped and running scripts of kill-previous entities are killed
+func runEntityScripts(ctx context.Context, event config.Event, entities []matchedEntity) {
+	record := state.addEvent(event)
 	for _, entity := range entities {
-		script := os.ExpandEnv(entity.Script)
-		if _, err := os.Stat(script); err != nil {
-			fmt.Printf("Failed to execute %s. Script does not exist\n", script)
+		logger := slog.With(append(eventAttrs(event), logging.Entity, entity.Index, logging.Script, entity.name(),
+			logging.Invocation, logging.NewInvocationID())...)
+		var execOut *shell.ExecScriptOut
+		var result any
+		var conditionVars map[string]string
+		err := interrupted(ctx)
+		if err == nil {
+			conditionVars, err = runConditions(&entity.Entity)
+		}
+		if err != nil {
+			execOut = &shell.ExecScriptOut{ScriptName: entity.name(), Skipped: true, Err: err.Error()}
+		} else if entity.Action != "" {
+			execOut, result = runAction(ctx, &entity, event)
+		} else {
+			script := os.ExpandEnv(entity.Script)
+			if _, err := os.Stat(script); err != nil {
+				logger.Error("Failed to execute script. Script does not exist", "path", script)
+				continue
+			}
+			envVars := getScriptEnvVariables(&entity.Entity, event)
+			maps.Copy(envVars, conditionVars)
+			opts := shell.ExecOptions{
+				Timeout:         time.Duration(entity.Timeout),
+				KillGracePeriod: time.Duration(entity.KillGracePeriod),
+				Logger:          logger}
+			if entity.GetConcurrency() == shell.PolicyKillPrevious {
+				opts.Context = ctx
+			}
+			execOut = executor.Execute(entity.key(), entity.GetConcurrency(), script, envVars, opts)
+		}
+		state.addScriptRun(record, execOut, result)
+		if execOut.Skipped {
+			logger.Warn("Script skipped", "reason", execOut.Err)
 			continue
 		}
-		envVars := make(map[string]string)
-		envVars[DISPATCHER_GATEWAY] = event.Gateway
-		envVars[DISPATCHER_GATEWAY_MACADDRESS] = event.MacAddress
-
-		for key, value := range entity.EnvVariables {
-			// allow to have variables like $HOME in EnvVariables values.
-			envVars[key] = os.ExpandEnv(value)
+		if execOut.Pid != 0 {
+			logger = logger.With(logging.Pid, execOut.Pid)
 		}
-		execOut := shell.ExecuteScript(script, envVars)
+		logger = logger.With(logging.Duration, execOut.Duration)
+		logMultilineScriptOutput(logger, logging.StreamStdout, execOut.Out)
+		logMultilineScriptOutput(logger, logging.StreamStderr, execOut.ErrOut)
 		if execOut.Err != "" {
-			log.Printf("Failed to execute %s", execOut.ScriptName)
-			logMultilineScriptOutput(
-				execOut.Err+"\n"+execOut.Combined,
-				execOut.ScriptName)
+			logger.Error("Script failed", logging.Error, execOut.Err)
 			if entity.ContinueOnFail {
 				continue
 			} else {
@@ -398,17 +725,59 @@ func executeEntityScripts(event config.Event) {
 			}
 
 		}
-		logMultilineScriptOutput(execOut.Combined, execOut.ScriptName)
+		logger.Info("Script finished")
 	}
 }
 
-func logMultilineScriptOutput(out string, script string) {
-	if out != "" {
-		for _, line := range strings.Split(out, "\n") {
-			if line == "" {
-				continue
-			}
-			log.Printf("[%s] %s\n", script, line)
+// interrupted returns why the event dispatch was interrupted or nil when it was not
+func interrupted(ctx context.Context) error {
+	if ctx.Err() == nil {
+		return nil
+	}
+	return fmt.Errorf("event dispatch was interrupted: %v", context.Cause(ctx))
+}
+
+func entityMatchesEvent(entity *config.Entity, event config.Event) bool {
+	if strings.ToLower(entity.Event) != event.Event {
+		return false
+	}
+	if !entity.ContainsDeviceType(event.DeviceType) {
+		return false
+	}
+	// Skip excluded mac addresses and networks
+	if entity.ContainsExcludedMacAddress(event.MacAddress) || entity.ContainsExcludedSSID(event.SSID) {
+		return false
+	}
+	if entity.ContainsExcludedConnection(event.ConnectionId, event.ConnectionUuid) {
+		return false
+	}
+	// empty included lists apply script on all networks
+	if entity.HasIncludedMacAddresses() && !entity.ContainsIncludedMacAddress(event.MacAddress) {
+		return false
+	}
+	if entity.HasIncludedSSIDs() && !entity.ContainsIncludedSSID(event.SSID) {
+		return false
+	}
+	if entity.HasIncludedBSSIDs() && !entity.ContainsIncludedBSSID(event.BSSID) {
+		return false
+	}
+	if entity.HasIncludedConnections() && !entity.ContainsIncludedConnection(event.ConnectionId, event.ConnectionUuid) {
+		return false
+	}
+	return true
+}
+
+// logMultilineScriptOutput logs every line of the script output stream as a separate record.
+// Stderr lines are logged at warn level, so they stand out in the journal
+func logMultilineScriptOutput(logger *slog.Logger, stream string, out string) {
+	level := slog.LevelInfo
+	if stream == logging.StreamStderr {
+		level = slog.LevelWarn
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
 		}
+		logger.Log(context.Background(), level, line, logging.Stream, stream)
 	}
 }
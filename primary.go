@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"network-dispatcher/config"
+	dbusapi "network-dispatcher/dbus_api"
+	"network-dispatcher/logging"
+	"time"
+)
+
+// Dispatched when default route with the lowest metric moves to another interface or gateway
+const PrimaryChanged = "primary-changed"
+
+// Queue of primary network changes, which might be caused by route updates of any device
+const primaryQueueKey = "primary"
+
+// Supported environment variables with the previous primary network of primary-changed event
+const DISPATCHER_PREVIOUS_INTERFACE = "DISPATCHER_PREVIOUS_INTERFACE"
+const DISPATCHER_PREVIOUS_GATEWAY = "DISPATCHER_PREVIOUS_GATEWAY"
+const DISPATCHER_PREVIOUS_GATEWAY_MACADDRESS = "DISPATCHER_PREVIOUS_GATEWAY_MACADDRESS"
+
+// onPrimaryMightChange is called on default route updates and NetworkManager PrimaryConnection changes.
+// Primary network is re-read from the routing table, so duplicate notifications are harmless
+func (d *networkDispatcher) onPrimaryMightChange() {
+	d.events.enqueue(deviceEvent{key: primaryQueueKey, event: PrimaryChanged, dispatch: func(context.Context) { d.dispatchPrimaryChanged() }})
+}
+
+// dispatchPrimaryChanged runs primary-changed entities when default route moved to another interface or gateway
+func (d *networkDispatcher) dispatchPrimaryChanged() {
+	primary := d.getPrimaryNetwork()
+	previous, changed := state.setPrimary(primary)
+	if !changed || primary == nil {
+		// no default route at all is reported by disconnected events
+		return
+	}
+	if previous == nil {
+		previous = &config.ConnectedGateway{}
+	}
+	slog.Info("Primary network changed", append(networkAttrs(primary),
+		"previous_interface", previous.Interface, "previous_gateway", previous.Gateway)...)
+	event := newEvent(primary, PrimaryChanged)
+	event.PreviousInterface = previous.Interface
+	event.PreviousGateway = previous.Gateway
+	event.PreviousMacAddress = previous.MacAddress
+	executeEntityScripts(event)
+}
+
+// syncPrimary remembers primary network without dispatching it, e.g. on startup
+func (d *networkDispatcher) syncPrimary() {
+	state.setPrimary(d.getPrimaryNetwork())
+}
+
+// getPrimaryNetwork returns network of the default route with the lowest metric. Nil when there is no default route
+func (d *networkDispatcher) getPrimaryNetwork() *config.ConnectedGateway {
+	route, err := d.routes.GetDefaultRoute()
+	if err != nil {
+		slog.Warn("Failed to get default route", logging.Error, err)
+		return nil
+	}
+	if route == nil {
+		return nil
+	}
+	// reuse details of the already connected network, e.g. ssid and connection profile
+	if network := state.findNetwork(route.Interface, ""); network != nil && network.Gateway == route.Gateway {
+		return network
+	}
+	primary := &config.ConnectedGateway{Interface: route.Interface, Gateway: route.Gateway, ConnectedAt: time.Now()}
+	if macAddress, err := d.getGatewayMacAddress(route.Gateway); err == nil {
+		primary.MacAddress = macAddress
+	} else {
+		slog.Warn("Failed to get macaddress of primary gateway", logging.Interface, route.Interface, logging.Gateway, route.Gateway, logging.Error, err)
+	}
+	if !d.nm.IsConnected() {
+		return primary
+	}
+	if netCard, err := d.nm.GetDeviceByInterfaceName(route.Interface); err == nil {
+		if deviceType, err := netCard.GetDeviceType(); err == nil {
+			primary.DeviceType = dbusapi.DeviceTypeName(deviceType)
+		}
+		primary.DevicePath = string(netCard.Path())
+	}
+	return primary
+}
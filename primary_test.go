@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	dbusapi "network-dispatcher/dbus_api"
+	"network-dispatcher/netlink_api"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const (
+	officeGateway = "10.0.0.1"
+	routerGateway = "192.168.1.254"
+	routerMac     = "dd:dd:dd:dd:dd:dd"
+)
+
+func TestDispatchPrimaryChanged(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(routes *netlink_api.FakeRoutes)
+		// dispatched events as "event interface mac"
+		wantEvents []string
+		// primary-changed script environment as "interface gateway mac previous_interface previous_gateway previous_mac"
+		wantEnv []string
+	}{
+		{
+			name: "default route moved to another interface",
+			change: func(routes *netlink_api.FakeRoutes) {
+				routes.AddRoute(netlink_api.DefaultRoute{Interface: "eth0", Gateway: officeGateway, Metric: 100})
+			},
+			wantEvents: []string{"primary-changed eth0 " + officeMac},
+			wantEnv:    []string{"eth0 " + officeGateway + " " + officeMac + " wlan0 " + homeGateway + " " + homeMac},
+		},
+		{
+			name: "gateway changed on the same interface",
+			change: func(routes *netlink_api.FakeRoutes) {
+				routes.RemoveRoutes("wlan0")
+				routes.AddRoute(netlink_api.DefaultRoute{Interface: "wlan0", Gateway: routerGateway, Metric: 600})
+			},
+			wantEvents: []string{"primary-changed wlan0 " + routerMac},
+			wantEnv:    []string{"wlan0 " + routerGateway + " " + routerMac + " wlan0 " + homeGateway + " " + homeMac},
+		},
+		{
+			name: "nothing changed",
+			change: func(routes *netlink_api.FakeRoutes) {
+				// route of not primary interface doesn't change the primary network
+				routes.AddRoute(netlink_api.DefaultRoute{Interface: "eth0", Gateway: officeGateway, Metric: 900})
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, nm, routes := newTestDispatcher(t)
+			dir := t.TempDir()
+			envLog := filepath.Join(dir, "env")
+			script := filepath.Join(dir, "primary.sh")
+			content := fmt.Sprintf("#!/bin/sh\necho \"$%s $%s $%s $%s $%s $%s\" >> %s\n", DISPATCHER_INTERFACE, DISPATCHER_GATEWAY, DISPATCHER_GATEWAY_MACADDRESS,
+				DISPATCHER_PREVIOUS_INTERFACE, DISPATCHER_PREVIOUS_GATEWAY, DISPATCHER_PREVIOUS_GATEWAY_MACADDRESS, envLog)
+			if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+				t.Fatal(err)
+			}
+			loadConfig(t, dir, fmt.Sprintf(`{"Entities": [{"Script": %q, "Event": "primary-changed", "DeviceTypes": ["wifi", "ethernet"]}]}`, script))
+			nm.SetDevice(homeWifi())
+			nm.SetDevice(dbusapi.FakeDevice{Path: ethernetPath, Interface: "eth0", DeviceType: dbusapi.NM_DEVICE_TYPE_ETHERNET,
+				State: dbusapi.NM_DEVICE_STATE_ACTIVATED, Ip4Gateway: officeGateway})
+			routes.SetNeighbour(officeGateway, officeMac)
+			routes.SetNeighbour(routerGateway, routerMac)
+			routes.AddRoute(netlink_api.DefaultRoute{Interface: "wlan0", Gateway: homeGateway, Metric: 600})
+			d.syncPrimary()
+
+			test.change(routes)
+			// duplicate notifications of the same change dispatch it once
+			d.onPrimaryMightChange()
+			d.onPrimaryMightChange()
+			d.events.wait()
+
+			if got := dispatchedEvents(); !slices.Equal(got, test.wantEvents) {
+				t.Errorf("dispatched events = %q, want %q", got, test.wantEvents)
+			}
+			logged, err := os.ReadFile(envLog)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			var env []string
+			if lines := strings.TrimSpace(string(logged)); lines != "" {
+				env = strings.Split(lines, "\n")
+			}
+			if !slices.Equal(env, test.wantEnv) {
+				t.Errorf("script environment = %q, want %q", env, test.wantEnv)
+			}
+		})
+	}
+}
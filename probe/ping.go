@@ -0,0 +1,93 @@
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	protocolICMP     = 1
+	protocolICMPIPv6 = 58
+)
+
+var pingSequence atomic.Uint32
+
+// errTimeout is returned by ping when no reply came before ctx deadline
+var errTimeout = errors.New("no reply before timeout")
+
+// ping sends single ICMP echo request and waits for the reply.
+//
+// Uses unprivileged ICMP socket allowed by net.ipv4.ping_group_range. Falls back to raw socket, which requires root
+func ping(ctx context.Context, host string) (string, error) {
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(addresses) == 0 {
+		return "", fmt.Errorf("%s has no addresses", host)
+	}
+	ip := addresses[0].IP
+
+	network, rawNetwork, listenAddress := "udp4", "ip4:icmp", "0.0.0.0"
+	var requestType, replyType icmp.Type = ipv4.ICMPTypeEcho, ipv4.ICMPTypeEchoReply
+	protocol := protocolICMP
+	if ip.To4() == nil {
+		network, rawNetwork, listenAddress = "udp6", "ip6:ipv6-icmp", "::"
+		requestType, replyType = ipv6.ICMPTypeEchoRequest, ipv6.ICMPTypeEchoReply
+		protocol = protocolICMPIPv6
+	}
+
+	var destination net.Addr = &net.UDPAddr{IP: ip}
+	conn, err := icmp.ListenPacket(network, listenAddress)
+	if err != nil {
+		if conn, err = icmp.ListenPacket(rawNetwork, listenAddress); err != nil {
+			return "", fmt.Errorf("failed to open icmp socket: %w", err)
+		}
+		destination = &net.IPAddr{IP: ip}
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// kernel replaces id of unprivileged sockets with the socket port, so replies are matched by sequence
+	id := os.Getpid() & 0xffff
+	sequence := int(pingSequence.Add(1) & 0xffff)
+	request := icmp.Message{Type: requestType, Body: &icmp.Echo{ID: id, Seq: sequence, Data: []byte(host)}}
+	data, err := request.Marshal(nil)
+	if err != nil {
+		return "", err
+	}
+	started := time.Now()
+	if _, err := conn.WriteTo(data, destination); err != nil {
+		return "", err
+	}
+
+	buffer := make([]byte, 1500)
+	for {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return "", fmt.Errorf("ping %s: %w", ip, errTimeout)
+			}
+			return "", err
+		}
+		reply, err := icmp.ParseMessage(protocol, buffer[:n])
+		if err != nil || reply.Type != replyType {
+			continue
+		}
+		if echo, ok := reply.Body.(*icmp.Echo); ok && echo.Seq == sequence {
+			return fmt.Sprintf("%s in %s", ip, time.Since(started).Round(time.Microsecond)), nil
+		}
+	}
+}
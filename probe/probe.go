@@ -0,0 +1,154 @@
+package probe
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Probe types
+const (
+	TypeTCP  = "tcp"
+	TypePing = "ping"
+	TypeDNS  = "dns"
+	TypeHTTP = "http"
+)
+
+var Types = []string{TypeTCP, TypePing, TypeDNS, TypeHTTP}
+
+// Pause between failed attempt and the next retry
+const retryDelay = 500 * time.Millisecond
+
+// Probe checks whether some host is reachable from the current network
+type Probe struct {
+	Type string
+	// host:port for tcp, host for ping, name for dns and url for http
+	Target string
+	// Address dns name must resolve to
+	ExpectedAddress string
+	// Status http GET must return
+	ExpectedStatus int
+	// Timeout of the single attempt
+	Timeout time.Duration
+	// Number of attempts after the first failed one
+	Retries int
+}
+
+// Result of the probe
+type Result struct {
+	Type     string
+	Target   string
+	Passed   bool
+	Attempts int
+	// Duration of the last attempt
+	Duration time.Duration
+	// What was observed, e.g. resolved addresses or http status
+	Detail string `json:",omitempty"`
+	Error  string `json:",omitempty"`
+}
+
+// Run runs probe attempts until one passes or retries are exhausted
+func (p *Probe) Run(ctx context.Context) Result {
+	result := Result{Type: p.Type, Target: p.Target}
+	for {
+		result.Attempts++
+		attemptCtx, cancel := context.WithTimeout(ctx, p.Timeout)
+		started := time.Now()
+		detail, err := p.attempt(attemptCtx)
+		cancel()
+		result.Duration = time.Since(started)
+		result.Detail = detail
+		if err == nil {
+			result.Passed = true
+			result.Error = ""
+			return result
+		}
+		result.Error = err.Error()
+		if result.Attempts > p.Retries {
+			return result
+		}
+		select {
+		case <-ctx.Done():
+			return result
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+func (p *Probe) attempt(ctx context.Context) (string, error) {
+	switch p.Type {
+	case TypeTCP:
+		return probeTCP(ctx, p.Target)
+	case TypePing:
+		return ping(ctx, p.Target)
+	case TypeDNS:
+		return probeDNS(ctx, p.Target, p.ExpectedAddress)
+	case TypeHTTP:
+		return probeHTTP(ctx, p.Target, p.ExpectedStatus, p.Timeout)
+	}
+	return "", fmt.Errorf("unsupported probe type %q", p.Type)
+}
+
+func probeTCP(ctx context.Context, address string) (string, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.RemoteAddr().String(), nil
+}
+
+func probeDNS(ctx context.Context, name string, expected string) (string, error) {
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	expectedIP := net.ParseIP(expected)
+	resolved := make([]string, 0, len(addresses))
+	found := false
+	for _, address := range addresses {
+		resolved = append(resolved, address.IP.String())
+		found = found || address.IP.Equal(expectedIP)
+	}
+	detail := strings.Join(resolved, ",")
+	if !found {
+		return detail, fmt.Errorf("%s resolved to %s, expected %s", name, detail, expected)
+	}
+	return detail, nil
+}
+
+// Probe connections are never reused, so every attempt checks the current network
+var httpTransport = &http.Transport{DisableKeepAlives: true}
+
+// newHTTPClient returns client which doesn't follow redirects,
+// so captive portal redirecting every request never passes the status check
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Transport: httpTransport,
+		Timeout:   timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func probeHTTP(ctx context.Context, url string, expectedStatus int, timeout time.Duration) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	response, err := newHTTPClient(timeout).Do(request)
+	if err != nil {
+		return "", err
+	}
+	response.Body.Close()
+	detail := response.Status
+	if response.StatusCode != expectedStatus {
+		return detail, fmt.Errorf("GET %s returned %s, expected %d", url, response.Status, expectedStatus)
+	}
+	return detail, nil
+}
@@ -0,0 +1,61 @@
+package probe
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPProbe(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/generate_204", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/portal", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/generate_204", http.StatusFound)
+	})
+	mux.HandleFunc("/hang", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		status     int
+		wantPassed bool
+		wantDetail string
+		wantError  string
+	}{
+		{name: "status matches", path: "/generate_204", status: http.StatusNoContent, wantPassed: true, wantDetail: "204 No Content"},
+		{name: "status differs", path: "/generate_204", status: http.StatusOK, wantDetail: "204 No Content", wantError: "expected 200"},
+		{name: "redirect is not followed", path: "/portal", status: http.StatusNoContent, wantDetail: "302 Found", wantError: "returned 302 Found"},
+		{name: "redirect is expected", path: "/portal", status: http.StatusFound, wantPassed: true, wantDetail: "302 Found"},
+		{name: "timeout", path: "/hang", status: http.StatusOK, wantError: "deadline exceeded"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := Probe{Type: TypeHTTP, Target: server.URL + test.path, ExpectedStatus: test.status, Timeout: 200 * time.Millisecond}
+			started := time.Now()
+			result := p.Run(context.Background())
+			if result.Passed != test.wantPassed || result.Detail != test.wantDetail {
+				t.Errorf("result = %+v, want passed %v with detail %q", result, test.wantPassed, test.wantDetail)
+			}
+			if !strings.Contains(result.Error, test.wantError) || (test.wantError == "") != (result.Error == "") {
+				t.Errorf("error = %q, want %q", result.Error, test.wantError)
+			}
+			if elapsed := time.Since(started); elapsed > 2*time.Second {
+				t.Errorf("probe took %s", elapsed)
+			}
+		})
+	}
+}
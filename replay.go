@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"network-dispatcher/config"
+	dbusapi "network-dispatcher/dbus_api"
+	"network-dispatcher/logging"
+	"network-dispatcher/trace"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// runReplay implements `network-dispatcher replay <file> [--config path] [--speed factor]`.
+//
+// Feeds signals of the trace recorded with --record through the same dispatch pipeline as the daemon does
+// and answers lookups with the recorded values, so field report could be reproduced on another machine
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configPath := flags.String("config", getConfigFilePath(), "Path to the configuration file. Its scripts are executed")
+	logLevel := flags.String("log-level", "info", "Minimal level of logged records: debug, info, warn or error")
+	logFormat := flags.String("log-format", logging.FormatText, "Format of logged records: text, json or journald")
+	speed := flags.Float64("speed", 1, "Replay speed factor. 0 dispatches every signal once events of the previous one are dispatched, so events are never coalesced or debounced")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay <trace file> [flags]\n", ApplicationName)
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		flags.Usage()
+		return 2
+	}
+	tracePath := args[0]
+	flags.Parse(args[1:])
+	if *speed < 0 {
+		fmt.Fprintln(os.Stderr, "--speed must not be negative")
+		return 2
+	}
+
+	if err := logging.Setup(*logLevel, *logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	configStore = config.NewStore(*configPath)
+	if err := configStore.Reload(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	recorded, err := trace.Load(tracePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load trace: %v\n", err)
+		return 1
+	}
+	if err := replayTrace(recorded, *speed); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("\nReplayed events:")
+	printEvents(os.Stdout, state.status().Events)
+	return 0
+}
+
+// replayTrace dispatches recorded signals with the recorded delays between them scaled by speed.
+// With zero speed every signal is dispatched once events of the previous one are dispatched.
+//
+// Returns once all events are dispatched, pending debounced disconnects are run right away
+func replayTrace(recorded *trace.Trace, speed float64) error {
+	signals := make([]*dbus.Signal, len(recorded.Signals))
+	for i, entry := range recorded.Signals {
+		signal, err := entry.DBusSignal()
+		if err != nil {
+			return err
+		}
+		signals[i] = signal
+	}
+
+	d := newNetworkDispatcher(recorded.NetworkManager(), recorded.Routes())
+	d.retry.delay = scaleDelay(d.retry.delay, speed)
+	dispatcher = d
+	d.syncOnStartup()
+
+	var background sync.WaitGroup
+	handlers := d.signalHandlers()
+	handlers.Go = func(handler func()) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			handler()
+		}()
+	}
+	started := time.Now()
+	for i, entry := range recorded.Signals {
+		if speed == 0 {
+			background.Wait()
+			d.events.wait()
+		} else {
+			time.Sleep(time.Until(started.Add(scaleDelay(entry.Time.Sub(recorded.Start), speed))))
+		}
+		if entry.Signal == trace.DefaultRouteChanged {
+			d.onPrimaryMightChange()
+			continue
+		}
+		c := make(chan *dbus.Signal, 1)
+		c <- signals[i]
+		close(c)
+		dbusapi.DispatchSignals(c, handlers)
+	}
+
+	background.Wait()
+	d.events.wait()
+	slog.Info("Trace is over. Run pending disconnect scripts")
+	disconnects.flush()
+	return nil
+}
+
+// scaleDelay shortens the recorded delay by the speed factor. Zero speed skips delays at all
+func scaleDelay(delay time.Duration, speed float64) time.Duration {
+	if speed == 0 {
+		return 0
+	}
+	return time.Duration(float64(delay) / speed)
+}
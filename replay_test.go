@@ -0,0 +1,80 @@
+package main
+
+import (
+	dbusapi "network-dispatcher/dbus_api"
+	"network-dispatcher/trace"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func stateChangedSignal(devicePath dbus.ObjectPath, state uint32, old uint32) *dbus.Signal {
+	return &dbus.Signal{Path: devicePath, Name: "org.freedesktop.NetworkManager.Device.StateChanged",
+		Body: []any{state, old, uint32(0)}}
+}
+
+func connectivitySignal(connectivity uint32) *dbus.Signal {
+	return &dbus.Signal{Path: "/org/freedesktop/NetworkManager", Name: "org.freedesktop.DBus.Properties.PropertiesChanged",
+		Body: []any{"org.freedesktop.NetworkManager", map[string]dbus.Variant{"Connectivity": dbus.MakeVariant(connectivity)}, []string{}}}
+}
+
+// dispatchSignal dispatches the signal the same way the signals loop does and waits until its events are dispatched
+func dispatchSignal(d *networkDispatcher, signal *dbus.Signal) {
+	c := make(chan *dbus.Signal, 1)
+	c <- signal
+	close(c)
+	dbusapi.DispatchSignals(c, d.signalHandlers())
+	d.events.wait()
+}
+
+// TestReplayReproducesRecordedEvents records signals dispatched against fake NetworkManager
+// and replays them on the clean daemon after devices are gone
+func TestReplayReproducesRecordedEvents(t *testing.T) {
+	d, nm, _ := newTestDispatcher(t)
+	tracePath := filepath.Join(t.TempDir(), "trace.jsonl")
+	recorder, err := trace.Create(tracePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.record(recorder)
+
+	// gateway is assigned a bit after activation
+	wifi := homeWifi()
+	wifi.Ip4Gateway = ""
+	nm.SetDevice(wifi)
+	assign := afterCalls(3, func() { nm.SetDevice(homeWifi()) })
+	nm.OnGet = func(path dbus.ObjectPath, property string) {
+		if property == "Ip4Config" {
+			assign()
+		}
+	}
+	d.syncOnStartup()
+	dispatchSignal(d, stateChangedSignal(wifiPath, dbusapi.NM_DEVICE_STATE_ACTIVATED, dbusapi.NM_DEVICE_STATE_DISCONNECTED))
+	dispatchSignal(d, connectivitySignal(dbusapi.NM_CONNECTIVITY_FULL))
+	nm.RemoveDevice(wifiPath)
+	dispatchSignal(d, stateChangedSignal(wifiPath, dbusapi.NM_DEVICE_STATE_DISCONNECTED, dbusapi.NM_DEVICE_STATE_ACTIVATED))
+	recorder.Close()
+
+	want := []string{"connected wlan0 " + homeMac, "connectivity-full wlan0 " + homeMac, "disconnected wlan0 " + homeMac}
+	if got := dispatchedEvents(); !slices.Equal(got, want) {
+		t.Fatalf("recorded events = %q, want %q", got, want)
+	}
+
+	// fakes of the new dispatcher are not used. Everything is answered from the trace
+	newTestDispatcher(t)
+	recorded, err := trace.Load(tracePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := replayTrace(recorded, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := dispatchedEvents(); !slices.Equal(got, want) {
+		t.Errorf("replayed events = %q, want %q", got, want)
+	}
+	if networks := savedNetworks(); len(networks) != 0 {
+		t.Errorf("saved networks = %q, want none", networks)
+	}
+}
@@ -0,0 +1,203 @@
+package shell
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Policy defines what happens when a script of the entity is started while its previous run is still running,
+// e.g. connected event comes again when mount script still retries to mount the share
+type Policy string
+
+const (
+	// Kill the previous run with its children processes and start the new one
+	PolicyKillPrevious Policy = "kill-previous"
+	// Wait for the previous run to finish and start the new one after it
+	PolicyQueue Policy = "queue"
+	// Keep the previous run and don't start the new one
+	PolicySkipIfRunning Policy = "skip-if-running"
+	// Start the new run next to the previous one
+	PolicyRunParallel Policy = "run-parallel"
+)
+
+const DefaultPolicy = PolicyKillPrevious
+
+var Policies = []Policy{PolicyKillPrevious, PolicyQueue, PolicySkipIfRunning, PolicyRunParallel}
+
+func IsValidPolicy(policy string) bool {
+	for _, p := range Policies {
+		if string(p) == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// Script process currently executed by the Executor
+type RunningScript struct {
+	// Identifies the entity script belongs to
+	Key        string
+	ScriptName string
+	Path       string
+	Pid        int
+	Started    time.Time
+}
+
+type process struct {
+	RunningScript
+	// killed by the next run of the same entity
+	killed bool
+}
+
+// queue serializes runs of the entity with PolicyQueue
+type queue struct {
+	sync.Mutex
+	// runs waiting for or holding the queue. Queue is removed when the last one leaves
+	users int
+}
+
+// Executor runs entity scripts and tracks them by entity key.
+//
+// Safe for concurrent use. Scripts of different entities never affect each other
+type Executor struct {
+	mu sync.Mutex
+	// runs of the entities including the reserved ones which are not started yet
+	running map[string][]*process
+	queues  map[string]*queue
+}
+
+func NewExecutor() *Executor {
+	return &Executor{running: map[string][]*process{}, queues: map[string]*queue{}}
+}
+
+// Execute runs the script of the entity identified by key and waits for it to finish.
+//
+// policy decides what to do with the previous run of the same entity if it's still running.
+// The run is reserved before the script is started, so concurrent runs of the entity always see each other
+func (e *Executor) Execute(key string, policy Policy, command string, envVars map[string]string, opts ExecOptions, args ...string) *ExecScriptOut {
+	if policy == PolicyQueue {
+		q := e.acquireQueue(key)
+		defer e.releaseQueue(key, q)
+	}
+	proc := &process{RunningScript: RunningScript{Key: key, ScriptName: filepath.Base(command), Path: command}}
+	if previous, skipped := e.reserve(proc, policy); skipped {
+		return &ExecScriptOut{
+			ScriptName: filepath.Base(command),
+			Skipped:    true,
+			Err:        skippedMessage(previous)}
+	}
+	output := runScript(command, envVars, opts, func(pid int) { e.started(proc, pid) }, args...)
+	if e.removeRunning(proc) {
+		output.Err = "Script was killed forcefully because next network event happen"
+	}
+	return output
+}
+
+// Running returns scripts which are currently executed ordered by start time
+func (e *Executor) Running() []RunningScript {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	scripts := []RunningScript{}
+	for _, processes := range e.running {
+		for _, proc := range processes {
+			// reserved run which script is not started yet
+			if proc.Pid == 0 {
+				continue
+			}
+			scripts = append(scripts, proc.RunningScript)
+		}
+	}
+	sort.Slice(scripts, func(i, j int) bool { return scripts[i].Started.Before(scripts[j].Started) })
+	return scripts
+}
+
+func skippedMessage(previous RunningScript) string {
+	if previous.Pid == 0 {
+		return "Script was skipped because its previous run is still starting"
+	}
+	return fmt.Sprintf("Script was skipped because its previous run pid %d is still running", previous.Pid)
+}
+
+func (e *Executor) acquireQueue(key string) *queue {
+	e.mu.Lock()
+	q, ok := e.queues[key]
+	if !ok {
+		q = &queue{}
+		e.queues[key] = q
+	}
+	q.users++
+	e.mu.Unlock()
+	q.Lock()
+	return q
+}
+
+func (e *Executor) releaseQueue(key string, q *queue) {
+	q.Unlock()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	q.users--
+	if q.users == 0 {
+		delete(e.queues, key)
+	}
+}
+
+// reserve adds the run of the entity before its script is started.
+//
+// Returns the previous run and true without reserving when it's still running and policy is PolicySkipIfRunning.
+// Previous runs are killed with PolicyKillPrevious
+func (e *Executor) reserve(proc *process, policy Policy) (RunningScript, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch policy {
+	case PolicySkipIfRunning:
+		if running := e.running[proc.Key]; len(running) > 0 {
+			return running[0].RunningScript, true
+		}
+	case PolicyQueue, PolicyRunParallel:
+	default:
+		// Forcefully kill the script from previous network event if it's still running
+		for _, previous := range e.running[proc.Key] {
+			if !previous.killed {
+				previous.killed = true
+				if previous.Pid != 0 {
+					killProcessGroup(previous.Pid)
+				}
+			}
+		}
+	}
+	e.running[proc.Key] = append(e.running[proc.Key], proc)
+	return RunningScript{}, false
+}
+
+// started records the pid of the reserved run. Run killed before its script started is killed right away
+func (e *Executor) started(proc *process, pid int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	proc.Pid = pid
+	proc.Started = time.Now()
+	if proc.killed {
+		killProcessGroup(pid)
+	}
+}
+
+// removeRunning returns true when the process was killed by the next run
+func (e *Executor) removeRunning(proc *process) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	processes := e.running[proc.Key]
+	for i, p := range processes {
+		if p == proc {
+			processes = append(processes[:i], processes[i+1:]...)
+			break
+		}
+	}
+	if len(processes) == 0 {
+		delete(e.running, proc.Key)
+	} else {
+		e.running[proc.Key] = processes
+	}
+	return proc.killed
+}
@@ -0,0 +1,206 @@
+package shell
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testScript writes script which logs its start and end into the returned log file and sleeps in between.
+// Arguments are the run name and sleep duration in seconds
+func testScript(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	script := filepath.Join(dir, "script.sh")
+	content := "#!/bin/sh\necho \"start $1\" >> " + log + "\nsleep $2\necho \"end $1\" >> " + log + "\n"
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return script, log
+}
+
+func readLog(t *testing.T, log string) []string {
+	content, err := os.ReadFile(log)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return strings.Fields(strings.ReplaceAll(string(content), " ", "-"))
+}
+
+// waitRunning waits until the executor runs the given number of scripts
+func waitRunning(t *testing.T, e *Executor, count int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(e.Running()) != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("running scripts = %+v, want %d", e.Running(), count)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestQueuePolicyRunsInOrder(t *testing.T) {
+	script, log := testScript(t)
+	e := NewExecutor()
+	var wg sync.WaitGroup
+	run := func(name string, sleep string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if out := e.Execute("entity", PolicyQueue, script, nil, ExecOptions{}, name, sleep); out.Err != "" {
+				t.Errorf("run %s failed: %s", name, out.Err)
+			}
+		}()
+	}
+	run("a", "0.2")
+	waitRunning(t, e, 1)
+	run("b", "0.05")
+	// b waits for the queue before c is started
+	time.Sleep(50 * time.Millisecond)
+	run("c", "0")
+	wg.Wait()
+
+	want := []string{"start-a", "end-a", "start-b", "end-b", "start-c", "end-c"}
+	if got := readLog(t, log); !slices.Equal(got, want) {
+		t.Errorf("log = %q, want %q", got, want)
+	}
+}
+
+func TestKillPreviousCancelsRunning(t *testing.T) {
+	script, log := testScript(t)
+	e := NewExecutor()
+	previous := make(chan *ExecScriptOut, 1)
+	started := time.Now()
+	go func() {
+		previous <- e.Execute("entity", PolicyKillPrevious, script, nil, ExecOptions{}, "a", "5")
+	}()
+	waitRunning(t, e, 1)
+
+	if out := e.Execute("entity", PolicyKillPrevious, script, nil, ExecOptions{}, "b", "0"); out.Err != "" {
+		t.Errorf("next run failed: %s", out.Err)
+	}
+	out := <-previous
+	if !strings.Contains(out.Err, "killed forcefully") {
+		t.Errorf("previous run error = %q, want killed", out.Err)
+	}
+	if elapsed := time.Since(started); elapsed > 4*time.Second {
+		t.Errorf("previous run took %s, want it killed", elapsed)
+	}
+	want := []string{"start-a", "start-b", "end-b"}
+	if got := readLog(t, log); !slices.Equal(got, want) {
+		t.Errorf("log = %q, want %q", got, want)
+	}
+	if running := e.Running(); len(running) != 0 {
+		t.Errorf("running scripts = %+v, want none", running)
+	}
+}
+
+func TestSkipIfRunningDropsNewRun(t *testing.T) {
+	script, log := testScript(t)
+	e := NewExecutor()
+	previous := make(chan *ExecScriptOut, 1)
+	go func() {
+		previous <- e.Execute("entity", PolicySkipIfRunning, script, nil, ExecOptions{}, "a", "0.3")
+	}()
+	waitRunning(t, e, 1)
+	pid := e.Running()[0].Pid
+
+	out := e.Execute("entity", PolicySkipIfRunning, script, nil, ExecOptions{}, "b", "0")
+	if !out.Skipped || out.Pid != 0 || !strings.Contains(out.Err, fmt.Sprintf("pid %d ", pid)) {
+		t.Errorf("second run = %+v, want skipped because of pid %d", out, pid)
+	}
+	if out := <-previous; out.Err != "" {
+		t.Errorf("previous run failed: %s", out.Err)
+	}
+	// runs again once the previous one finished
+	if out := e.Execute("entity", PolicySkipIfRunning, script, nil, ExecOptions{}, "c", "0"); out.Skipped || out.Err != "" {
+		t.Errorf("run after the previous one finished = %+v, want started", out)
+	}
+	want := []string{"start-a", "end-a", "start-c", "end-c"}
+	if got := readLog(t, log); !slices.Equal(got, want) {
+		t.Errorf("log = %q, want %q", got, want)
+	}
+}
+
+// runConcurrently starts runs of the same entity at once and returns their outputs
+func runConcurrently(e *Executor, policy Policy, script string, count int) []*ExecScriptOut {
+	outputs := make([]*ExecScriptOut, count)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range outputs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			outputs[i] = e.Execute("entity", policy, script, nil, ExecOptions{}, fmt.Sprint(i), "0.3")
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	return outputs
+}
+
+func TestSkipIfRunningStartsOneOfConcurrentRuns(t *testing.T) {
+	script, log := testScript(t)
+	e := NewExecutor()
+	outputs := runConcurrently(e, PolicySkipIfRunning, script, 10)
+
+	var started []*ExecScriptOut
+	for _, out := range outputs {
+		if !out.Skipped {
+			started = append(started, out)
+		}
+	}
+	if len(started) != 1 || started[0].Err != "" {
+		t.Fatalf("started runs = %+v, want exactly one", started)
+	}
+	if got := readLog(t, log); len(got) != 2 {
+		t.Errorf("log = %q, want exactly one run", got)
+	}
+}
+
+func TestKillPreviousKeepsOneOfConcurrentRuns(t *testing.T) {
+	script, log := testScript(t)
+	e := NewExecutor()
+	outputs := runConcurrently(e, PolicyKillPrevious, script, 10)
+
+	finished := 0
+	for _, out := range outputs {
+		if out.Err == "" {
+			finished++
+		} else if !strings.Contains(out.Err, "killed forcefully") {
+			t.Errorf("run error = %q, want killed", out.Err)
+		}
+	}
+	if finished != 1 {
+		t.Errorf("finished runs = %d, want exactly one", finished)
+	}
+	ended := 0
+	for _, line := range readLog(t, log) {
+		if strings.HasPrefix(line, "end-") {
+			ended++
+		}
+	}
+	if ended != 1 {
+		t.Errorf("log = %q, want exactly one run ended", readLog(t, log))
+	}
+	if running := e.Running(); len(running) != 0 {
+		t.Errorf("running scripts = %+v, want none", running)
+	}
+}
+
+func TestQueueIsRemovedOnceDrained(t *testing.T) {
+	script, _ := testScript(t)
+	e := NewExecutor()
+	runConcurrently(e, PolicyQueue, script, 3)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queues) != 0 || len(e.running) != 0 {
+		t.Errorf("queues = %v, running = %v, want none", e.queues, e.running)
+	}
+}
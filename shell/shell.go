@@ -2,12 +2,15 @@ package shell
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"network-dispatcher/logging"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"syscall"
+	"time"
 )
 
 type ExecScriptOut struct {
@@ -16,17 +19,29 @@ type ExecScriptOut struct {
 	Out        string
 	Combined   string
 	ErrOut     string
+	Pid        int
+	Started    time.Time
+	Duration   time.Duration
+	// Script was terminated because it didn't finish within ExecOptions.Timeout
+	TimedOut bool
+	// Script was not started because previous run of the same entity was still running. See PolicySkipIfRunning
+	Skipped bool
 }
 
-// Holds the running pid of the process triggered by currently running script
-//
-// It could be a script from previous nextwork event.
-// In that case current network event will kill it forcefully
-// and update runningProcessPid with script from current network event
-var runningProcessPid int
-
-// Holds the last process killed forcefully
-var killedProcessPid int
+// Default time between SIGTERM and SIGKILL sent to the timed out script
+const DefaultKillGracePeriod = 5 * time.Second
+
+type ExecOptions struct {
+	// Script is terminated when it runs longer. Zero waits forever
+	Timeout time.Duration
+	// Time given to the script to exit after SIGTERM before it's killed with SIGKILL.
+	// DefaultKillGracePeriod when zero
+	KillGracePeriod time.Duration
+	// Logger of the script lifecycle records, e.g. with the entity fields. slog.Default when nil
+	Logger *slog.Logger
+	// Script with its process group is killed once the context is done. Optional
+	Context context.Context
+}
 
 func ExecuteScriptOld(command string, envVars map[string]string, args ...string) *ExecScriptOut {
 	cmd := exec.Command(command, args...)
@@ -64,10 +79,15 @@ func ExecuteScriptOld(command string, envVars map[string]string, args ...string)
 		Err:        errString}
 }
 
-func setRunningProcessPid(pid int) {
-	runningProcessPid = pid
+func (opts ExecOptions) logger() *slog.Logger {
+	if opts.Logger == nil {
+		return slog.Default()
+	}
+	return opts.Logger
 }
-func killPreviousRunningScript(pid int) {
+
+// killProcessGroup kills the script and all the children processes it started
+func killProcessGroup(pid int) {
 	pgid, err := syscall.Getpgid(pid)
 	if err == nil {
 		// Kill the entire process group
@@ -75,83 +95,109 @@ func killPreviousRunningScript(pid int) {
 	}
 }
 
-func ExecuteScript(command string, envVars map[string]string, args ...string) *ExecScriptOut {
-	outputChan := make(chan *ExecScriptOut)
-	pidChan := make(chan int)
-
-	// Forcefully kill the script from previous network event if it's still running
-	if runningProcessPid != 0 {
-		killPreviousRunningScript(runningProcessPid)
-		killedProcessPid = runningProcessPid
+// waitWithTimeout waits for the script to finish.
+//
+// When timeout expires sends SIGTERM to the whole script process group and SIGKILL after the grace period.
+// Processes of the group still running once the script exited are killed too.
+// The process group is killed right away when opts.Context is done.
+// Returns true when script was terminated due to timeout
+func waitWithTimeout(cmd *exec.Cmd, opts ExecOptions) (bool, error) {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var cancelled <-chan struct{}
+	if opts.Context != nil {
+		cancelled = opts.Context.Done()
+	}
+	var timeout <-chan time.Time
+	if opts.Timeout > 0 {
+		timer := time.NewTimer(opts.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err := <-done:
+		return false, err
+	case <-cancelled:
+		opts.logger().Warn("Script is interrupted. Kill it", "reason", context.Cause(opts.Context), logging.Pid, cmd.Process.Pid)
+		killProcessGroup(cmd.Process.Pid)
+		<-done
+		return false, fmt.Errorf("script was killed: %v", context.Cause(opts.Context))
+	case <-timeout:
 	}
-	log.Println("Execute dispatch script " + command)
-
-	go func() {
-		var outb, errb bytes.Buffer
 
-		cmd := exec.Command(command, args...)
-		cmd.Env = os.Environ()
+	gracePeriod := opts.KillGracePeriod
+	if gracePeriod <= 0 {
+		gracePeriod = DefaultKillGracePeriod
+	}
+	// script is started in its own process group, so pgid is the script pid
+	pgid := cmd.Process.Pid
+	opts.logger().Warn("Script timed out. Terminate it", "timeout", opts.Timeout, logging.Pid, pgid)
+	syscall.Kill(-pgid, syscall.SIGTERM)
+	select {
+	case err := <-done:
+		// children which ignore SIGTERM must not outlive the timed out script
+		syscall.Kill(-pgid, syscall.SIGKILL)
+		return true, err
+	case <-time.After(gracePeriod):
+	}
+	opts.logger().Warn("Script did not exit after SIGTERM. Kill it", "grace_period", gracePeriod, logging.Pid, pgid)
+	syscall.Kill(-pgid, syscall.SIGKILL)
+	return true, <-done
+}
 
-		for key, value := range envVars {
-			keyvalue := fmt.Sprintf("%s=%s", key, value)
-			cmd.Env = append(cmd.Env, keyvalue)
-		}
+// runScript executes the script and waits for it to finish.
+//
+// onStart is called with the script pid right after it's started
+func runScript(command string, envVars map[string]string, opts ExecOptions, onStart func(pid int), args ...string) *ExecScriptOut {
+	opts.logger().Info("Execute dispatch script", "path", command)
+	started := time.Now()
+	var outb, errb bytes.Buffer
 
-		// Set output to Byte Buffers
-		if cmd.Stdout != nil || cmd.Stderr != nil {
-			outputChan <- &ExecScriptOut{
-				ScriptName: filepath.Base(command),
-				Err:        "Stdout/StdErr already set"}
-			return
-		}
+	cmd := exec.Command(command, args...)
+	cmd.Env = os.Environ()
 
-		cmd.Stdout = &outb
-		cmd.Stderr = &errb
-		// Create a new process group to allow kill to kill
-		// all the children process might start
-		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-
-		createExecScriptOut := func(err error) *ExecScriptOut {
-			errString := ""
-			if err != nil {
-				errString = err.Error()
-			}
-			return &ExecScriptOut{
-				ScriptName: filepath.Base(command),
-				Out:        outb.String(),
-				ErrOut:     errb.String(),
-				Combined:   outb.String() + "\n" + errb.String(),
-				Err:        errString}
-		}
+	for key, value := range envVars {
+		keyvalue := fmt.Sprintf("%s=%s", key, value)
+		cmd.Env = append(cmd.Env, keyvalue)
+	}
 
-		err := cmd.Start()
+	cmd.Stdout = &outb
+	cmd.Stderr = &errb
+	// Create a new process group to allow kill to kill
+	// all the children process might start
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-		//  some fatal error on starting a script
-		if err != nil {
-			outputChan <- createExecScriptOut(err)
-			return
-		}
-		pidChan <- cmd.Process.Pid
-		err = cmd.Wait()
-		// script execution error
+	createExecScriptOut := func(err error) *ExecScriptOut {
+		errString := ""
 		if err != nil {
-			outputChan <- createExecScriptOut(err)
-			return
+			errString = err.Error()
 		}
-		outputChan <- createExecScriptOut(nil)
-	}()
-	var runningProcessPid int
-	for {
-		select {
-		case pid := <-pidChan:
-			runningProcessPid = pid
-			setRunningProcessPid(pid)
-		case output := <-outputChan:
-			if runningProcessPid > 0 && runningProcessPid == killedProcessPid {
-				output.Err = "Script was killed forcefully because next network event happen"
-			}
-			setRunningProcessPid(0)
-			return output
+		pid := 0
+		if cmd.Process != nil {
+			pid = cmd.Process.Pid
 		}
+		return &ExecScriptOut{
+			ScriptName: filepath.Base(command),
+			Out:        outb.String(),
+			ErrOut:     errb.String(),
+			Combined:   outb.String() + "\n" + errb.String(),
+			Err:        errString,
+			Pid:        pid,
+			Started:    started,
+			Duration:   time.Since(started)}
+	}
+
+	//  some fatal error on starting a script
+	if err := cmd.Start(); err != nil {
+		return createExecScriptOut(err)
+	}
+	onStart(cmd.Process.Pid)
+	timedOut, err := waitWithTimeout(cmd, opts)
+	if timedOut {
+		output := createExecScriptOut(fmt.Errorf("script timed out after %s", opts.Timeout))
+		output.TimedOut = true
+		return output
 	}
+	// script execution error
+	return createExecScriptOut(err)
 }
@@ -0,0 +1,113 @@
+package shell
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// childScript writes script which starts background child, writes its pid into the returned file and waits.
+//
+// body runs before the child is started
+func childScript(t *testing.T, body string, child string) (string, string) {
+	dir := t.TempDir()
+	pids := filepath.Join(dir, "pids")
+	script := filepath.Join(dir, "script.sh")
+	content := "#!/bin/sh\n" + body + "\n" + child + " &\necho $! > " + pids + "\nwhile true; do sleep 0.05; done\n"
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return script, pids
+}
+
+// processAlive tells whether process exists and is not a zombie waiting to be reaped
+func processAlive(pid int) bool {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	// state follows the command name in parentheses, which might contain spaces
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+// assertNoChildren checks that the script child written into pids file is gone
+func assertNoChildren(t *testing.T, pids string) {
+	t.Helper()
+	content, err := os.ReadFile(pids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			t.Errorf("child pid %d is still running", pid)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForFile waits until the script writes the file
+func waitForFile(t *testing.T, path string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if content, err := os.ReadFile(path); err == nil && len(content) > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is not written", path)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTimedOutScriptExitsOnTerm(t *testing.T) {
+	script, pids := childScript(t, "", "sleep 60")
+	opts := ExecOptions{Timeout: 200 * time.Millisecond, KillGracePeriod: 10 * time.Second}
+	out := runScript(script, nil, opts, func(int) {})
+	if !out.TimedOut || !strings.Contains(out.Err, "timed out after 200ms") {
+		t.Errorf("output = %+v, want timed out", out)
+	}
+	// exits on SIGTERM long before the grace period passes
+	if out.Duration > 5*time.Second {
+		t.Errorf("script ran %s, want it terminated by SIGTERM", out.Duration)
+	}
+	waitForFile(t, pids)
+	assertNoChildren(t, pids)
+}
+
+func TestTimedOutScriptIgnoringTermIsKilled(t *testing.T) {
+	// ignored signal is inherited by the child too
+	script, pids := childScript(t, "trap '' TERM", "sleep 60")
+	opts := ExecOptions{Timeout: 200 * time.Millisecond, KillGracePeriod: 300 * time.Millisecond}
+	out := runScript(script, nil, opts, func(int) {})
+	if !out.TimedOut || !strings.Contains(out.Err, "timed out after 200ms") {
+		t.Errorf("output = %+v, want timed out", out)
+	}
+	if out.Duration < 500*time.Millisecond {
+		t.Errorf("script ran %s, want it killed only after the grace period", out.Duration)
+	}
+	waitForFile(t, pids)
+	assertNoChildren(t, pids)
+}
+
+func TestTimedOutScriptLeavesNoChildIgnoringTerm(t *testing.T) {
+	// child doesn't hold script output, so script exits right after SIGTERM
+	script, pids := childScript(t, "", "(trap '' TERM; exec sleep 60) > /dev/null 2>&1")
+	opts := ExecOptions{Timeout: 200 * time.Millisecond, KillGracePeriod: 10 * time.Second}
+	out := runScript(script, nil, opts, func(int) {})
+	if !out.TimedOut || out.Duration > 5*time.Second {
+		t.Errorf("output = %+v, want terminated by SIGTERM", out)
+	}
+	waitForFile(t, pids)
+	assertNoChildren(t, pids)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"network-dispatcher/config"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// runSimulate implements `network-dispatcher simulate <event> --mac <mac> --gateway <ip> [--dry-run]`.
+//
+// Dispatches synthetic event through the same filters and scripts as the real network events,
+// so new entities could be tested without leaving the network
+func runSimulate(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	configPath := flags.String("config", getConfigFilePath(), "Path to the configuration file")
+	event := config.Event{}
+	flags.StringVar(&event.MacAddress, "mac", "", "Gateway mac address")
+	flags.StringVar(&event.Gateway, "gateway", "", "Gateway ip address")
+	flags.StringVar(&event.SSID, "ssid", "", "Wifi network name")
+	flags.StringVar(&event.BSSID, "bssid", "", "Wifi access point mac address")
+	flags.StringVar(&event.ConnectionId, "connection", "", "NetworkManager connection profile name")
+	flags.StringVar(&event.ConnectionUuid, "connection-uuid", "", "NetworkManager connection profile UUID")
+	flags.StringVar(&event.DeviceType, "device-type", config.DefaultDeviceTypes[0], "NetworkManager device type, e.g. wifi or ethernet")
+	flags.StringVar(&event.Interface, "interface", "", "Network interface name")
+	dryRun := flags.Bool("dry-run", false, "Only print matching entities and their environment without running scripts")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s simulate <%s> [flags]\n", ApplicationName, strings.Join(config.SupportedEvents, "|"))
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		flags.Usage()
+		return 2
+	}
+	event.Event = strings.ToLower(args[0])
+	flags.Parse(args[1:])
+	if !config.IsSupportedEvent(event.Event) {
+		fmt.Fprintf(os.Stderr, "Unsupported event %q. Supported events: %s\n", event.Event, strings.Join(config.SupportedEvents, ", "))
+		return 2
+	}
+
+	configStore = config.NewStore(*configPath)
+	if err := configStore.Reload(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if !*dryRun {
+		executeEntityScripts(event)
+		interrupted := make(chan os.Signal, 1)
+		signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(interrupted)
+		stopTunnelsOn(interrupted)
+		return 0
+	}
+
+	entities := getMatchingEntities(event)
+	if len(entities) == 0 {
+		fmt.Printf("No entities match %s event\n", event.Event)
+		return 0
+	}
+	for i, entity := range entities {
+		if entity.Action == config.ActionSSHTunnel {
+			fmt.Printf("%d. built-in %s action. Without --dry-run the tunnel runs until simulate is interrupted\n", i+1, entity.Action)
+			continue
+		}
+		if entity.Action != "" {
+			fmt.Printf("%d. built-in %s action\n", i+1, entity.Action)
+			continue
+		}
+		fmt.Printf("%d. %s\n", i+1, os.ExpandEnv(entity.Script))
+		envVars := getScriptEnvVariables(&entity.Entity, event)
+		keys := make([]string, 0, len(envVars))
+		for key := range envVars {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("   %s=%s\n", key, envVars[key])
+		}
+	}
+	fmt.Println("Scripts also inherit the network-dispatcher environment")
+	return 0
+}
+
+// stopTunnelsOn keeps ssh tunnels started by the simulated event until the signal and stops them explicitly.
+// Tunnels live only as long as the process, so they would be gone right after simulate returns
+func stopTunnelsOn(signals <-chan os.Signal) {
+	running := tunnels.Status()
+	if len(running) == 0 {
+		return
+	}
+	names := make([]string, 0, len(running))
+	for _, tunnel := range running {
+		names = append(names, tunnel.Name)
+	}
+	fmt.Printf("ssh tunnels %s run only while simulate runs. Press Ctrl+C to stop them\n", strings.Join(names, ", "))
+	<-signals
+	for _, name := range names {
+		tunnels.Stop(name)
+		fmt.Printf("ssh tunnel %s stopped\n", name)
+	}
+}
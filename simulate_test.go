@@ -0,0 +1,34 @@
+package main
+
+import (
+	"network-dispatcher/config"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSimulateStopsTunnelsOnSignal(t *testing.T) {
+	tunnel := connectingTunnel(t)
+	runSSHTunnel(tunnel, config.Event{Event: Connected})
+	defer tunnels.Stop(tunnel.Name)
+
+	signals := make(chan os.Signal, 1)
+	stopped := make(chan struct{})
+	go func() {
+		stopTunnelsOn(signals)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("tunnels are stopped before the signal")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if status := tunnels.Status(); len(status) != 1 {
+		t.Errorf("tunnels = %+v, want running tunnel", status)
+	}
+	signals <- os.Interrupt
+	<-stopped
+	if status := tunnels.Status(); len(status) != 0 {
+		t.Errorf("tunnels = %+v, want all stopped", status)
+	}
+}
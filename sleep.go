@@ -0,0 +1,94 @@
+package main
+
+import (
+	"log/slog"
+	dbusapi "network-dispatcher/dbus_api"
+	"network-dispatcher/logging"
+	"os"
+	"sync"
+	"time"
+)
+
+// Delay inhibitor lock which gives disconnect scripts time to run before the system is suspended
+var sleepLock struct {
+	sync.Mutex
+	file *os.File
+}
+
+// Default logind InhibitDelayMaxSec used when it can't be read from logind
+const defaultSleepDelay = 5 * time.Second
+
+// takeSleepLock takes new sleep inhibitor lock and releases the previous one.
+//
+// Previous lock is stale after resume, logind restart or bus reconnect, so it's always replaced
+func takeSleepLock() {
+	sleepLock.Lock()
+	defer sleepLock.Unlock()
+	file, err := dbusapi.InhibitSleep("Run disconnect scripts, e.g. unmount network shares")
+	if err != nil {
+		slog.Warn("Failed to take sleep inhibitor lock. Disconnect scripts might not finish before suspend", logging.Error, err)
+	}
+	if sleepLock.file != nil {
+		if err := sleepLock.file.Close(); err != nil {
+			slog.Warn("Failed to release stale sleep inhibitor lock", logging.Error, err)
+		}
+	}
+	sleepLock.file = file
+}
+
+func releaseSleepLock() {
+	sleepLock.Lock()
+	defer sleepLock.Unlock()
+	if sleepLock.file == nil {
+		return
+	}
+	if err := sleepLock.file.Close(); err != nil {
+		slog.Warn("Failed to release sleep inhibitor lock", logging.Error, err)
+	}
+	sleepLock.file = nil
+}
+
+// onPrepareForSleep runs disconnect scripts for all connected networks before suspend.
+//
+// NetworkManager disconnect signal often arrives only after resume, when it's too late,
+// e.g. hung cifs share already blocks file managers.
+// After resume networks are connected again the same way as after NetworkManager restart
+func (d *networkDispatcher) onPrepareForSleep(sleeping bool) {
+	if !sleeping {
+		slog.Info("System resumed from sleep. Resync network state")
+		takeSleepLock()
+		d.reconcileNetworks()
+		return
+	}
+	slog.Info("System is going to sleep. Run disconnect scripts")
+	defer releaseSleepLock()
+	// logind doesn't delay sleep longer than InhibitDelayMaxSec anyway
+	delay := d.sleepDelay()
+	deadline := time.After(delay)
+	// disconnects are queued after pending events of the device, so they never run next to its connect scripts.
+	// Removed network will not run disconnect scripts again on NetworkManager disconnect signal
+	var disconnected []<-chan struct{}
+	for _, network := range state.getNetworks() {
+		disconnected = append(disconnected, d.events.pushDisconnectedNetwork(network))
+	}
+	for _, done := range disconnected {
+		select {
+		case <-done:
+		case <-deadline:
+			slog.Warn("Disconnect scripts did not finish before sleep. Release sleep inhibitor lock", "delay", delay)
+			return
+		}
+	}
+	// shares must be unmounted before suspend even if network might come back after resume
+	disconnects.flush()
+}
+
+// logindSleepDelay returns how long logind delays sleep for the inhibitor lock
+func logindSleepDelay() time.Duration {
+	delay, err := dbusapi.InhibitDelayMax()
+	if err != nil || delay <= 0 {
+		slog.Debug("Failed to read logind InhibitDelayMaxSec. Use default", "default", defaultSleepDelay, logging.Error, err)
+		return defaultSleepDelay
+	}
+	return delay
+}
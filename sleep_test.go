@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"network-dispatcher/config"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestPrepareForSleepWaitsForDeviceQueue checks that sleep disconnect runs after the connect of the same device
+// and that the sleep lock is released only once disconnect scripts finished
+func TestPrepareForSleepWaitsForDeviceQueue(t *testing.T) {
+	d, _, _ := newTestDispatcher(t)
+	state.setNetwork(config.ConnectedGateway{Interface: "wlan0", DevicePath: string(wifiPath), DeviceType: "wifi", Gateway: homeGateway, MacAddress: homeMac})
+	connecting, release := make(chan struct{}), make(chan struct{})
+	d.events.enqueue(deviceEvent{key: string(wifiPath), event: Connected, dispatch: func(context.Context) {
+		close(connecting)
+		<-release
+	}})
+	<-connecting
+
+	slept := make(chan struct{})
+	go func() {
+		d.onPrepareForSleep(true)
+		close(slept)
+	}()
+	select {
+	case <-slept:
+		t.Fatal("sleep didn't wait for the connect of the device")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := dispatchedEvents(); len(got) != 0 {
+		t.Fatalf("dispatched events while connect runs = %q, want none", got)
+	}
+
+	close(release)
+	select {
+	case <-slept:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sleep didn't finish")
+	}
+	want := []string{"disconnected wlan0 " + homeMac}
+	if got := dispatchedEvents(); !slices.Equal(got, want) {
+		t.Errorf("dispatched events = %q, want %q", got, want)
+	}
+	if got := savedNetworks(); len(got) != 0 {
+		t.Errorf("saved networks = %q, want none", got)
+	}
+}
+
+// TestPrepareForSleepIsBoundedByInhibitDelay checks that hung connect of the device doesn't hold sleep forever
+func TestPrepareForSleepIsBoundedByInhibitDelay(t *testing.T) {
+	d, _, _ := newTestDispatcher(t)
+	d.sleepDelay = func() time.Duration { return 100 * time.Millisecond }
+	state.setNetwork(config.ConnectedGateway{Interface: "wlan0", DevicePath: string(wifiPath), DeviceType: "wifi", Gateway: homeGateway, MacAddress: homeMac})
+	connecting, release := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(release)
+		d.events.wait()
+	}()
+	d.events.enqueue(deviceEvent{key: string(wifiPath), event: Connected, dispatch: func(context.Context) {
+		close(connecting)
+		<-release
+	}})
+	<-connecting
+
+	slept := make(chan struct{})
+	go func() {
+		d.onPrepareForSleep(true)
+		close(slept)
+	}()
+	select {
+	case <-slept:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sleep waits for the hung connect longer than inhibit delay")
+	}
+}
@@ -0,0 +1,433 @@
+package sshtunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"network-dispatcher/logging"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Tunnel connection states reported in Status
+const (
+	StateConnecting = "connecting"
+	StateConnected  = "connected"
+	StateStopped    = "stopped"
+)
+
+const (
+	minReconnectDelay = time.Second
+	maxReconnectDelay = time.Minute
+	dialTimeout       = 15 * time.Second
+)
+
+// Forward is a local port forwarded to the address on the ssh server side
+type Forward struct {
+	// Local listen address, e.g. 127.0.0.1:4445
+	Local string
+	// Address dialed by the ssh server, e.g. 127.0.0.1:445
+	Remote string
+}
+
+type Options struct {
+	// Identifies the tunnel in the Manager
+	Name string
+	// ssh server host:port
+	Address string
+	User    string
+	// Path to the private key
+	KeyFile string
+	// Path to the known_hosts file used to verify server host key
+	KnownHostsFile string
+	Forwards       []Forward
+	// Interval of keepalive requests
+	KeepaliveInterval time.Duration
+	// Connection is restarted after so many unanswered keepalives
+	KeepaliveCountMax int
+}
+
+// Status of the tunnel reported to the daemon
+type Status struct {
+	Name     string
+	Address  string
+	User     string
+	Forwards []string
+	State    string
+	// Time the current connection was established. Zero when not connected
+	ConnectedSince time.Time `json:",omitempty"`
+	Reconnects     int
+	LastError      string `json:",omitempty"`
+}
+
+// Manager keeps tunnels by their names. Safe for concurrent use
+type Manager struct {
+	mu      sync.Mutex
+	tunnels map[string]*Tunnel
+}
+
+func NewManager() *Manager {
+	return &Manager{tunnels: map[string]*Tunnel{}}
+}
+
+// Start starts the tunnel and waits until it's connected.
+//
+// Tunnel already started with the same options is kept as is, otherwise it's restarted with the new options.
+// Returns error when local ports could not be bound or tunnel did not connect within timeout.
+// Tunnel keeps reconnecting in background in the last case until it's stopped
+func (m *Manager) Start(opts Options, timeout time.Duration) error {
+	m.mu.Lock()
+	t, ok := m.tunnels[opts.Name]
+	for ok && !reflect.DeepEqual(t.opts, opts) {
+		slog.Info("ssh tunnel options changed. Restart it", "tunnel", opts.Name)
+		delete(m.tunnels, opts.Name)
+		// stop waits for the run loop, other tunnels must not wait for it
+		m.mu.Unlock()
+		t.stop()
+		m.mu.Lock()
+		// might be started again meanwhile
+		t, ok = m.tunnels[opts.Name]
+	}
+	if !ok {
+		var err error
+		if t, err = startTunnel(opts); err != nil {
+			m.mu.Unlock()
+			return err
+		}
+		m.tunnels[opts.Name] = t
+	}
+	m.mu.Unlock()
+	return t.waitConnected(timeout)
+}
+
+// Stop stops the tunnel and closes all connections forwarded through it.
+// Returns false when tunnel was not running
+func (m *Manager) Stop(name string) bool {
+	m.mu.Lock()
+	t, ok := m.tunnels[name]
+	delete(m.tunnels, name)
+	m.mu.Unlock()
+	if ok {
+		t.stop()
+	}
+	return ok
+}
+
+// Status returns status of all tunnels sorted by name
+func (m *Manager) Status() []Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	statuses := make([]Status, 0, len(m.tunnels))
+	for _, t := range m.tunnels {
+		statuses = append(statuses, t.getStatus())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// Tunnel keeps ssh connection alive and forwards local ports through it
+type Tunnel struct {
+	opts      Options
+	ctx       context.Context
+	cancel    context.CancelFunc
+	listeners []net.Listener
+	// closed when run loop exited
+	done chan struct{}
+
+	mu     sync.Mutex
+	client *ssh.Client
+	// closed when tunnel is connected. Replaced with the new one on disconnect
+	connected chan struct{}
+	status    Status
+	// forwarded connections closed on stop
+	conns map[io.Closer]struct{}
+}
+
+// startTunnel binds local ports and starts connecting in background.
+// Fails right away when any of the ports is busy, like ssh ExitOnForwardFailure
+func startTunnel(opts Options) (*Tunnel, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &Tunnel{
+		opts:      opts,
+		ctx:       ctx,
+		cancel:    cancel,
+		done:      make(chan struct{}),
+		connected: make(chan struct{}),
+		conns:     map[io.Closer]struct{}{},
+		status:    Status{Name: opts.Name, Address: opts.Address, User: opts.User, State: StateConnecting}}
+	for _, forward := range opts.Forwards {
+		t.status.Forwards = append(t.status.Forwards, forward.Local+" -> "+forward.Remote)
+		listener, err := net.Listen("tcp", forward.Local)
+		if err != nil {
+			cancel()
+			for _, l := range t.listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on %s for ssh tunnel %s: %w", forward.Local, opts.Name, err)
+		}
+		t.listeners = append(t.listeners, listener)
+	}
+	for i, listener := range t.listeners {
+		go t.serve(listener, opts.Forwards[i].Remote)
+	}
+	go t.run()
+	return t, nil
+}
+
+func (t *Tunnel) waitConnected(timeout time.Duration) error {
+	t.mu.Lock()
+	connected := t.connected
+	t.mu.Unlock()
+	select {
+	case <-connected:
+		return nil
+	case <-t.ctx.Done():
+		return fmt.Errorf("ssh tunnel %s was stopped", t.opts.Name)
+	case <-time.After(timeout):
+		status := t.getStatus()
+		return fmt.Errorf("ssh tunnel %s did not connect within %s: %s", t.opts.Name, timeout, status.LastError)
+	}
+}
+
+// run connects to the server and reconnects with backoff until tunnel is stopped
+func (t *Tunnel) run() {
+	defer close(t.done)
+	delay := minReconnectDelay
+	for {
+		client, err := t.dial()
+		if err == nil {
+			delay = minReconnectDelay
+			slog.Info("ssh tunnel connected", "tunnel", t.opts.Name, "address", t.opts.Address)
+			t.setClient(client)
+			err = t.keepAlive(client)
+			t.setClient(nil)
+			client.Close()
+		}
+		if t.ctx.Err() != nil {
+			return
+		}
+		slog.Warn("ssh tunnel failed. Reconnecting", "tunnel", t.opts.Name, "retry_in", delay, logging.Error, err)
+		t.setError(err)
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxReconnectDelay)
+	}
+}
+
+func (t *Tunnel) dial() (*ssh.Client, error) {
+	key, err := os.ReadFile(t.opts.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key %s: %w", t.opts.KeyFile, err)
+	}
+	hostKeyCallback, err := knownhosts.New(t.opts.KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts: %w", err)
+	}
+	conf := &ssh.ClientConfig{
+		User:            t.opts.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback}
+
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(t.ctx, "tcp", t.opts.Address)
+	if err != nil {
+		return nil, err
+	}
+	// handshake ignores ClientConfig.Timeout on the dialed connection, so server which accepted tcp connection
+	// but never answers would hang it forever. Stopped tunnel closes the connection as well
+	conn.SetDeadline(time.Now().Add(dialTimeout))
+	closeOnStop := context.AfterFunc(t.ctx, func() { conn.Close() })
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, t.opts.Address, conf)
+	if !closeOnStop() {
+		if err == nil {
+			sshConn.Close()
+		}
+		return nil, fmt.Errorf("ssh tunnel %s was stopped", t.opts.Name)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(sshConn, channels, requests), nil
+}
+
+// keepAlive sends keepalive requests until connection is lost or tunnel is stopped
+func (t *Tunnel) keepAlive(client *ssh.Client) error {
+	closed := make(chan error, 1)
+	go func() { closed <- client.Wait() }()
+	ticker := time.NewTicker(t.opts.KeepaliveInterval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-t.ctx.Done():
+			return nil
+		case err := <-closed:
+			return fmt.Errorf("connection closed: %v", err)
+		case <-ticker.C:
+			if t.sendKeepalive(client) {
+				missed = 0
+				continue
+			}
+			missed++
+			if missed >= t.opts.KeepaliveCountMax {
+				return fmt.Errorf("server did not answer %d keepalives", missed)
+			}
+		}
+	}
+}
+
+// sendKeepalive returns true when server answered within keepalive interval.
+// Any answer counts, OpenSSH replies to unknown requests with failure
+func (t *Tunnel) sendKeepalive(client *ssh.Client) bool {
+	answered := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		answered <- err
+	}()
+	select {
+	case err := <-answered:
+		return err == nil
+	case <-time.After(t.opts.KeepaliveInterval):
+		return false
+	}
+}
+
+// serve forwards connections accepted on the local port until listener is closed
+func (t *Tunnel) serve(listener net.Listener, remote string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Warn("ssh tunnel stopped accepting connections", "tunnel", t.opts.Name, "address", listener.Addr(), logging.Error, err)
+			}
+			return
+		}
+		go t.forward(conn, remote)
+	}
+}
+
+func (t *Tunnel) forward(local net.Conn, remote string) {
+	defer local.Close()
+	t.mu.Lock()
+	client := t.client
+	t.mu.Unlock()
+	if client == nil {
+		// not connected right now. Client retries the same way as with ssh
+		return
+	}
+	remoteConn, err := client.Dial("tcp", remote)
+	if err != nil {
+		slog.Warn("ssh tunnel failed to connect to the forwarded address", "tunnel", t.opts.Name, "address", remote, logging.Error, err)
+		return
+	}
+	defer remoteConn.Close()
+	if !t.track(local, remoteConn) {
+		return
+	}
+	defer t.untrack(local, remoteConn)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remoteConn, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remoteConn)
+		done <- struct{}{}
+	}()
+	// either side closed the connection. Deferred close stops the other direction
+	<-done
+}
+
+// track remembers forwarded connections to close them on stop. Returns false when tunnel is already stopped
+func (t *Tunnel) track(conns ...io.Closer) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.ctx.Err() != nil {
+		return false
+	}
+	for _, conn := range conns {
+		t.conns[conn] = struct{}{}
+	}
+	return true
+}
+
+func (t *Tunnel) untrack(conns ...io.Closer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, conn := range conns {
+		delete(t.conns, conn)
+	}
+}
+
+func (t *Tunnel) setClient(client *ssh.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.client = client
+	if client != nil {
+		t.status.State = StateConnected
+		t.status.ConnectedSince = time.Now()
+		t.status.LastError = ""
+		close(t.connected)
+		return
+	}
+	t.status.State = StateConnecting
+	t.status.ConnectedSince = time.Time{}
+	if t.ctx.Err() == nil {
+		t.status.Reconnects++
+	}
+	t.connected = make(chan struct{})
+}
+
+func (t *Tunnel) setError(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.status.LastError = err.Error()
+}
+
+func (t *Tunnel) getStatus() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.status
+}
+
+// stop closes listeners, ssh connection and all forwarded connections. Waits for the run loop to exit
+func (t *Tunnel) stop() {
+	t.cancel()
+	for _, listener := range t.listeners {
+		listener.Close()
+	}
+	t.mu.Lock()
+	if t.client != nil {
+		t.client.Close()
+	}
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+	<-t.done
+
+	t.mu.Lock()
+	t.status.State = StateStopped
+	t.status.ConnectedSince = time.Time{}
+	t.mu.Unlock()
+	slog.Info("ssh tunnel stopped", "tunnel", t.opts.Name)
+}
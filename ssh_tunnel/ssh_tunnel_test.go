@@ -0,0 +1,330 @@
+package sshtunnel
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testServer is in-process ssh server which accepts the test client key and serves direct-tcpip channels
+type testServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.Signer
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newTestServer(t *testing.T, clientKey ssh.PublicKey) *testServer {
+	hostKey, err := ssh.NewSignerFromKey(newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if string(key.Marshal()) != string(clientKey.Marshal()) {
+			return nil, errors.New("unknown key")
+		}
+		return nil, nil
+	}}
+	config.AddHostKey(hostKey)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{listener: listener, config: config, hostKey: hostKey}
+	t.Cleanup(func() {
+		listener.Close()
+		s.drop()
+	})
+	go s.serve()
+	return s
+}
+
+func (s *testServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *testServer) handle(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip is supported")
+			continue
+		}
+		var target struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		remote, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			remote.Close()
+			continue
+		}
+		go ssh.DiscardRequests(channelRequests)
+		go func() {
+			defer channel.Close()
+			defer remote.Close()
+			go io.Copy(remote, channel)
+			io.Copy(channel, remote)
+		}()
+	}
+}
+
+// drop closes all accepted connections, like restarted server
+func (s *testServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+// newEchoServer returns address of the tcp server which sends back everything it receives
+func newEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// freeAddress returns local address nobody listens on
+func freeAddress(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// testOptions writes client key and known_hosts with the host key into the temporary directory
+func testOptions(t *testing.T, address string, hostKey ssh.PublicKey, clientKey ed25519.PrivateKey, remote string) Options {
+	dir := t.TempDir()
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, hostKey)
+	if err := os.WriteFile(knownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return Options{Name: "test", Address: address, User: "user", KeyFile: keyFile, KnownHostsFile: knownHostsFile,
+		Forwards:          []Forward{{Local: freeAddress(t), Remote: remote}},
+		KeepaliveInterval: time.Second, KeepaliveCountMax: 3}
+}
+
+// echo sends the message through the local forward and returns the answer
+func echo(t *testing.T, local string, message string) string {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", local, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(message)); err != nil {
+		t.Fatal(err)
+	}
+	answer := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		t.Fatalf("failed to read the answer through the tunnel: %v", err)
+	}
+	return string(answer)
+}
+
+// newTestTunnel starts the server with the echo service behind it and returns tunnel options forwarding to it
+func newTestTunnel(t *testing.T) (*testServer, Options) {
+	clientKey := newKey(t)
+	clientPublicKey, err := ssh.NewPublicKey(clientKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t, clientPublicKey)
+	return server, testOptions(t, server.addr(), server.hostKey.PublicKey(), clientKey, newEchoServer(t))
+}
+
+func TestLocalForward(t *testing.T) {
+	_, opts := newTestTunnel(t)
+	m := NewManager()
+	if err := m.Start(opts, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop(opts.Name)
+
+	if got := echo(t, opts.Forwards[0].Local, "ping"); got != "ping" {
+		t.Errorf("answer = %q, want ping", got)
+	}
+	status := m.Status()
+	if len(status) != 1 || status[0].State != StateConnected {
+		t.Errorf("status = %+v, want connected tunnel", status)
+	}
+
+	if !m.Stop(opts.Name) {
+		t.Error("Stop() of the running tunnel returned false")
+	}
+	if _, err := net.DialTimeout("tcp", opts.Forwards[0].Local, time.Second); err == nil {
+		t.Error("local port is still open after stop")
+	}
+}
+
+func TestReconnectAfterServerDrops(t *testing.T) {
+	server, opts := newTestTunnel(t)
+	m := NewManager()
+	if err := m.Start(opts, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop(opts.Name)
+
+	server.drop()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		status := m.Status()[0]
+		if status.Reconnects == 1 && status.State == StateConnected {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("tunnel did not reconnect: %+v", status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got := echo(t, opts.Forwards[0].Local, "after reconnect"); got != "after reconnect" {
+		t.Errorf("answer = %q, want the same message", got)
+	}
+}
+
+func TestStopDuringHandshake(t *testing.T) {
+	// accepts tcp connections and never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var accepted net.Conn
+	handshake := make(chan struct{})
+	go func() {
+		var err error
+		if accepted, err = listener.Accept(); err == nil {
+			close(handshake)
+		}
+	}()
+	clientKey := newKey(t)
+	hostKey, err := ssh.NewSignerFromKey(newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions(t, listener.Addr().String(), hostKey.PublicKey(), clientKey, "127.0.0.1:1")
+	m := NewManager()
+	if err := m.Start(opts, 100*time.Millisecond); err == nil {
+		t.Fatal("Start() succeeded against server which never answers")
+	}
+	<-handshake
+	defer accepted.Close()
+
+	stopped := make(chan struct{})
+	go func() {
+		m.Stop(opts.Name)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Stop() hangs while tunnel waits for the handshake")
+	}
+}
+
+func TestKnownHostsRejection(t *testing.T) {
+	server, opts := newTestTunnel(t)
+	otherHostKey, err := ssh.NewSignerFromKey(newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(server.addr())}, otherHostKey.PublicKey())
+	if err := os.WriteFile(opts.KnownHostsFile, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	m := NewManager()
+	defer m.Stop(opts.Name)
+
+	err = m.Start(opts, 500*time.Millisecond)
+	if err == nil {
+		t.Fatal("Start() succeeded with host key missing in known_hosts")
+	}
+	status := m.Status()[0]
+	if !strings.Contains(err.Error(), "key mismatch") || !strings.Contains(status.LastError, "key mismatch") {
+		t.Errorf("Start() error = %v, last error %q, want host key mismatch", err, status.LastError)
+	}
+	if status.State != StateConnecting {
+		t.Errorf("state = %s, want %s", status.State, StateConnecting)
+	}
+}
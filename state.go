@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"network-dispatcher/config"
+	"network-dispatcher/logging"
+	"network-dispatcher/shell"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of the last dispatched events kept for the status command
+const maxEventHistory = 20
+
+// Script executed for the dispatched event
+type scriptRun struct {
+	Script   string
+	Pid      int
+	Started  time.Time
+	Duration time.Duration
+	Err      string `json:",omitempty"`
+	TimedOut bool   `json:",omitempty"`
+	Skipped  bool   `json:",omitempty"`
+	// Structured result of the built-in action
+	Result any `json:",omitempty"`
+}
+
+// Network event dispatched to the entities
+type eventRecord struct {
+	Time    time.Time
+	Event   config.Event
+	Scripts []scriptRun
+}
+
+// daemonState is the live daemon state reported by the status command
+type daemonState struct {
+	mu      sync.Mutex
+	started time.Time
+	// connected networks keyed by interface name
+	networks map[string]config.ConnectedGateway
+	// file to persist networks into. Networks are kept only in memory when empty
+	networksFilePath string
+	events           []*eventRecord
+	// the last known NetworkManager connectivity, e.g. full or portal
+	connectivity string
+	// network of the default route with the lowest metric. Nil when there is no default route
+	primary *config.ConnectedGateway
+}
+
+var state = newDaemonState()
+
+func newDaemonState() *daemonState {
+	return &daemonState{started: time.Now(), networks: map[string]config.ConnectedGateway{}}
+}
+
+// setNetwork remembers network connected on the interface to use it later in the disconnect event
+func (s *daemonState) setNetwork(gateway config.ConnectedGateway) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.networks[gateway.Interface] = gateway
+	s.saveNetworks()
+}
+
+// removeNetwork forgets network of disconnected device and returns it.
+//
+// Device is looked up by its dbus path first since interface name is not always available for removed devices,
+// e.g. unplugged usb wifi dongle. Returns nil when nothing was connected on the device
+func (s *daemonState) removeNetwork(ifName string, devicePath string) *config.ConnectedGateway {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, found := s.findNetworkKey(ifName, devicePath)
+	if !found {
+		return nil
+	}
+	gateway := s.networks[key]
+	delete(s.networks, key)
+	s.saveNetworks()
+	return &gateway
+}
+
+// findNetwork returns network connected on the device or nil
+func (s *daemonState) findNetwork(ifName string, devicePath string) *config.ConnectedGateway {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, found := s.findNetworkKey(ifName, devicePath)
+	if !found {
+		return nil
+	}
+	gateway := s.networks[key]
+	return &gateway
+}
+
+// Must be called with s.mu held
+func (s *daemonState) findNetworkKey(ifName string, devicePath string) (string, bool) {
+	for name, gateway := range s.networks {
+		if devicePath != "" && gateway.DevicePath == devicePath {
+			return name, true
+		}
+	}
+	_, found := s.networks[ifName]
+	return ifName, found
+}
+
+func (s *daemonState) getNetworks() []config.ConnectedGateway {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedNetworks()
+}
+
+func (s *daemonState) sortedNetworks() []config.ConnectedGateway {
+	networks := make([]config.ConnectedGateway, 0, len(s.networks))
+	for _, gateway := range s.networks {
+		networks = append(networks, gateway)
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].Interface < networks[j].Interface })
+	return networks
+}
+
+// saveNetworks persists connected networks so they could be inspected outside of the daemon.
+// Must be called with s.mu held
+func (s *daemonState) saveNetworks() {
+	if s.networksFilePath == "" {
+		return
+	}
+	content, err := json.MarshalIndent(s.networks, "", " ")
+	if err != nil {
+		slog.Error("Failed to save connected networks", logging.Error, err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(s.networksFilePath), 0755); err != nil {
+		slog.Error("Failed to save connected networks", logging.Error, err)
+		return
+	}
+	// write to temp file first to never leave half written state
+	tmpPath := s.networksFilePath + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		slog.Error("Failed to save connected networks", logging.Error, err)
+		return
+	}
+	if err := os.Rename(tmpPath, s.networksFilePath); err != nil {
+		slog.Error("Failed to save connected networks", logging.Error, err)
+	}
+}
+
+// setConnectivity remembers NetworkManager connectivity. Returns false when it did not change
+func (s *daemonState) setConnectivity(connectivity string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.connectivity == connectivity {
+		return false
+	}
+	s.connectivity = connectivity
+	return true
+}
+
+// setPrimary remembers primary network. Returns the previous one and whether interface or gateway changed
+func (s *daemonState) setPrimary(primary *config.ConnectedGateway) (*config.ConnectedGateway, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	previous := s.primary
+	s.primary = primary
+	if previous == nil || primary == nil {
+		return previous, previous != primary
+	}
+	return previous, previous.Interface != primary.Interface || previous.Gateway != primary.Gateway
+}
+
+// addEvent records dispatched event. Returned record is updated with scripts through addScriptRun
+func (s *daemonState) addEvent(event config.Event) *eventRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := &eventRecord{Time: time.Now(), Event: event}
+	s.events = append(s.events, record)
+	if len(s.events) > maxEventHistory {
+		s.events = s.events[len(s.events)-maxEventHistory:]
+	}
+	return record
+}
+
+func (s *daemonState) addScriptRun(record *eventRecord, execOut *shell.ExecScriptOut, result any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record.Scripts = append(record.Scripts, scriptRun{
+		Script:   execOut.ScriptName,
+		Pid:      execOut.Pid,
+		Started:  execOut.Started,
+		Duration: execOut.Duration,
+		Err:      execOut.Err,
+		TimedOut: execOut.TimedOut,
+		Skipped:  execOut.Skipped,
+		Result:   result})
+}
+
+// status makes a consistent copy of the state
+func (s *daemonState) status() *daemonStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := &daemonStatus{
+		Started:          s.started,
+		ConfigPath:       configStore.Path(),
+		ConfigGeneration: configStore.Generation(),
+		RunningScripts:   executor.Running(),
+		Networks:         s.sortedNetworks(),
+		Connectivity:     s.connectivity,
+		Primary:          s.primary,
+		Events:           make([]eventRecord, 0, len(s.events)),
+	}
+	for _, record := range s.events {
+		copied := *record
+		copied.Scripts = append([]scriptRun(nil), record.Scripts...)
+		status.Events = append(status.Events, copied)
+	}
+	return status
+}
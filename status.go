@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"network-dispatcher/config"
+	"network-dispatcher/control"
+	"network-dispatcher/shell"
+	sshtunnel "network-dispatcher/ssh_tunnel"
+	"os"
+	"strings"
+	"time"
+)
+
+const statusCommand = "status"
+
+// daemonStatus is returned by the status command of the control socket
+type daemonStatus struct {
+	Pid              int
+	Started          time.Time
+	ConfigPath       string
+	ConfigGeneration uint64
+	Networks         []config.ConnectedGateway
+	Connectivity     string                   `json:",omitempty"`
+	Primary          *config.ConnectedGateway `json:",omitempty"`
+	RunningScripts   []shell.RunningScript
+	Tunnels          []sshtunnel.Status
+	Events           []eventRecord
+}
+
+func serveControlSocket(path string) error {
+	return control.Serve(path, func(command string) (any, error) {
+		switch command {
+		case statusCommand:
+			status := state.status()
+			status.Pid = os.Getpid()
+			status.Tunnels = tunnels.Status()
+			return status, nil
+		default:
+			return nil, fmt.Errorf("unknown command %q", command)
+		}
+	})
+}
+
+// runStatus implements `network-dispatcher status [--json] [--socket path]`
+func runStatus(args []string) int {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	socketPath := flags.String("socket", control.DefaultSocketPath(), "Path to the daemon control socket")
+	asJson := flags.Bool("json", false, "Print raw json status")
+	flags.Parse(args)
+
+	data, err := control.Request(*socketPath, statusCommand)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *asJson {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, data, "", "  "); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(indented.String())
+		return 0
+	}
+	status := daemonStatus{}
+	if err := json.Unmarshal(data, &status); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse status: %v\n", err)
+		return 1
+	}
+	printStatus(os.Stdout, &status)
+	return 0
+}
+
+func printStatus(w io.Writer, status *daemonStatus) {
+	now := time.Now()
+	fmt.Fprintf(w, "%s pid %d, running since %s (%s)\n", ApplicationName, status.Pid,
+		status.Started.Format(time.DateTime), now.Sub(status.Started).Round(time.Second))
+	fmt.Fprintf(w, "Config: %s (generation %d)\n", status.ConfigPath, status.ConfigGeneration)
+
+	if status.Primary != nil {
+		fmt.Fprintf(w, "Primary: %s %s\n", status.Primary.Interface, status.Primary)
+	}
+	if status.Connectivity != "" {
+		fmt.Fprintf(w, "Connectivity: %s\n", status.Connectivity)
+	}
+
+	fmt.Fprintln(w, "\nNetworks:")
+	if len(status.Networks) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, network := range status.Networks {
+		fmt.Fprintf(w, "  %-10s %-9s since %s    %s\n", network.Interface, network.DeviceType,
+			network.ConnectedAt.Format(time.DateTime), network)
+	}
+
+	fmt.Fprintln(w, "\nRunning scripts:")
+	if len(status.RunningScripts) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, script := range status.RunningScripts {
+		fmt.Fprintf(w, "  pid %-8d %s started %s (%s ago)\n", script.Pid, script.Path,
+			script.Started.Format(time.TimeOnly), now.Sub(script.Started).Round(time.Second))
+	}
+
+	fmt.Fprintln(w, "\nSsh tunnels:")
+	if len(status.Tunnels) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, tunnel := range status.Tunnels {
+		fmt.Fprintf(w, "  %s %s", tunnel.Name, tunnel.State)
+		if !tunnel.ConnectedSince.IsZero() {
+			fmt.Fprintf(w, " since %s", tunnel.ConnectedSince.Format(time.DateTime))
+		}
+		fmt.Fprintf(w, ", %d reconnects\n", tunnel.Reconnects)
+		for _, forward := range tunnel.Forwards {
+			fmt.Fprintf(w, "      %s\n", forward)
+		}
+		if tunnel.LastError != "" {
+			fmt.Fprintf(w, "      last error: %s\n", tunnel.LastError)
+		}
+	}
+
+	fmt.Fprintln(w, "\nLast events:")
+	printEvents(w, status.Events)
+}
+
+// printEvents prints dispatched events with their scripts
+func printEvents(w io.Writer, events []eventRecord) {
+	if len(events) == 0 {
+		fmt.Fprintln(w, "  none")
+	}
+	for _, record := range events {
+		event := record.Event
+		fmt.Fprintf(w, "  %s %-12s %-10s gateway %s %s", record.Time.Format(time.DateTime), event.Event,
+			event.Interface, event.Gateway, event.MacAddress)
+		if event.SSID != "" {
+			fmt.Fprintf(w, " ssid %q", event.SSID)
+		}
+		fmt.Fprintln(w)
+		if len(record.Scripts) == 0 {
+			fmt.Fprintln(w, "      no matching scripts")
+		}
+		for _, run := range record.Scripts {
+			result := "ok"
+			if run.Skipped {
+				result = "skipped: " + strings.SplitN(run.Err, "\n", 2)[0]
+			} else if run.TimedOut {
+				result = "timed out"
+			} else if run.Err != "" {
+				result = "failed: " + strings.SplitN(run.Err, "\n", 2)[0]
+			}
+			fmt.Fprintf(w, "      %s pid %d %s in %s\n", run.Script, run.Pid, result, run.Duration.Round(time.Millisecond))
+			if run.Result != nil {
+				details, _ := json.Marshal(run.Result)
+				fmt.Fprintf(w, "        %s\n", details)
+			}
+		}
+	}
+}
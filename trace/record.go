@@ -0,0 +1,227 @@
+package trace
+
+import (
+	dbusapi "network-dispatcher/dbus_api"
+	"network-dispatcher/netlink_api"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Query names. Object lookups record path of the returned object, so replay could answer its properties
+const (
+	queryIsConnected         = "NetworkManager.IsConnected"
+	queryDeviceByIpIface     = "NetworkManager.GetDeviceByIpIface"
+	queryDevices             = "NetworkManager.GetDevices"
+	queryConnectivity        = "NetworkManager.Connectivity"
+	queryState               = "Device.State"
+	queryDeviceType          = "Device.DeviceType"
+	queryInterface           = "Device.Interface"
+	queryIp4Config           = "Device.Ip4Config"
+	queryIp6Config           = "Device.Ip6Config"
+	queryActiveAccessPoint   = "Device.ActiveAccessPoint"
+	queryActiveConnection    = "Device.ActiveConnection"
+	queryGateway             = "IpConfig.Gateway"
+	querySsid                = "AccessPoint.Ssid"
+	queryBssid               = "AccessPoint.HwAddress"
+	queryConnectionId        = "ActiveConnection.Id"
+	queryConnectionUuid      = "ActiveConnection.Uuid"
+	queryConnectionType      = "ActiveConnection.Type"
+	queryDefaultRoute        = "Routes.GetDefaultRoute"
+	queryDefaultGateways     = "Routes.GetDefaultGateways"
+	queryNeighbourMacAddress = "Routes.GetNeighbourMacAddress"
+	queryDeviceTypeName      = "Routes.GetDeviceType"
+)
+
+// RecordNetworkManager records results of all lookups made through nm
+func RecordNetworkManager(nm dbusapi.NetworkManager, r *Recorder) dbusapi.NetworkManager {
+	return &recordingNetworkManager{nm: nm, r: r}
+}
+
+// RecordRoutes records results of all lookups made through routes
+func RecordRoutes(routes netlink_api.Routes, r *Recorder) netlink_api.Routes {
+	return &recordingRoutes{routes: routes, r: r}
+}
+
+type recordingNetworkManager struct {
+	nm dbusapi.NetworkManager
+	r  *Recorder
+}
+
+func (n *recordingNetworkManager) IsConnected() bool {
+	connected, _ := query(n.r, queryIsConnected, "", "", n.nm.IsConnected(), nil)
+	return connected
+}
+
+func (n *recordingNetworkManager) Device(path dbus.ObjectPath) dbusapi.Device {
+	return &recordingDevice{device: n.nm.Device(path), r: n.r}
+}
+
+func (n *recordingNetworkManager) GetDeviceByInterfaceName(name string) (dbusapi.Device, error) {
+	device, err := n.nm.GetDeviceByInterfaceName(name)
+	var path dbus.ObjectPath
+	if err == nil {
+		path = device.Path()
+	}
+	query(n.r, queryDeviceByIpIface, "", name, path, err)
+	if err != nil {
+		return nil, err
+	}
+	return &recordingDevice{device: device, r: n.r}, nil
+}
+
+func (n *recordingNetworkManager) GetDevicePaths() ([]dbus.ObjectPath, error) {
+	paths, err := n.nm.GetDevicePaths()
+	return query(n.r, queryDevices, "", "", paths, err)
+}
+
+func (n *recordingNetworkManager) GetConnectivity() (uint32, error) {
+	connectivity, err := n.nm.GetConnectivity()
+	return query(n.r, queryConnectivity, "", "", connectivity, err)
+}
+
+type recordingDevice struct {
+	device dbusapi.Device
+	r      *Recorder
+}
+
+func (d *recordingDevice) Path() dbus.ObjectPath {
+	return d.device.Path()
+}
+
+func (d *recordingDevice) GetState() (uint32, error) {
+	state, err := d.device.GetState()
+	return query(d.r, queryState, d.Path(), "", state, err)
+}
+
+func (d *recordingDevice) GetDeviceType() (uint32, error) {
+	deviceType, err := d.device.GetDeviceType()
+	return query(d.r, queryDeviceType, d.Path(), "", deviceType, err)
+}
+
+func (d *recordingDevice) GetInterfaceName() (string, error) {
+	name, err := d.device.GetInterfaceName()
+	return query(d.r, queryInterface, d.Path(), "", name, err)
+}
+
+func (d *recordingDevice) Ip4Config() (dbusapi.IpConfig, error) {
+	config, err := d.device.Ip4Config()
+	if d.recordObject(queryIp4Config, config, err); err != nil {
+		return nil, err
+	}
+	return &recordingIpConfig{config: config, r: d.r}, nil
+}
+
+func (d *recordingDevice) Ip6Config() (dbusapi.IpConfig, error) {
+	config, err := d.device.Ip6Config()
+	if d.recordObject(queryIp6Config, config, err); err != nil {
+		return nil, err
+	}
+	return &recordingIpConfig{config: config, r: d.r}, nil
+}
+
+func (d *recordingDevice) ActiveAccessPoint() (dbusapi.AccessPoint, error) {
+	accessPoint, err := d.device.ActiveAccessPoint()
+	if d.recordObject(queryActiveAccessPoint, accessPoint, err); err != nil {
+		return nil, err
+	}
+	return &recordingAccessPoint{accessPoint: accessPoint, r: d.r}, nil
+}
+
+func (d *recordingDevice) ActiveConnection() (dbusapi.ActiveConnection, error) {
+	connection, err := d.device.ActiveConnection()
+	if d.recordObject(queryActiveConnection, connection, err); err != nil {
+		return nil, err
+	}
+	return &recordingActiveConnection{connection: connection, r: d.r}, nil
+}
+
+// recordObject records path of the device object, e.g. IP4Config
+func (d *recordingDevice) recordObject(name string, object interface{ Path() dbus.ObjectPath }, err error) {
+	var path dbus.ObjectPath
+	if err == nil {
+		path = object.Path()
+	}
+	query(d.r, name, d.Path(), "", path, err)
+}
+
+type recordingIpConfig struct {
+	config dbusapi.IpConfig
+	r      *Recorder
+}
+
+func (c *recordingIpConfig) Path() dbus.ObjectPath {
+	return c.config.Path()
+}
+
+func (c *recordingIpConfig) Gateway() (string, error) {
+	gateway, err := c.config.Gateway()
+	return query(c.r, queryGateway, c.Path(), "", gateway, err)
+}
+
+type recordingAccessPoint struct {
+	accessPoint dbusapi.AccessPoint
+	r           *Recorder
+}
+
+func (a *recordingAccessPoint) Path() dbus.ObjectPath {
+	return a.accessPoint.Path()
+}
+
+func (a *recordingAccessPoint) Ssid() (string, error) {
+	ssid, err := a.accessPoint.Ssid()
+	return query(a.r, querySsid, a.Path(), "", ssid, err)
+}
+
+func (a *recordingAccessPoint) Bssid() (string, error) {
+	bssid, err := a.accessPoint.Bssid()
+	return query(a.r, queryBssid, a.Path(), "", bssid, err)
+}
+
+type recordingActiveConnection struct {
+	connection dbusapi.ActiveConnection
+	r          *Recorder
+}
+
+func (a *recordingActiveConnection) Path() dbus.ObjectPath {
+	return a.connection.Path()
+}
+
+func (a *recordingActiveConnection) Id() (string, error) {
+	id, err := a.connection.Id()
+	return query(a.r, queryConnectionId, a.Path(), "", id, err)
+}
+
+func (a *recordingActiveConnection) Uuid() (string, error) {
+	uuid, err := a.connection.Uuid()
+	return query(a.r, queryConnectionUuid, a.Path(), "", uuid, err)
+}
+
+func (a *recordingActiveConnection) Type() (string, error) {
+	connectionType, err := a.connection.Type()
+	return query(a.r, queryConnectionType, a.Path(), "", connectionType, err)
+}
+
+type recordingRoutes struct {
+	routes netlink_api.Routes
+	r      *Recorder
+}
+
+func (n *recordingRoutes) GetDefaultRoute() (*netlink_api.DefaultRoute, error) {
+	route, err := n.routes.GetDefaultRoute()
+	return query(n.r, queryDefaultRoute, "", "", route, err)
+}
+
+func (n *recordingRoutes) GetDefaultGateways() (map[string]string, error) {
+	gateways, err := n.routes.GetDefaultGateways()
+	return query(n.r, queryDefaultGateways, "", "", gateways, err)
+}
+
+func (n *recordingRoutes) GetNeighbourMacAddress(ip string) (string, error) {
+	macAddress, err := n.routes.GetNeighbourMacAddress(ip)
+	return query(n.r, queryNeighbourMacAddress, "", ip, macAddress, err)
+}
+
+func (n *recordingRoutes) GetDeviceType(ifName string) string {
+	deviceType, _ := query(n.r, queryDeviceTypeName, "", ifName, n.routes.GetDeviceType(ifName), nil)
+	return deviceType
+}
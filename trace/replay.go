@@ -0,0 +1,238 @@
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	dbusapi "network-dispatcher/dbus_api"
+	"network-dispatcher/netlink_api"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Trace lines could be long, e.g. GetDevices of the host with many veth interfaces
+const maxEntrySize = 1024 * 1024
+
+// Trace is recorded trace loaded for replay
+type Trace struct {
+	// Time of the first entry, which is daemon start
+	Start time.Time
+	// Signals in the order they were received, including DefaultRouteChanged ones
+	Signals []Entry
+	mu      sync.Mutex
+	// recorded lookup results in the order they were made
+	answers map[answerKey][]Entry
+}
+
+type answerKey struct {
+	query string
+	path  dbus.ObjectPath
+	arg   string
+}
+
+func (k answerKey) String() string {
+	if k.path != "" {
+		return fmt.Sprintf("%s of %s", k.query, k.path)
+	}
+	if k.arg != "" {
+		return fmt.Sprintf("%s of %s", k.query, k.arg)
+	}
+	return k.query
+}
+
+// Load reads trace written by Recorder
+func Load(path string) (*Trace, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	t := &Trace{answers: map[answerKey][]Entry{}}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxEntrySize)
+	for line := 1; scanner.Scan(); line++ {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("invalid trace entry on line %d: %v", line, err)
+		}
+		if t.Start.IsZero() {
+			t.Start = entry.Time
+		}
+		if entry.Signal != "" {
+			t.Signals = append(t.Signals, entry)
+			continue
+		}
+		key := answerKey{query: entry.Query, path: entry.Path, arg: entry.Arg}
+		t.answers[key] = append(t.answers[key], entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read trace: %v", err)
+	}
+	return t, nil
+}
+
+// NetworkManager answers lookups with the recorded results
+func (t *Trace) NetworkManager() dbusapi.NetworkManager {
+	return &replayNetworkManager{t: t}
+}
+
+// Routes answers lookups with the recorded results
+func (t *Trace) Routes() netlink_api.Routes {
+	return &replayRoutes{t: t}
+}
+
+// answer returns the next recorded result of the lookup.
+// The last one repeats once all are used up, e.g. when replayed event is dispatched a bit later and polls gateway longer
+func answer[T any](t *Trace, name string, path dbus.ObjectPath, arg string) (T, error) {
+	var value T
+	key := answerKey{query: name, path: path, arg: arg}
+	t.mu.Lock()
+	results := t.answers[key]
+	if len(results) > 1 {
+		t.answers[key] = results[1:]
+	}
+	t.mu.Unlock()
+	if len(results) == 0 {
+		return value, fmt.Errorf("%s is not recorded in the trace", key)
+	}
+	if results[0].Error != "" {
+		return value, errors.New(results[0].Error)
+	}
+	if err := json.Unmarshal(results[0].Value, &value); err != nil {
+		return value, fmt.Errorf("invalid recorded %s result: %v", name, err)
+	}
+	return value, nil
+}
+
+type replayNetworkManager struct {
+	t *Trace
+}
+
+func (n *replayNetworkManager) IsConnected() bool {
+	connected, _ := answer[bool](n.t, queryIsConnected, "", "")
+	return connected
+}
+
+func (n *replayNetworkManager) Device(path dbus.ObjectPath) dbusapi.Device {
+	return &replayDevice{t: n.t, path: path}
+}
+
+func (n *replayNetworkManager) GetDeviceByInterfaceName(name string) (dbusapi.Device, error) {
+	path, err := answer[dbus.ObjectPath](n.t, queryDeviceByIpIface, "", name)
+	if err != nil {
+		return nil, err
+	}
+	return &replayDevice{t: n.t, path: path}, nil
+}
+
+func (n *replayNetworkManager) GetDevicePaths() ([]dbus.ObjectPath, error) {
+	return answer[[]dbus.ObjectPath](n.t, queryDevices, "", "")
+}
+
+func (n *replayNetworkManager) GetConnectivity() (uint32, error) {
+	return answer[uint32](n.t, queryConnectivity, "", "")
+}
+
+type replayDevice struct {
+	t    *Trace
+	path dbus.ObjectPath
+}
+
+func (d *replayDevice) Path() dbus.ObjectPath {
+	return d.path
+}
+
+func (d *replayDevice) GetState() (uint32, error) {
+	return answer[uint32](d.t, queryState, d.path, "")
+}
+
+func (d *replayDevice) GetDeviceType() (uint32, error) {
+	return answer[uint32](d.t, queryDeviceType, d.path, "")
+}
+
+func (d *replayDevice) GetInterfaceName() (string, error) {
+	return answer[string](d.t, queryInterface, d.path, "")
+}
+
+func (d *replayDevice) Ip4Config() (dbusapi.IpConfig, error) {
+	return d.object(queryIp4Config)
+}
+
+func (d *replayDevice) Ip6Config() (dbusapi.IpConfig, error) {
+	return d.object(queryIp6Config)
+}
+
+func (d *replayDevice) ActiveAccessPoint() (dbusapi.AccessPoint, error) {
+	return d.object(queryActiveAccessPoint)
+}
+
+func (d *replayDevice) ActiveConnection() (dbusapi.ActiveConnection, error) {
+	return d.object(queryActiveConnection)
+}
+
+func (d *replayDevice) object(name string) (*replayObject, error) {
+	path, err := answer[dbus.ObjectPath](d.t, name, d.path, "")
+	if err != nil {
+		return nil, err
+	}
+	return &replayObject{t: d.t, path: path}, nil
+}
+
+// replayObject is any object owned by the device: ip config, access point or active connection
+type replayObject struct {
+	t    *Trace
+	path dbus.ObjectPath
+}
+
+func (o *replayObject) Path() dbus.ObjectPath {
+	return o.path
+}
+
+func (o *replayObject) Gateway() (string, error) {
+	return answer[string](o.t, queryGateway, o.path, "")
+}
+
+func (o *replayObject) Ssid() (string, error) {
+	return answer[string](o.t, querySsid, o.path, "")
+}
+
+func (o *replayObject) Bssid() (string, error) {
+	return answer[string](o.t, queryBssid, o.path, "")
+}
+
+func (o *replayObject) Id() (string, error) {
+	return answer[string](o.t, queryConnectionId, o.path, "")
+}
+
+func (o *replayObject) Uuid() (string, error) {
+	return answer[string](o.t, queryConnectionUuid, o.path, "")
+}
+
+func (o *replayObject) Type() (string, error) {
+	return answer[string](o.t, queryConnectionType, o.path, "")
+}
+
+type replayRoutes struct {
+	t *Trace
+}
+
+func (r *replayRoutes) GetDefaultRoute() (*netlink_api.DefaultRoute, error) {
+	return answer[*netlink_api.DefaultRoute](r.t, queryDefaultRoute, "", "")
+}
+
+func (r *replayRoutes) GetDefaultGateways() (map[string]string, error) {
+	return answer[map[string]string](r.t, queryDefaultGateways, "", "")
+}
+
+func (r *replayRoutes) GetNeighbourMacAddress(ip string) (string, error) {
+	return answer[string](r.t, queryNeighbourMacAddress, "", ip)
+}
+
+func (r *replayRoutes) GetDeviceType(ifName string) string {
+	deviceType, _ := answer[string](r.t, queryDeviceTypeName, "", ifName)
+	return deviceType
+}
@@ -0,0 +1,123 @@
+// Package trace records NetworkManager signals and the lookups they caused into jsonl file
+// and replays them, so field reports could be reproduced without the reporter's network.
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Pseudo signal recorded when kernel default routes changed. It's not a dbus signal but it triggers primary-changed
+const DefaultRouteChanged = "netlink.DefaultRouteChanged"
+
+// Entry is a single line of the trace. It's either received signal or lookup made by the dispatcher
+type Entry struct {
+	Time time.Time
+	// Received signal, e.g. org.freedesktop.NetworkManager.Device.StateChanged
+	Signal string `json:",omitempty"`
+	// Lookup made by the dispatcher, e.g. Device.State or Routes.GetNeighbourMacAddress
+	Query string `json:",omitempty"`
+	// Object path of the signal or of the queried object
+	Path dbus.ObjectPath `json:",omitempty"`
+	// Lookup argument, e.g. interface name or ip address
+	Arg string `json:",omitempty"`
+	// Signal arguments
+	Body []Argument `json:",omitempty"`
+	// Lookup result
+	Value json.RawMessage `json:",omitempty"`
+	Error string          `json:",omitempty"`
+}
+
+// Argument is dbus value in its text form, e.g. {"Signature": "u", "Value": "@u 100"}
+type Argument struct {
+	Signature string
+	Value     string
+}
+
+// Recorder appends entries to the trace file. Safe for concurrent use.
+//
+// Nil recorder records nothing, so callers don't need to check whether recording is enabled
+type Recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+// Create truncates the trace file and returns recorder writing into it
+func Create(path string) (*Recorder, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace file: %v", err)
+	}
+	return &Recorder{file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// Signal records received dbus signal
+func (r *Recorder) Signal(signal *dbus.Signal) {
+	if r == nil {
+		return
+	}
+	body := make([]Argument, 0, len(signal.Body))
+	for _, value := range signal.Body {
+		variant := dbus.MakeVariant(value)
+		body = append(body, Argument{Signature: variant.Signature().String(), Value: variant.String()})
+	}
+	r.write(Entry{Signal: signal.Name, Path: signal.Path, Body: body})
+}
+
+// RouteChanged records DefaultRouteChanged pseudo signal
+func (r *Recorder) RouteChanged() {
+	if r == nil {
+		return
+	}
+	r.write(Entry{Signal: DefaultRouteChanged})
+}
+
+// query records lookup result and returns it unchanged
+func query[T any](r *Recorder, name string, path dbus.ObjectPath, arg string, value T, err error) (T, error) {
+	entry := Entry{Query: name, Path: path, Arg: arg}
+	if err != nil {
+		entry.Error = err.Error()
+	} else if data, marshalErr := json.Marshal(value); marshalErr == nil {
+		entry.Value = data
+	}
+	r.write(entry)
+	return value, err
+}
+
+func (r *Recorder) write(entry Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry.Time = time.Now()
+	// trace is best effort. Failed write must not break dispatching
+	r.encoder.Encode(entry)
+}
+
+// DBusSignal converts recorded signal entry back into the signal received from the bus
+func (e *Entry) DBusSignal() (*dbus.Signal, error) {
+	signal := &dbus.Signal{Name: e.Signal, Path: e.Path}
+	for _, argument := range e.Body {
+		signature, err := dbus.ParseSignature(argument.Signature)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature of %s argument: %v", e.Signal, err)
+		}
+		variant, err := dbus.ParseVariant(argument.Value, signature)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s argument %q: %v", e.Signal, argument.Value, err)
+		}
+		signal.Body = append(signal.Body, variant.Value())
+	}
+	return signal, nil
+}
@@ -0,0 +1,77 @@
+package trace
+
+import (
+	"errors"
+	dbusapi "network-dispatcher/dbus_api"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+func TestRecordAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	r, err := Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signals := []*dbus.Signal{
+		{Path: "/org/freedesktop/NetworkManager/Devices/3", Name: "org.freedesktop.NetworkManager.Device.StateChanged",
+			Body: []any{uint32(100), uint32(30), uint32(0)}},
+		{Path: "/org/freedesktop/NetworkManager", Name: "org.freedesktop.DBus.Properties.PropertiesChanged",
+			Body: []any{"org.freedesktop.NetworkManager", map[string]dbus.Variant{
+				"Connectivity":      dbus.MakeVariant(uint32(4)),
+				"PrimaryConnection": dbus.MakeVariant(dbus.ObjectPath("/org/freedesktop/NetworkManager/ActiveConnection/1"))},
+				[]string{"Devices"}}},
+		{Path: "/org/freedesktop/login1", Name: "org.freedesktop.login1.Manager.PrepareForSleep", Body: []any{true}},
+	}
+	nm := dbusapi.NewFakeNetworkManager()
+	recording := RecordNetworkManager(nm, r)
+	for _, signal := range signals {
+		r.Signal(signal)
+	}
+	recording.GetConnectivity()
+	nm.SetConnectivity(dbusapi.NM_CONNECTIVITY_FULL)
+	recording.GetConnectivity()
+	nm.SetAvailable(false)
+	_, recordedErr := recording.GetDevicePaths()
+	r.RouteChanged()
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	recorded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded.Signals) != len(signals)+1 || recorded.Signals[len(signals)].Signal != DefaultRouteChanged {
+		t.Fatalf("loaded signals = %+v, want %d signals and DefaultRouteChanged", recorded.Signals, len(signals))
+	}
+	for i, want := range signals {
+		got, err := recorded.Signals[i].DBusSignal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("signal %d = %#v, want %#v", i, got, want)
+		}
+	}
+
+	replay := recorded.NetworkManager()
+	// the last recorded result repeats
+	for _, want := range []uint32{dbusapi.NM_CONNECTIVITY_UNKNOWN, dbusapi.NM_CONNECTIVITY_FULL, dbusapi.NM_CONNECTIVITY_FULL} {
+		if got, err := replay.GetConnectivity(); err != nil || got != want {
+			t.Errorf("GetConnectivity() = %d, %v, want %d", got, err, want)
+		}
+	}
+	if _, err := replay.GetDevicePaths(); err == nil || err.Error() != recordedErr.Error() {
+		t.Errorf("GetDevicePaths() error = %v, want %v", err, recordedErr)
+	}
+	if _, err := replay.Device("/org/freedesktop/NetworkManager/Devices/3").GetState(); err == nil {
+		t.Error("GetState() of not recorded device succeeded")
+	}
+	if recordedErr == nil {
+		t.Error(errors.New("fake NetworkManager was available"))
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"network-dispatcher/config"
+	"os"
+)
+
+// runValidate implements `network-dispatcher validate [--config path]`.
+//
+// Checks the config the same way daemon loads it plus unknown fields, mac addresses and scripts.
+// Returns process exit code: 0 when config has no problems
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	path := flags.String("config", getConfigFilePath(), "Path to the configuration file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s validate [--config path]\n", ApplicationName)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() > 0 {
+		*path = flags.Arg(0)
+	}
+
+	conf, report, err := config.CheckFile(*path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	for _, d := range report.Diagnostics {
+		separator := " "
+		if d.Line > 0 {
+			separator = ""
+		}
+		fmt.Fprintf(os.Stderr, "%s:%s%s\n", *path, separator, d)
+	}
+	if report.HasProblems() {
+		fmt.Fprintf(os.Stderr, "%s: %d problems found\n", *path, len(report.Diagnostics))
+		return 1
+	}
+	fmt.Printf("%s: OK, %d entities\n", *path, len(conf.Entities))
+	return 0
+}